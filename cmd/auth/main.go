@@ -19,6 +19,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/apexskier/strava-tile-proxy/strava"
 	"github.com/chromedp/cdproto/storage"
 	"github.com/chromedp/chromedp"
 )
@@ -91,7 +92,7 @@ func main() {
 		log.Fatal("_strava4_session cookie not found")
 	}
 
-	content := fmt.Sprintf("STRAVA_REMEMBER_TOKEN=%s\nSTRAVA4_SESSION=%s\n", rememberToken, stravaSession)
+	content := fmt.Sprintf("%s=%s\n%s=%s\n", strava.EnvRememberToken, rememberToken, strava.EnvSession, stravaSession)
 	if err := os.MkdirAll(filepath.Dir(*sessionPath), 0700); err != nil {
 		log.Fatalf("mkdir: %v", err)
 	}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+// maxRetries is how many times a tile is retried when Strava is rate
+// limiting or failing.
+const maxRetries = 3
+
+// layer is the heatmap being exported.
+type layer struct {
+	personal bool
+	color    strava.Heat
+	sports   string
+	// filter selects the activities on personal heatmaps, its sports are
+	// ignored in favor of sports
+	filter strava.HeatmapFilter
+}
+
+type exporter struct {
+	client      strava.Client
+	layer       layer
+	out         *mbtiles
+	interval    time.Duration
+	concurrency int
+	logger      *log.Logger
+
+	personalHeatmapDomain string
+	globalHeatmapDomain   string
+}
+
+// tileURL returns the Strava URL for a tile, matching the tile proxy.
+func (e *exporter) tileURL(t geo.Tile) (string, error) {
+	if !e.layer.personal {
+		return strava.GlobalHeatmapURL(e.globalHeatmapDomain, e.layer.sports, e.layer.color, t.Z, t.X, t.Y), nil
+	}
+	athleteID, err := e.client.AthleteID()
+	if err != nil {
+		return "", err
+	}
+	filter := e.layer.filter
+	filter.Sports = e.layer.sports
+	return strava.PersonalHeatmapURL(e.personalHeatmapDomain, athleteID, e.layer.color, t.Z, t.X, t.Y, filter), nil
+}
+
+// layerMetadata is the MBTiles metadata entry describing the exported layer.
+const layerMetadata = "strava_layer"
+
+// layerDescription describes everything that changes the exported tiles, so
+// exports can only be resumed with the same options.
+func (e *exporter) layerDescription() (string, error) {
+	if !e.layer.personal {
+		return url.Values{
+			"kind":   []string{"global"},
+			"color":  []string{string(e.layer.color)},
+			"sports": []string{e.layer.sports},
+		}.Encode(), nil
+	}
+	athleteID, err := e.client.AthleteID()
+	if err != nil {
+		return "", err
+	}
+	return url.Values{
+		"kind":                 []string{"personal"},
+		"athlete":              []string{athleteID},
+		"color":                []string{string(e.layer.color)},
+		"sports":               []string{e.layer.sports},
+		"start":                []string{e.layer.filter.Start},
+		"end":                  []string{e.layer.filter.End},
+		"commutes":             []string{strconv.FormatBool(e.layer.filter.IncludeCommutes)},
+		"reveal_privacy_zones": []string{strconv.FormatBool(e.layer.filter.RevealPrivacyZones)},
+		"reveal_only_me":       []string{strconv.FormatBool(e.layer.filter.RevealOnlyMeActivities)},
+		"reveal_followers":     []string{strconv.FormatBool(e.layer.filter.RevealFollowerOnlyActivities)},
+		"reveal_public":        []string{strconv.FormatBool(e.layer.filter.RevealPublicActivities)},
+	}.Encode(), nil
+}
+
+// claimOutput records the layer being exported in the output's metadata, or
+// returns an error if the output already has tiles from a different layer.
+func (e *exporter) claimOutput() error {
+	description, err := e.layerDescription()
+	if err != nil {
+		return err
+	}
+	existing, ok, err := e.out.metadata(layerMetadata)
+	if err != nil {
+		return err
+	}
+	if ok && existing != description {
+		return errors.Errorf("output has tiles from a different layer (%s), use another file or the same options", existing)
+	}
+	return e.out.setMetadata(map[string]string{layerMetadata: description})
+}
+
+// export downloads every tile in region between minZoom and maxZoom that
+// isn't already in the output.
+func (e *exporter) export(ctx context.Context, region geo.Region, minZoom, maxZoom uint64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	tiles := make(chan geo.Tile)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var exportErr error
+	for range e.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tiles {
+				select {
+				case <-ctx.Done():
+					continue
+				case <-ticker.C:
+				}
+				if err := e.exportTile(ctx, t); err != nil {
+					errOnce.Do(func() {
+						exportErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+
+	err := e.queue(ctx, region, minZoom, maxZoom, tiles)
+	close(tiles)
+	wg.Wait()
+	if exportErr != nil {
+		return exportErr
+	}
+	return err
+}
+
+// queue sends the tiles still to be exported to tiles, logging progress.
+func (e *exporter) queue(ctx context.Context, region geo.Region, minZoom, maxZoom uint64, tiles chan<- geo.Tile) error {
+	for z := minZoom; z <= maxZoom; z++ {
+		covering := geo.CoveringTiles(region, z)
+		skipped := 0
+		for i, t := range covering {
+			done, err := e.out.done(t)
+			if err != nil {
+				return err
+			}
+			if done {
+				skipped++
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case tiles <- t:
+			}
+			if (i+1)%100 == 0 {
+				e.logger.Printf("zoom %d: %d of %d tiles", z, i+1, len(covering))
+			}
+		}
+		e.logger.Printf("zoom %d: queued %d tiles, %d already exported", z, len(covering)-skipped, skipped)
+	}
+	return nil
+}
+
+func (e *exporter) exportTile(ctx context.Context, t geo.Tile) error {
+	data, err := e.fetch(ctx, t)
+	if err != nil {
+		return errors.Wrapf(err, "tile %d/%d/%d", t.Z, t.X, t.Y)
+	}
+	if data == nil {
+		return e.out.putEmpty(t)
+	}
+	return e.out.putTile(t, data)
+}
+
+// fetch downloads a tile, returning nil if Strava has nothing there.
+// CloudFront cookies are refreshed once if they're rejected, and rate limited
+// or failed requests are retried with backoff.
+func (e *exporter) fetch(ctx context.Context, t geo.Tile) ([]byte, error) {
+	tileURL, err := e.tileURL(t)
+	if err != nil {
+		return nil, err
+	}
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, tileURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		res, err := e.client.HttpClient().Do(req)
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case res.StatusCode == http.StatusOK:
+			return data, nil
+		case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusNoContent:
+			return nil, nil
+		case (res.StatusCode == http.StatusUnauthorized || res.StatusCode == http.StatusForbidden) && !refreshed:
+			refreshed = true
+			if err := e.client.RefreshCloudFrontCookies(); err != nil {
+				return nil, err
+			}
+		case (res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500) && attempt < maxRetries:
+			backoff := time.Duration(1<<attempt) * time.Second
+			e.logger.Printf("tile %d/%d/%d: %s, retrying in %s", t.Z, t.X, t.Y, res.Status, backoff)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+		default:
+			return nil, errors.Errorf("unexpected status %s", res.Status)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/pmtiles"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClient struct {
+	strava.Client
+	httpClient *http.Client
+	refreshes  int
+}
+
+func (c *fakeClient) HttpClient() *http.Client {
+	return c.httpClient
+}
+
+func (c *fakeClient) RefreshCloudFrontCookies() error {
+	c.refreshes++
+	return nil
+}
+
+func (c *fakeClient) AthleteID() (string, error) {
+	return "123", nil
+}
+
+func TestMBTiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.mbtiles")
+	out, err := openMBTiles(path)
+	require.NoError(t, err)
+
+	tile := geo.Tile{Z: 10, X: 163, Y: 357}
+	done, err := out.done(tile)
+	require.NoError(t, err)
+	assert.False(t, done)
+
+	require.NoError(t, out.putTile(tile, []byte("png")))
+	require.NoError(t, out.putEmpty(geo.Tile{Z: 10, X: 164, Y: 357}))
+	require.NoError(t, out.setMetadata(map[string]string{"name": "test", "format": "png"}))
+	require.NoError(t, out.Close())
+
+	// reopening keeps what was already exported
+	out, err = openMBTiles(path)
+	require.NoError(t, err)
+	defer out.Close()
+	for _, tile := range []geo.Tile{{Z: 10, X: 163, Y: 357}, {Z: 10, X: 164, Y: 357}} {
+		done, err := out.done(tile)
+		require.NoError(t, err)
+		assert.True(t, done)
+	}
+	data, err := out.tile(tile)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("png"), data)
+
+	// rows are stored in TMS order
+	var row int
+	require.NoError(t, out.db.QueryRow(`SELECT tile_row FROM tiles`).Scan(&row))
+	assert.Equal(t, 1024-1-357, row)
+	var name string
+	require.NoError(t, out.db.QueryRow(`SELECT value FROM metadata WHERE name = 'name'`).Scan(&name))
+	assert.Equal(t, "test", name)
+}
+
+func TestExport(t *testing.T) {
+	var lock sync.Mutex
+	var requested []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requested = append(requested, r.URL.Path)
+		count := len(requested)
+		lock.Unlock()
+		assert.Equal(t, "true", r.URL.Query().Get(strava.ParamRespectPrivacyZones))
+		if count == 1 {
+			// the first request needs fresh cookies
+			rw.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/11/327/714@2x.png") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		io.WriteString(rw, r.URL.Path)
+	}))
+	defer mockServer.Close()
+
+	out, err := openMBTiles(filepath.Join(t.TempDir(), "out.mbtiles"))
+	require.NoError(t, err)
+	defer out.Close()
+
+	client := &fakeClient{httpClient: mockServer.Client()}
+	e := &exporter{
+		client:      client,
+		layer:       layer{personal: true, color: strava.HeatOrange, sports: "Run"},
+		out:         out,
+		interval:    time.Millisecond,
+		concurrency: 2,
+		logger:      log.Default(),
+
+		personalHeatmapDomain: mockServer.URL,
+	}
+	// a tile at zoom 10, and the four tiles it contains at zoom 11
+	region := geo.Tile{Z: 10, X: 163, Y: 357}.BBox()
+	region.MinLon += 0.001
+	region.MinLat += 0.001
+	region.MaxLon -= 0.001
+	region.MaxLat -= 0.001
+	require.NoError(t, e.claimOutput())
+	require.NoError(t, e.export(context.Background(), region, 10, 11))
+	assert.Equal(t, 1, client.refreshes)
+	assert.Len(t, requested, 6)
+
+	data, err := out.tile(geo.Tile{Z: 11, X: 326, Y: 715})
+	require.NoError(t, err)
+	assert.Equal(t, "/tiles/123/orange/11/326/715@2x.png", string(data))
+	done, err := out.done(geo.Tile{Z: 11, X: 327, Y: 714})
+	require.NoError(t, err)
+	assert.True(t, done)
+
+	// running again doesn't request anything
+	requested = nil
+	require.NoError(t, e.claimOutput())
+	require.NoError(t, e.export(context.Background(), region, 10, 11))
+	assert.Empty(t, requested)
+
+	// but it can't be resumed with options that change the tiles
+	for _, l := range []layer{
+		{personal: true, color: strava.HeatRed, sports: "Run"},
+		{personal: true, color: strava.HeatOrange, sports: "Run", filter: strava.HeatmapFilter{Start: "2024-01-01"}},
+		{color: strava.HeatOrange, sports: "Run"},
+	} {
+		e.layer = l
+		assert.Error(t, e.claimOutput(), l)
+	}
+}
+
+func TestWritePMTiles(t *testing.T) {
+	dir := t.TempDir()
+	out, err := openMBTiles(filepath.Join(dir, "out.mbtiles"))
+	require.NoError(t, err)
+	defer out.Close()
+	for _, tile := range []geo.Tile{{Z: 11, X: 327, Y: 714}, {Z: 10, X: 163, Y: 357}, {Z: 11, X: 326, Y: 715}} {
+		require.NoError(t, out.putTile(tile, []byte(fmt.Sprint(tile))))
+	}
+
+	path := filepath.Join(dir, "out.pmtiles")
+	bounds := geo.Tile{Z: 10, X: 163, Y: 357}.BBox()
+	require.NoError(t, writePMTiles(out, path, 10, 11, bounds, map[string]string{"name": "test"}))
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := pmtiles.Open(f)
+	require.NoError(t, err)
+	assert.Equal(t, uint8(10), r.Header().MinZoom)
+	assert.Equal(t, uint64(3), r.Header().AddressedTilesCount)
+	data, ok, err := r.Tile(11, 326, 715)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, fmt.Sprint(geo.Tile{Z: 11, X: 326, Y: 715}), string(data))
+}
@@ -0,0 +1,227 @@
+// cmd/export downloads heatmap tiles for a region into an MBTiles file, for
+// offline use in apps like Gaia GPS.
+//
+// Usage:
+//
+//	go run ./cmd/export -bbox -122.5,47.5,-122.2,47.8 -o seattle.mbtiles
+//	go run ./cmd/export -polygon area.geojson -kind global -color purple -sports ride -o area.mbtiles
+//
+// The output is written as MBTiles, or PMTiles if its name ends in .pmtiles.
+// An interrupted export resumes where it left off when run again with the
+// same output file and layer options.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+func main() {
+	if err := run(); err != nil {
+		if errors.Is(err, context.Canceled) {
+			log.Fatal("interrupted, run again with the same output file to resume")
+		}
+		log.Fatal(err)
+	}
+}
+
+func run() error {
+	sessionPath := flag.String("session", ".env.auth", "path to the session file written by cmd/auth")
+	output := flag.String("o", "", "MBTiles or PMTiles (.pmtiles) file to write")
+	bbox := flag.String("bbox", "", "region to export, as min_lon,min_lat,max_lon,max_lat")
+	polygon := flag.String("polygon", "", "GeoJSON file with the polygon(s) to export, instead of -bbox")
+	minZoom := flag.Uint64("minzoom", strava.HeatmapMinZoom, "lowest zoom level to export")
+	maxZoom := flag.Uint64("maxzoom", strava.HeatmapMaxZoom, "highest zoom level to export")
+	kind := flag.String("kind", "personal", "personal or global")
+	color := flag.String("color", "", `heat color (default "orange" for personal, "blue" for global)`)
+	sports := flag.String("sports", string(strava.SportAll), "comma separated sports")
+	start := flag.String("start", "", "personal only, only include activities on or after this date (YYYY-MM-DD)")
+	end := flag.String("end", "", "personal only, only include activities on or before this date (YYYY-MM-DD)")
+	commutes := flag.Bool("commutes", true, "personal only, include commutes")
+	revealPrivacyZones := flag.Bool("reveal-privacy-zones", false, "personal only, show activities in privacy zones")
+	revealOnlyMe := flag.Bool("reveal-only-me", true, `personal only, include "only me" activities`)
+	revealFollowers := flag.Bool("reveal-followers", true, "personal only, include follower only activities")
+	revealPublic := flag.Bool("reveal-public", true, "personal only, include public activities")
+	rate := flag.Float64("rate", 5, "maximum tile requests per second")
+	concurrency := flag.Int("concurrency", 2, "maximum concurrent tile requests")
+	name := flag.String("name", "", "name stored in the MBTiles metadata")
+	flag.Parse()
+
+	if *output == "" {
+		return errors.New("-o is required")
+	}
+	region, err := parseRegion(*bbox, *polygon)
+	if err != nil {
+		return err
+	}
+	if *minZoom > *maxZoom || *maxZoom > strava.HeatmapMaxZoom {
+		return errors.Errorf("zoom levels must be between 0 and %d", strava.HeatmapMaxZoom)
+	}
+	if *rate <= 0 || *concurrency <= 0 {
+		return errors.New("-rate and -concurrency must be positive")
+	}
+
+	layer := layer{
+		personal: *kind == "personal",
+		sports:   *sports,
+		filter: strava.HeatmapFilter{
+			IncludeCommutes:              *commutes,
+			RevealPrivacyZones:           *revealPrivacyZones,
+			RevealOnlyMeActivities:       *revealOnlyMe,
+			RevealFollowerOnlyActivities: *revealFollowers,
+			RevealPublicActivities:       *revealPublic,
+		},
+	}
+	switch *kind {
+	case "personal":
+		layer.color = strava.HeatOrange
+	case "global":
+		layer.color = strava.HeatBlue
+	default:
+		return errors.New("-kind must be personal or global")
+	}
+	if *color != "" {
+		layer.color, err = strava.ParseHeat(*color)
+		if err != nil {
+			return err
+		}
+	}
+	for _, date := range []string{*start, *end} {
+		if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+			return errors.Errorf("bad date %s, expected YYYY-MM-DD", date)
+		}
+	}
+	layer.filter.Start, layer.filter.End = *start, *end
+
+	session, err := strava.ReadSessionFile(*sessionPath)
+	if err != nil {
+		return errors.Wrap(err, "reading session")
+	}
+	client, err := strava.NewClient(session.RememberToken, session.Session)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := client.RefreshCloudFrontCookies(); err != nil {
+		return errors.Wrap(err, "logging in to strava")
+	}
+
+	bounds := region.Bounds()
+	if *name == "" {
+		*name = fmt.Sprintf("Strava %s heatmap (%s, %s)", *kind, layer.sports, layer.color)
+	}
+	metadata := map[string]string{
+		"name":        *name,
+		"format":      "png",
+		"type":        "overlay",
+		"version":     "1",
+		"description": fmt.Sprintf("Exported %s", time.Now().Format(time.RFC3339)),
+		"attribution": `<a href="https://www.strava.com" target="_blank">&copy; Strava</a>`,
+		"minzoom":     strconv.FormatUint(*minZoom, 10),
+		"maxzoom":     strconv.FormatUint(*maxZoom, 10),
+		"bounds":      fmt.Sprintf("%f,%f,%f,%f", bounds.MinLon, bounds.MinLat, bounds.MaxLon, bounds.MaxLat),
+		"center":      fmt.Sprintf("%f,%f,%d", (bounds.MinLon+bounds.MaxLon)/2, (bounds.MinLat+bounds.MaxLat)/2, *minZoom),
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// PMTiles archives can't be appended to, so tiles are downloaded to an
+	// MBTiles file that's converted once the export is complete
+	mbtilesPath := *output
+	pmtilesPath := ""
+	if strings.HasSuffix(*output, ".pmtiles") {
+		mbtilesPath = *output + ".mbtiles"
+		pmtilesPath = *output
+	}
+	out, err := openMBTiles(mbtilesPath)
+	if err != nil {
+		return err
+	}
+	e := &exporter{
+		client:      client,
+		layer:       layer,
+		out:         out,
+		interval:    time.Duration(float64(time.Second) / *rate),
+		concurrency: *concurrency,
+		logger:      log.Default(),
+
+		personalHeatmapDomain: strava.PersonalHeatmapDomain,
+		globalHeatmapDomain:   strava.GlobalHeatmapDomain,
+	}
+	err = exportTo(ctx, e, pmtilesPath, region, *minZoom, *maxZoom, metadata)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if pmtilesPath != "" {
+		if err := os.Remove(mbtilesPath); err != nil {
+			log.Printf("removing %s: %v", mbtilesPath, err)
+		}
+	}
+	log.Printf("exported to %s", *output)
+	return nil
+}
+
+// exportTo exports tiles into e's output, and converts it to a PMTiles
+// archive at pmtilesPath if that's set.
+func exportTo(ctx context.Context, e *exporter, pmtilesPath string, region geo.Region, minZoom, maxZoom uint64, metadata map[string]string) error {
+	if err := e.claimOutput(); err != nil {
+		return err
+	}
+	if err := e.out.setMetadata(metadata); err != nil {
+		return err
+	}
+	if err := e.export(ctx, region, minZoom, maxZoom); err != nil {
+		return err
+	}
+	if pmtilesPath == "" {
+		return nil
+	}
+	return writePMTiles(e.out, pmtilesPath, minZoom, maxZoom, region.Bounds(), metadata)
+}
+
+// parseRegion reads the region to export from either -bbox or -polygon.
+func parseRegion(bbox, polygon string) (geo.Region, error) {
+	if (bbox == "") == (polygon == "") {
+		return nil, errors.New("one of -bbox or -polygon is required")
+	}
+	if polygon != "" {
+		data, err := os.ReadFile(polygon)
+		if err != nil {
+			return nil, err
+		}
+		return geo.ParseGeoJSON(data)
+	}
+	parts := strings.Split(bbox, ",")
+	if len(parts) != 4 {
+		return nil, errors.New("-bbox must be min_lon,min_lat,max_lon,max_lat")
+	}
+	var values [4]float64
+	for i, part := range parts {
+		var err error
+		values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad -bbox")
+		}
+	}
+	region := geo.BBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+	if !region.Valid() {
+		return nil, errors.New("-bbox must be min_lon,min_lat,max_lon,max_lat")
+	}
+	return region, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite"
+)
+
+// mbtiles writes tiles to an MBTiles 1.3 file,
+// https://github.com/mapbox/mbtiles-spec/blob/master/1.3/spec.md
+type mbtiles struct {
+	db *sql.DB
+}
+
+const mbtilesSchema = `
+CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT);
+CREATE UNIQUE INDEX IF NOT EXISTS metadata_name ON metadata (name);
+CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+CREATE UNIQUE INDEX IF NOT EXISTS tile_index ON tiles (zoom_level, tile_column, tile_row);
+-- tiles Strava has nothing for, so resuming an export doesn't request them again
+CREATE TABLE IF NOT EXISTS export_empty (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, PRIMARY KEY (zoom_level, tile_column, tile_row));
+`
+
+// openMBTiles opens or creates an MBTiles file. Tiles already in an existing
+// file are kept, so an interrupted export can be resumed.
+func openMBTiles(path string) (*mbtiles, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite only supports one writer
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(mbtilesSchema); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "creating MBTiles schema")
+	}
+	return &mbtiles{db: db}, nil
+}
+
+func (m *mbtiles) Close() error {
+	return m.db.Close()
+}
+
+func (m *mbtiles) setMetadata(metadata map[string]string) error {
+	for name, value := range metadata {
+		if _, err := m.db.Exec(`INSERT OR REPLACE INTO metadata (name, value) VALUES (?, ?)`, name, value); err != nil {
+			return errors.Wrapf(err, "writing metadata %s", name)
+		}
+	}
+	return nil
+}
+
+// metadata returns a metadata value, and whether it's set.
+func (m *mbtiles) metadata(name string) (string, bool, error) {
+	var value string
+	err := m.db.QueryRow(`SELECT value FROM metadata WHERE name = ?`, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", false, nil
+	}
+	return value, err == nil, err
+}
+
+// tmsRow converts an XYZ row to the TMS row MBTiles uses, which counts from
+// the bottom.
+func tmsRow(t geo.Tile) uint64 {
+	return geo.Tiles(t.Z) - 1 - t.Y
+}
+
+// done reports whether a tile has already been exported.
+func (m *mbtiles) done(t geo.Tile) (bool, error) {
+	var count int
+	err := m.db.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM tiles WHERE zoom_level = ?1 AND tile_column = ?2 AND tile_row = ?3)
+		      + (SELECT COUNT(*) FROM export_empty WHERE zoom_level = ?1 AND tile_column = ?2 AND tile_row = ?3)`,
+		t.Z, t.X, tmsRow(t),
+	).Scan(&count)
+	return count > 0, err
+}
+
+func (m *mbtiles) putTile(t geo.Tile, data []byte) error {
+	_, err := m.db.Exec(
+		`INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)`,
+		t.Z, t.X, tmsRow(t), data,
+	)
+	return err
+}
+
+// putEmpty records that Strava has no tile at t.
+func (m *mbtiles) putEmpty(t geo.Tile) error {
+	_, err := m.db.Exec(
+		`INSERT OR REPLACE INTO export_empty (zoom_level, tile_column, tile_row) VALUES (?, ?, ?)`,
+		t.Z, t.X, tmsRow(t),
+	)
+	return err
+}
+
+// tile returns the data for a tile, or nil if it isn't in the file.
+func (m *mbtiles) tile(t geo.Tile) ([]byte, error) {
+	var data []byte
+	err := m.db.QueryRow(
+		`SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?`,
+		t.Z, t.X, tmsRow(t),
+	).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return data, err
+}
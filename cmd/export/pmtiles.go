@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/pmtiles"
+	"github.com/pkg/errors"
+)
+
+// writePMTiles converts the tiles in an MBTiles file to a PMTiles archive.
+func writePMTiles(m *mbtiles, path string, minZoom, maxZoom uint64, bounds geo.BBox, metadata map[string]string) error {
+	rows, err := m.db.Query(`SELECT zoom_level, tile_column, tile_row FROM tiles`)
+	if err != nil {
+		return err
+	}
+	var tiles []geo.Tile
+	for rows.Next() {
+		var t geo.Tile
+		var row uint64
+		if err := rows.Scan(&t.Z, &t.X, &row); err != nil {
+			rows.Close()
+			return err
+		}
+		t.Y = geo.Tiles(t.Z) - 1 - row
+		tiles = append(tiles, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// archives must be written in tile ID order
+	sort.Slice(tiles, func(i, j int) bool {
+		return pmtilesID(tiles[i]) < pmtilesID(tiles[j])
+	})
+
+	w, err := pmtiles.NewWriter("")
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	for _, t := range tiles {
+		data, err := m.tile(t)
+		if err != nil {
+			return err
+		}
+		if err := w.AddTile(uint8(t.Z), uint32(t.X), uint32(t.Y), data); err != nil {
+			return err
+		}
+	}
+
+	// write to a temporary file first so a failed conversion doesn't leave a
+	// broken archive behind
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	err = w.Finish(tmp, pmtiles.Header{
+		TileType:   pmtiles.TileTypePNG,
+		MinZoom:    uint8(minZoom),
+		MaxZoom:    uint8(maxZoom),
+		MinLon:     bounds.MinLon,
+		MinLat:     bounds.MinLat,
+		MaxLon:     bounds.MaxLon,
+		MaxLat:     bounds.MaxLat,
+		CenterZoom: uint8(minZoom),
+		CenterLon:  (bounds.MinLon + bounds.MaxLon) / 2,
+		CenterLat:  (bounds.MinLat + bounds.MaxLat) / 2,
+	}, metadata)
+	if err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "writing PMTiles")
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func pmtilesID(t geo.Tile) uint64 {
+	return pmtiles.TileID(uint8(t.Z), uint32(t.X), uint32(t.Y))
+}
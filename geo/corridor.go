@@ -0,0 +1,324 @@
+package geo
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"math"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// Line is a path through points, such as a planned route.
+type Line []Point
+
+// Corridor is a Region made of the area within Buffer meters of lines.
+type Corridor struct {
+	Lines  []Line
+	Buffer float64
+}
+
+// bufferDegrees returns the buffer as degrees of longitude and latitude
+// around points up to lat degrees from the equator.
+func (c Corridor) bufferDegrees(lat float64) (dLon, dLat float64) {
+	dLat = c.Buffer / EarthRadius * 180 / math.Pi
+	// degrees of longitude are narrowest at the edge of the buffer furthest
+	// from the equator
+	lat = math.Min(math.Abs(lat)+dLat, MaxLatitude)
+	return dLat / math.Cos(lat*math.Pi/180), dLat
+}
+
+// segmentBounds returns the box around a segment, including the buffer.
+func (c Corridor) segmentBounds(a, b Point) BBox {
+	dLon, dLat := c.bufferDegrees(math.Max(math.Abs(a.Lat), math.Abs(b.Lat)))
+	return BBox{
+		MinLon: math.Max(-180, math.Min(a.Lon, b.Lon)-dLon),
+		MinLat: math.Max(-90, math.Min(a.Lat, b.Lat)-dLat),
+		MaxLon: math.Min(180, math.Max(a.Lon, b.Lon)+dLon),
+		MaxLat: math.Min(90, math.Max(a.Lat, b.Lat)+dLat),
+	}
+}
+
+// segments calls fn with each segment of the corridor's lines. A line of one
+// point is a segment from the point to itself.
+func (c Corridor) segments(fn func(a, b Point) bool) {
+	for _, line := range c.Lines {
+		if len(line) == 1 {
+			if !fn(line[0], line[0]) {
+				return
+			}
+		}
+		for i := 1; i < len(line); i++ {
+			if !fn(line[i-1], line[i]) {
+				return
+			}
+		}
+	}
+}
+
+func (c Corridor) Bounds() BBox {
+	b := BBox{MinLon: math.Inf(1), MinLat: math.Inf(1), MaxLon: math.Inf(-1), MaxLat: math.Inf(-1)}
+	c.segments(func(p, q Point) bool {
+		s := c.segmentBounds(p, q)
+		b.MinLon, b.MaxLon = math.Min(b.MinLon, s.MinLon), math.Max(b.MaxLon, s.MaxLon)
+		b.MinLat, b.MaxLat = math.Min(b.MinLat, s.MinLat), math.Max(b.MaxLat, s.MaxLat)
+		return true
+	})
+	return b
+}
+
+func (c Corridor) IntersectsTile(t Tile) bool {
+	box := t.BBox()
+	near := false
+	c.segments(func(a, b Point) bool {
+		near = c.segmentBounds(a, b).Intersects(box) && c.segmentNearBox(a, b, box)
+		return !near
+	})
+	return near
+}
+
+// mercatorPoint is a point in web mercator meters.
+type mercatorPoint struct {
+	X float64
+	Y float64
+}
+
+func toMercator(p Point) mercatorPoint {
+	x, y := LonLatToMercator(p.Lon, p.Lat)
+	return mercatorPoint{X: x, Y: y}
+}
+
+func (p mercatorPoint) xy() (x, y float64) {
+	return p.X, p.Y
+}
+
+// segmentNearBox reports whether a segment comes within the buffer of a box.
+// Distances are measured in web mercator, scaled by the latitude furthest from
+// the equator so the corridor is never narrower than the buffer.
+func (c Corridor) segmentNearBox(a, b Point, box BBox) bool {
+	lat := math.Max(math.Max(math.Abs(a.Lat), math.Abs(b.Lat)), math.Max(math.Abs(box.MinLat), math.Abs(box.MaxLat)))
+	lat = math.Min(lat, MaxLatitude)
+	buffer := c.Buffer / math.Cos(lat*math.Pi/180)
+
+	ma, mb := toMercator(a), toMercator(b)
+	lo, hi := toMercator(Point{Lon: box.MinLon, Lat: box.MinLat}), toMercator(Point{Lon: box.MaxLon, Lat: box.MaxLat})
+	rect := [4]mercatorPoint{{lo.X, lo.Y}, {hi.X, lo.Y}, {hi.X, hi.Y}, {lo.X, hi.Y}}
+
+	// either end in the box, or the segment crossing an edge, is inside
+	if ma.X >= lo.X && ma.X <= hi.X && ma.Y >= lo.Y && ma.Y <= hi.Y {
+		return true
+	}
+	for i, p := range rect {
+		if segmentsIntersect(ma, mb, p, rect[(i+1)%4]) {
+			return true
+		}
+	}
+
+	// otherwise the closest point is an end of the segment or a corner
+	distance := math.Min(
+		math.Hypot(math.Max(0, math.Max(lo.X-ma.X, ma.X-hi.X)), math.Max(0, math.Max(lo.Y-ma.Y, ma.Y-hi.Y))),
+		math.Hypot(math.Max(0, math.Max(lo.X-mb.X, mb.X-hi.X)), math.Max(0, math.Max(lo.Y-mb.Y, mb.Y-hi.Y))),
+	)
+	for _, p := range rect {
+		distance = math.Min(distance, pointSegmentDistance(p.X, p.Y, ma.X, ma.Y, mb.X, mb.Y))
+	}
+	return distance <= buffer
+}
+
+// pointSegmentDistance returns the distance from (px, py) to the segment
+// from (ax, ay) to (bx, by).
+func pointSegmentDistance(px, py, ax, ay, bx, by float64) float64 {
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, ((px-ax)*dx+(py-ay)*dy)/length))
+	}
+	return math.Hypot(px-(ax+t*dx), py-(ay+t*dy))
+}
+
+// coveringTiles lists the tiles near each segment by walking along it, rather
+// than scanning the whole bounding box, which is mostly empty for a long route.
+// It stops, returning false, once there are more than limit tiles.
+func (c Corridor) coveringTiles(z uint64, limit int) ([]Tile, bool) {
+	seen := map[Tile]bool{}
+	var tiles []Tile
+	c.segments(func(a, b Point) bool {
+		minX, minY, maxX, maxY := c.segmentBounds(a, b).TileRange(z)
+		// the buffer in tiles, at its widest in the rows near the segment
+		_, top := TileToLonLat(0, float64(minY), z)
+		_, bottom := TileToLonLat(0, float64(maxY+1), z)
+		lat := math.Min(math.Max(math.Abs(top), math.Abs(bottom)), MaxLatitude)
+		buffer := c.Buffer / math.Cos(lat*math.Pi/180) / (2 * MercatorExtent) * float64(Tiles(z))
+		// candidates are the tiles around points at most a tile apart along the
+		// segment, so every point on it is within half a tile of one of them
+		reach := buffer + 0.5
+
+		ax, ay := LonLatToTile(a.Lon, a.Lat, z)
+		bx, by := LonLatToTile(b.Lon, b.Lat, z)
+		steps := math.Ceil(math.Hypot(bx-ax, by-ay))
+		for i := 0.0; i <= steps; i++ {
+			f := 0.0
+			if steps > 0 {
+				f = i / steps
+			}
+			px, py := ax+f*(bx-ax), ay+f*(by-ay)
+			x0 := uint64(math.Max(float64(minX), math.Floor(px-reach)))
+			x1 := uint64(math.Min(float64(maxX), math.Floor(px+reach)))
+			y0 := uint64(math.Max(float64(minY), math.Floor(py-reach)))
+			y1 := uint64(math.Min(float64(maxY), math.Floor(py+reach)))
+			for y := y0; y <= y1; y++ {
+				for x := x0; x <= x1; x++ {
+					t := Tile{Z: z, X: x, Y: y}
+					if seen[t] || !c.segmentNearBox(a, b, t.BBox()) {
+						continue
+					}
+					seen[t] = true
+					tiles = append(tiles, t)
+					if len(tiles) > limit {
+						return false
+					}
+				}
+			}
+		}
+		return true
+	})
+	if len(tiles) > limit {
+		return nil, false
+	}
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].Y != tiles[j].Y {
+			return tiles[i].Y < tiles[j].Y
+		}
+		return tiles[i].X < tiles[j].X
+	})
+	return tiles, true
+}
+
+// ParseGeoJSONLines reads the lines in a GeoJSON geometry, feature or feature
+// collection. Other geometry types are ignored.
+func ParseGeoJSONLines(data []byte) ([]Line, error) {
+	var doc geoJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing GeoJSON")
+	}
+	lines, err := doc.lines()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("GeoJSON has no lines")
+	}
+	if err := checkLines(lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// checkLines returns an error if any point is outside the valid range of
+// longitudes and latitudes.
+func checkLines(lines []Line) error {
+	for _, line := range lines {
+		for _, p := range line {
+			if !(p.Lon >= -180 && p.Lon <= 180 && p.Lat >= -90 && p.Lat <= 90) {
+				return errors.Errorf("point %g,%g is out of range", p.Lon, p.Lat)
+			}
+		}
+	}
+	return nil
+}
+
+func (g geoJSON) lines() ([]Line, error) {
+	switch g.Type {
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, nil
+		}
+		return g.Geometry.lines()
+	case "FeatureCollection", "GeometryCollection":
+		var lines []Line
+		for _, child := range append(g.Features, g.Geometries...) {
+			childLines, err := child.lines()
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, childLines...)
+		}
+		return lines, nil
+	case "LineString":
+		var coordinates [][2]float64
+		if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+			return nil, errors.Wrap(err, "parsing LineString")
+		}
+		return []Line{toLine(coordinates)}, nil
+	case "MultiLineString":
+		var coordinates [][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+			return nil, errors.Wrap(err, "parsing MultiLineString")
+		}
+		var lines []Line
+		for _, line := range coordinates {
+			lines = append(lines, toLine(line))
+		}
+		return lines, nil
+	}
+	return nil, nil
+}
+
+func toLine(coordinates [][2]float64) Line {
+	line := make(Line, len(coordinates))
+	for i, c := range coordinates {
+		line[i] = Point{Lon: c[0], Lat: c[1]}
+	}
+	return line
+}
+
+type gpxPoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+}
+
+type gpx struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []gpxPoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+	Routes []struct {
+		Points []gpxPoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+// ParseGPX reads the tracks and routes in a GPX file, with each track
+// segment and route as a line.
+func ParseGPX(data []byte) ([]Line, error) {
+	var doc gpx
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing GPX")
+	}
+	var lines []Line
+	addLine := func(points []gpxPoint) {
+		if len(points) == 0 {
+			return
+		}
+		line := make(Line, len(points))
+		for i, p := range points {
+			line[i] = Point{Lon: p.Lon, Lat: p.Lat}
+		}
+		lines = append(lines, line)
+	}
+	for _, track := range doc.Tracks {
+		for _, segment := range track.Segments {
+			addLine(segment.Points)
+		}
+	}
+	for _, route := range doc.Routes {
+		addLine(route.Points)
+	}
+	if len(lines) == 0 {
+		return nil, errors.New("GPX has no tracks or routes")
+	}
+	if err := checkLines(lines); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
@@ -0,0 +1,146 @@
+package geo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCorridorCoveringTiles(t *testing.T) {
+	// a line along the middle of a row of tiles
+	start := Tile{Z: 12, X: 650, Y: 1430}.BBox()
+	end := Tile{Z: 12, X: 653, Y: 1430}.BBox()
+	lat := (start.MinLat + start.MaxLat) / 2
+	line := Line{{Lon: start.MinLon + 0.01, Lat: lat}, {Lon: end.MaxLon - 0.01, Lat: lat}}
+
+	narrow := Corridor{Lines: []Line{line}, Buffer: 100}
+	assert.Equal(t, []Tile{
+		{Z: 12, X: 650, Y: 1430},
+		{Z: 12, X: 651, Y: 1430},
+		{Z: 12, X: 652, Y: 1430},
+		{Z: 12, X: 653, Y: 1430},
+	}, CoveringTiles(narrow, 12))
+
+	// a buffer wider than half a tile reaches the rows above and below, and
+	// the columns either side
+	wide := Corridor{Lines: []Line{line}, Buffer: 4000}
+	tiles := CoveringTiles(wide, 12)
+	assert.Len(t, tiles, 18)
+	for _, tile := range tiles {
+		assert.True(t, wide.IntersectsTile(tile))
+	}
+	assert.False(t, wide.IntersectsTile(Tile{Z: 12, X: 651, Y: 1433}))
+
+	// the same tiles are found by scanning the bounds
+	bounds := wide.Bounds()
+	var scanned []Tile
+	minX, minY, maxX, maxY := bounds.TileRange(12)
+	for y := minY; y <= maxY; y++ {
+		for x := minX; x <= maxX; x++ {
+			if wide.IntersectsTile(Tile{Z: 12, X: x, Y: y}) {
+				scanned = append(scanned, Tile{Z: 12, X: x, Y: y})
+			}
+		}
+	}
+	assert.Equal(t, scanned, tiles)
+
+	// a single point
+	point := Corridor{Lines: []Line{{{Lon: start.MinLon + 0.01, Lat: lat}}}, Buffer: 10}
+	assert.Equal(t, []Tile{{Z: 12, X: 650, Y: 1430}}, CoveringTiles(point, 12))
+}
+
+func TestCorridorCoveringTiles_diagonal(t *testing.T) {
+	// walking a diagonal line finds the same tiles as scanning its bounds
+	for _, c := range []Corridor{
+		{Lines: []Line{{{Lon: -122.4, Lat: 47.6}, {Lon: -122.1, Lat: 47.8}, {Lon: -121.9, Lat: 47.5}}}, Buffer: 300},
+		{Lines: []Line{{{Lon: -122.4, Lat: 47.6}, {Lon: -122.3, Lat: 47.61}}}, Buffer: 2000},
+		{Lines: []Line{{{Lon: 10, Lat: 69}, {Lon: 11, Lat: 70}}}, Buffer: 1000},
+	} {
+		for _, z := range []uint64{10, 13} {
+			var scanned []Tile
+			minX, minY, maxX, maxY := c.Bounds().TileRange(z)
+			for y := minY; y <= maxY; y++ {
+				for x := minX; x <= maxX; x++ {
+					if c.IntersectsTile(Tile{Z: z, X: x, Y: y}) {
+						scanned = append(scanned, Tile{Z: z, X: x, Y: y})
+					}
+				}
+			}
+			assert.Equal(t, scanned, CoveringTiles(c, z))
+		}
+	}
+}
+
+func TestCorridorCoveringTilesUpTo(t *testing.T) {
+	line := Corridor{Lines: []Line{{{Lon: -122.4, Lat: 47.6}, {Lon: -122.1, Lat: 47.8}}}, Buffer: 300}
+	all := CoveringTiles(line, 13)
+
+	tiles, ok := CoveringTilesUpTo(line, 13, len(all))
+	assert.True(t, ok)
+	assert.Equal(t, all, tiles)
+	_, ok = CoveringTilesUpTo(line, 13, len(all)-1)
+	assert.False(t, ok)
+
+	// a route across the world gives up long before listing every tile
+	world := Corridor{Lines: []Line{{{Lon: -120, Lat: 40}, {Lon: 120, Lat: -40}}}, Buffer: 5000}
+	_, ok = CoveringTilesUpTo(world, 18, 1000)
+	assert.False(t, ok)
+}
+
+func TestParseGeoJSONLines(t *testing.T) {
+	lines, err := ParseGeoJSONLines([]byte(`{
+		"type": "FeatureCollection",
+		"features": [
+			{"type": "Feature", "properties": {}, "geometry": {"type": "LineString", "coordinates": [[0, 0, 100], [10, 0, 110]]}},
+			{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [10, 0], [10, 10], [0, 0]]]}},
+			{"type": "Feature", "properties": {}, "geometry": {"type": "MultiLineString", "coordinates": [[[20, 20], [30, 20]], [[40, 40], [50, 50]]]}}
+		]
+	}`))
+	require.NoError(t, err)
+	require.Len(t, lines, 3)
+	assert.Equal(t, Line{{Lon: 0, Lat: 0}, {Lon: 10, Lat: 0}}, lines[0])
+	assert.Equal(t, Point{Lon: 50, Lat: 50}, lines[2][1])
+
+	_, err = ParseGeoJSONLines([]byte(`{"type": "Polygon", "coordinates": [[[0, 0], [10, 0], [10, 10], [0, 0]]]}`))
+	assert.Error(t, err)
+	_, err = ParseGeoJSONLines([]byte(`{"type": "LineString", "coordinates": [[0, 0], [1e12, 0]]}`))
+	assert.Error(t, err)
+	_, err = ParseGeoJSONLines([]byte(`{"type": "LineString", "coordinates": [[0, 0], [10, 91]]}`))
+	assert.Error(t, err)
+}
+
+func TestParseGPX(t *testing.T) {
+	lines, err := ParseGPX([]byte(`<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk>
+    <name>Morning Ride</name>
+    <trkseg>
+      <trkpt lat="47.6" lon="-122.4"><ele>10</ele></trkpt>
+      <trkpt lat="47.7" lon="-122.3"><ele>20</ele></trkpt>
+    </trkseg>
+    <trkseg>
+      <trkpt lat="47.8" lon="-122.2"></trkpt>
+    </trkseg>
+  </trk>
+  <rte>
+    <rtept lat="48" lon="-121"></rtept>
+    <rtept lat="48.1" lon="-121.1"></rtept>
+  </rte>
+</gpx>`))
+	require.NoError(t, err)
+	assert.Equal(t, []Line{
+		{{Lon: -122.4, Lat: 47.6}, {Lon: -122.3, Lat: 47.7}},
+		{{Lon: -122.2, Lat: 47.8}},
+		{{Lon: -121, Lat: 48}, {Lon: -121.1, Lat: 48.1}},
+	}, lines)
+
+	_, err = ParseGPX([]byte(`<gpx version="1.1"><wpt lat="47.6" lon="-122.4"></wpt></gpx>`))
+	assert.Error(t, err)
+	_, err = ParseGPX([]byte(`not xml`))
+	assert.Error(t, err)
+	for _, point := range []string{`lat="47.6" lon="1e12"`, `lat="-91" lon="0"`, `lat="NaN" lon="0"`, `lat="0" lon="+Inf"`} {
+		_, err = ParseGPX([]byte(`<gpx version="1.1"><trk><trkseg><trkpt ` + point + `></trkpt></trkseg></trk></gpx>`))
+		assert.Error(t, err, point)
+	}
+}
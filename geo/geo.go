@@ -0,0 +1,160 @@
+// Package geo converts between geographic coordinates, web mercator and XYZ
+// map tiles.
+package geo
+
+import (
+	"math"
+)
+
+const (
+	// EarthRadius is the radius of the sphere used by web mercator, in meters.
+	EarthRadius = 6378137.0
+	// MercatorExtent is half the width of the web mercator plane, in meters.
+	MercatorExtent = math.Pi * EarthRadius
+	// MaxLatitude is the latitude at which web mercator is cut off, making the
+	// plane square.
+	MaxLatitude = 85.05112877980659
+)
+
+// LonLatToMercator projects degrees to web mercator (EPSG:3857) meters.
+func LonLatToMercator(lon, lat float64) (x, y float64) {
+	lat = math.Max(-MaxLatitude, math.Min(MaxLatitude, lat))
+	x = lon * MercatorExtent / 180
+	y = math.Log(math.Tan((90+lat)*math.Pi/360)) * EarthRadius
+	return x, y
+}
+
+// MercatorToLonLat converts web mercator meters to degrees.
+func MercatorToLonLat(x, y float64) (lon, lat float64) {
+	lon = x / MercatorExtent * 180
+	lat = math.Atan(math.Sinh(y/EarthRadius)) * 180 / math.Pi
+	return lon, lat
+}
+
+// MercatorToTile returns the fractional tile coordinates of a web mercator
+// point at zoom z, where tile (0, 0) is the top left.
+func MercatorToTile(x, y float64, z uint64) (tx, ty float64) {
+	n := math.Exp2(float64(z))
+	tx = (x + MercatorExtent) / (2 * MercatorExtent) * n
+	ty = (MercatorExtent - y) / (2 * MercatorExtent) * n
+	return tx, ty
+}
+
+// TileToMercator returns the web mercator point at fractional tile coordinates.
+func TileToMercator(tx, ty float64, z uint64) (x, y float64) {
+	n := math.Exp2(float64(z))
+	x = tx/n*2*MercatorExtent - MercatorExtent
+	y = MercatorExtent - ty/n*2*MercatorExtent
+	return x, y
+}
+
+// LonLatToTile returns the fractional tile coordinates of a point at zoom z.
+func LonLatToTile(lon, lat float64, z uint64) (tx, ty float64) {
+	x, y := LonLatToMercator(lon, lat)
+	return MercatorToTile(x, y, z)
+}
+
+// TileToLonLat returns the point at fractional tile coordinates.
+func TileToLonLat(tx, ty float64, z uint64) (lon, lat float64) {
+	x, y := TileToMercator(tx, ty, z)
+	return MercatorToLonLat(x, y)
+}
+
+// Tile is an XYZ tile address.
+type Tile struct {
+	Z uint64
+	X uint64
+	Y uint64
+}
+
+// Tiles returns the number of tiles across a zoom level.
+func Tiles(z uint64) uint64 {
+	return 1 << z
+}
+
+// BBox is a bounding box in degrees.
+type BBox struct {
+	MinLon float64
+	MinLat float64
+	MaxLon float64
+	MaxLat float64
+}
+
+// Valid reports whether the box is non-empty and within valid coordinates.
+func (b BBox) Valid() bool {
+	return b.MinLon < b.MaxLon && b.MinLat < b.MaxLat &&
+		b.MinLon >= -180 && b.MaxLon <= 180 &&
+		b.MinLat >= -90 && b.MaxLat <= 90
+}
+
+// TileRange returns the inclusive range of tiles covering the box at zoom z.
+func (b BBox) TileRange(z uint64) (minX, minY, maxX, maxY uint64) {
+	x0, y0 := LonLatToTile(b.MinLon, b.MaxLat, z)
+	x1, y1 := LonLatToTile(b.MaxLon, b.MinLat, z)
+	last := float64(Tiles(z) - 1)
+	clamp := func(v float64) uint64 {
+		return uint64(math.Max(0, math.Min(last, math.Floor(v))))
+	}
+	return clamp(x0), clamp(y0), clamp(x1), clamp(y1)
+}
+
+// BBox returns the area covered by the tile.
+func (t Tile) BBox() BBox {
+	minLon, maxLat := TileToLonLat(float64(t.X), float64(t.Y), t.Z)
+	maxLon, minLat := TileToLonLat(float64(t.X+1), float64(t.Y+1), t.Z)
+	return BBox{MinLon: minLon, MinLat: minLat, MaxLon: maxLon, MaxLat: maxLat}
+}
+
+// Region is an area tiles can be listed for.
+type Region interface {
+	Bounds() BBox
+	// IntersectsTile reports whether any part of the tile is in the region.
+	IntersectsTile(t Tile) bool
+}
+
+func (b BBox) Bounds() BBox {
+	return b
+}
+
+func (b BBox) IntersectsTile(t Tile) bool {
+	return b.Intersects(t.BBox())
+}
+
+// Intersects reports whether two boxes overlap.
+func (b BBox) Intersects(o BBox) bool {
+	return b.MinLon < o.MaxLon && o.MinLon < b.MaxLon && b.MinLat < o.MaxLat && o.MinLat < b.MaxLat
+}
+
+// Contains reports whether a point is in the box.
+func (b BBox) Contains(p Point) bool {
+	return p.Lon >= b.MinLon && p.Lon <= b.MaxLon && p.Lat >= b.MinLat && p.Lat <= b.MaxLat
+}
+
+// CoveringTiles returns the tiles at zoom z that intersect a region.
+func CoveringTiles(region Region, z uint64) []Tile {
+	tiles, _ := CoveringTilesUpTo(region, z, math.MaxInt)
+	return tiles
+}
+
+// CoveringTilesUpTo is CoveringTiles, but gives up, returning false, once there
+// are more than limit tiles.
+func CoveringTilesUpTo(region Region, z uint64, limit int) ([]Tile, bool) {
+	if c, ok := region.(Corridor); ok {
+		return c.coveringTiles(z, limit)
+	}
+	var tiles []Tile
+	minX, minY, maxX, maxY := region.Bounds().TileRange(z)
+	for y := minY; y <= maxY; y++ {
+		for x := minX; x <= maxX; x++ {
+			t := Tile{Z: z, X: x, Y: y}
+			if !region.IntersectsTile(t) {
+				continue
+			}
+			tiles = append(tiles, t)
+			if len(tiles) > limit {
+				return nil, false
+			}
+		}
+	}
+	return tiles, true
+}
@@ -0,0 +1,46 @@
+package geo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMercator(t *testing.T) {
+	x, y := LonLatToMercator(180, MaxLatitude)
+	assert.InDelta(t, MercatorExtent, x, 1e-6)
+	assert.InDelta(t, MercatorExtent, y, 1e-6)
+
+	lon, lat := MercatorToLonLat(LonLatToMercator(-122.4, 47.6))
+	assert.InDelta(t, -122.4, lon, 1e-9)
+	assert.InDelta(t, 47.6, lat, 1e-9)
+}
+
+func TestLonLatToTile(t *testing.T) {
+	// The tile from the README.
+	x, y := LonLatToTile(19.9, 50.06, 13)
+	assert.Equal(t, 4548.0, float64(int(x)))
+	assert.Equal(t, 2776.0, float64(int(y)))
+
+	x, y = LonLatToTile(-180, MaxLatitude, 4)
+	assert.InDelta(t, 0, x, 1e-9)
+	assert.InDelta(t, 0, y, 1e-9)
+
+	lon, lat := TileToLonLat(4548.5, 2776.5, 13)
+	x, y = LonLatToTile(lon, lat, 13)
+	assert.InDelta(t, 4548.5, x, 1e-9)
+	assert.InDelta(t, 2776.5, y, 1e-9)
+}
+
+func TestBBoxTileRange(t *testing.T) {
+	b := BBox{MinLon: -180, MinLat: -MaxLatitude, MaxLon: 180, MaxLat: MaxLatitude}
+	assert.True(t, b.Valid())
+	minX, minY, maxX, maxY := b.TileRange(2)
+	assert.Equal(t, []uint64{0, 0, 3, 3}, []uint64{minX, minY, maxX, maxY})
+
+	b = BBox{MinLon: 19.87, MinLat: 50.04, MaxLon: 19.95, MaxLat: 50.06}
+	minX, minY, maxX, maxY = b.TileRange(13)
+	assert.Equal(t, []uint64{4548, 2776, 4549, 2776}, []uint64{minX, minY, maxX, maxY})
+
+	assert.False(t, BBox{MinLon: 1, MaxLon: 0, MinLat: 0, MaxLat: 1}.Valid())
+}
@@ -0,0 +1,188 @@
+package geo
+
+import (
+	"encoding/json"
+	"math"
+
+	"github.com/pkg/errors"
+)
+
+// Point is a position in degrees.
+type Point struct {
+	Lon float64
+	Lat float64
+}
+
+// Polygon is an exterior ring followed by any holes. Rings are closed, with
+// the first point repeated at the end.
+type Polygon [][]Point
+
+// MultiPolygon is a Region made of polygons.
+type MultiPolygon []Polygon
+
+func (mp MultiPolygon) Bounds() BBox {
+	b := BBox{MinLon: math.Inf(1), MinLat: math.Inf(1), MaxLon: math.Inf(-1), MaxLat: math.Inf(-1)}
+	for _, polygon := range mp {
+		if len(polygon) == 0 {
+			continue
+		}
+		for _, p := range polygon[0] {
+			b.MinLon, b.MaxLon = math.Min(b.MinLon, p.Lon), math.Max(b.MaxLon, p.Lon)
+			b.MinLat, b.MaxLat = math.Min(b.MinLat, p.Lat), math.Max(b.MaxLat, p.Lat)
+		}
+	}
+	return b
+}
+
+func (mp MultiPolygon) IntersectsTile(t Tile) bool {
+	box := t.BBox()
+	for _, polygon := range mp {
+		if polygon.intersects(box) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether a point is inside the polygon, using the even-odd
+// rule so holes are excluded.
+func (polygon Polygon) contains(p Point) bool {
+	inside := false
+	for _, ring := range polygon {
+		for i := 1; i < len(ring); i++ {
+			a, b := ring[i-1], ring[i]
+			if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+				p.Lon < (b.Lon-a.Lon)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lon {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+func (polygon Polygon) intersects(box BBox) bool {
+	corners := []Point{
+		{box.MinLon, box.MinLat},
+		{box.MaxLon, box.MinLat},
+		{box.MaxLon, box.MaxLat},
+		{box.MinLon, box.MaxLat},
+	}
+	// the box is inside the polygon
+	if polygon.contains(corners[0]) {
+		return true
+	}
+	for _, ring := range polygon {
+		for i, p := range ring {
+			// the polygon is inside the box
+			if box.Contains(p) {
+				return true
+			}
+			if i == 0 {
+				continue
+			}
+			// an edge of the polygon crosses the box
+			for j := range corners {
+				if segmentsIntersect(ring[i-1], p, corners[j], corners[(j+1)%len(corners)]) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// planar is a point that can be treated as on a flat plane, which for Point
+// is the longitude and latitude.
+type planar interface {
+	Point | mercatorPoint
+	xy() (x, y float64)
+}
+
+func (p Point) xy() (x, y float64) {
+	return p.Lon, p.Lat
+}
+
+func segmentsIntersect[P planar](a, b, c, d P) bool {
+	cross := func(o, p, q P) float64 {
+		ox, oy := o.xy()
+		px, py := p.xy()
+		qx, qy := q.xy()
+		return (px-ox)*(qy-oy) - (py-oy)*(qx-ox)
+	}
+	d1, d2 := cross(c, d, a), cross(c, d, b)
+	d3, d4 := cross(a, b, c), cross(a, b, d)
+	return ((d1 > 0 && d2 < 0) || (d1 < 0 && d2 > 0)) &&
+		((d3 > 0 && d4 < 0) || (d3 < 0 && d4 > 0))
+}
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Features    []geoJSON       `json:"features"`
+	Geometries  []geoJSON       `json:"geometries"`
+}
+
+// ParseGeoJSON reads the polygons in a GeoJSON geometry, feature or feature
+// collection. Other geometry types are ignored.
+func ParseGeoJSON(data []byte) (MultiPolygon, error) {
+	var doc geoJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrap(err, "parsing GeoJSON")
+	}
+	mp, err := doc.polygons()
+	if err != nil {
+		return nil, err
+	}
+	if len(mp) == 0 {
+		return nil, errors.New("GeoJSON has no polygons")
+	}
+	return mp, nil
+}
+
+func (g geoJSON) polygons() (MultiPolygon, error) {
+	switch g.Type {
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, nil
+		}
+		return g.Geometry.polygons()
+	case "FeatureCollection", "GeometryCollection":
+		var mp MultiPolygon
+		for _, child := range append(g.Features, g.Geometries...) {
+			polygons, err := child.polygons()
+			if err != nil {
+				return nil, err
+			}
+			mp = append(mp, polygons...)
+		}
+		return mp, nil
+	case "Polygon":
+		var coordinates [][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+			return nil, errors.Wrap(err, "parsing Polygon")
+		}
+		return MultiPolygon{toPolygon(coordinates)}, nil
+	case "MultiPolygon":
+		var coordinates [][][][2]float64
+		if err := json.Unmarshal(g.Coordinates, &coordinates); err != nil {
+			return nil, errors.Wrap(err, "parsing MultiPolygon")
+		}
+		var mp MultiPolygon
+		for _, polygon := range coordinates {
+			mp = append(mp, toPolygon(polygon))
+		}
+		return mp, nil
+	}
+	return nil, nil
+}
+
+func toPolygon(coordinates [][][2]float64) Polygon {
+	polygon := make(Polygon, len(coordinates))
+	for i, ring := range coordinates {
+		for _, c := range ring {
+			polygon[i] = append(polygon[i], Point{Lon: c[0], Lat: c[1]})
+		}
+	}
+	return polygon
+}
@@ -0,0 +1,69 @@
+package geo
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGeoJSON(t *testing.T) {
+	mp, err := ParseGeoJSON([]byte(`{
+		"type": "FeatureCollection",
+		"features": [
+			{"type": "Feature", "properties": {}, "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [10, 0], [10, 10], [0, 10], [0, 0]]]}},
+			{"type": "Feature", "properties": {}, "geometry": {"type": "Point", "coordinates": [5, 5]}},
+			{"type": "Feature", "properties": {}, "geometry": {"type": "MultiPolygon", "coordinates": [[[[20, 20, 100], [30, 20, 100], [30, 30, 100], [20, 20, 100]]]]}}
+		]
+	}`))
+	require.NoError(t, err)
+	require.Len(t, mp, 2)
+	assert.Equal(t, Point{Lon: 30, Lat: 20}, mp[1][0][1])
+	assert.Equal(t, BBox{MinLon: 0, MinLat: 0, MaxLon: 30, MaxLat: 30}, mp.Bounds())
+
+	_, err = ParseGeoJSON([]byte(`{"type": "Point", "coordinates": [5, 5]}`))
+	assert.Error(t, err)
+	_, err = ParseGeoJSON([]byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestPolygonContains(t *testing.T) {
+	square := Polygon{
+		{{0, 0}, {10, 0}, {10, 10}, {0, 10}, {0, 0}},
+		{{4, 4}, {6, 4}, {6, 6}, {4, 6}, {4, 4}},
+	}
+	assert.True(t, square.contains(Point{1, 1}))
+	assert.False(t, square.contains(Point{5, 5}), "in the hole")
+	assert.False(t, square.contains(Point{11, 5}))
+}
+
+func TestCoveringTiles(t *testing.T) {
+	// a triangle covering the bottom left half of a 2x2 block of tiles
+	bl := Tile{Z: 10, X: 100, Y: 101}.BBox()
+	tr := Tile{Z: 10, X: 101, Y: 100}.BBox()
+	triangle := MultiPolygon{{{
+		{bl.MinLon + 0.001, bl.MinLat + 0.001},
+		{tr.MaxLon - 0.001, bl.MinLat + 0.001},
+		{bl.MinLon + 0.001, tr.MaxLat - 0.001},
+		{bl.MinLon + 0.001, bl.MinLat + 0.001},
+	}}}
+	tiles := CoveringTiles(triangle, 10)
+	assert.ElementsMatch(t, []Tile{
+		{Z: 10, X: 100, Y: 100},
+		{Z: 10, X: 100, Y: 101},
+		{Z: 10, X: 101, Y: 101},
+	}, tiles)
+
+	// the bounding box covers all four
+	assert.Len(t, CoveringTiles(triangle.Bounds(), 10), 4)
+
+	// a polygon entirely inside one tile
+	center := Tile{Z: 10, X: 100, Y: 100}.BBox()
+	small := MultiPolygon{{{
+		{center.MinLon + 0.01, center.MinLat + 0.01},
+		{center.MinLon + 0.02, center.MinLat + 0.01},
+		{center.MinLon + 0.02, center.MinLat + 0.02},
+		{center.MinLon + 0.01, center.MinLat + 0.01},
+	}}}
+	assert.Equal(t, []Tile{{Z: 10, X: 100, Y: 100}}, CoveringTiles(small, 10))
+}
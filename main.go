@@ -1,10 +1,13 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"log"
 	"net/http"
-	"sync"
+	"os"
+	"os/signal"
 	"syscall"
 
 	"github.com/apexskier/strava-tile-proxy/service"
@@ -15,30 +18,61 @@ var logger = log.Default()
 func errorMiddleware(h func(rw http.ResponseWriter, r *http.Request) error) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		if err := h(rw, r); err != nil {
-			if errors.Is(err, syscall.EPIPE) {
-				// ignore broken pipe errors, client cancelled connection
+			if errors.Is(err, syscall.EPIPE) || errors.Is(err, context.Canceled) {
+				// ignore errors from the client cancelling the request
 				return
 			}
 			logger.Printf("error: %s, %v", r.URL.String(), err)
-			rw.WriteHeader(http.StatusInternalServerError)
+			service.WriteError(rw, r, err)
 		}
 	})
 }
 
 func main() {
-	s, err := service.New()
+	sessionPath := flag.String("session", "", "path to a session file written by cmd/auth, reloaded when it changes")
+	flag.Parse()
+
+	s, err := service.New(*sessionPath)
 	if err != nil {
 		panic(err)
 	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/personal/", errorMiddleware(s.ServePersonalTile))
+	mux.Handle("/personal/tiles/{z}/{x}/{y}", errorMiddleware(s.ServePersonalTile))
+	mux.Handle("/personal/{athlete}/{z}/{x}/{y}", errorMiddleware(s.ServePersonalTile))
+	mux.Handle("/personal/tiles.json", errorMiddleware(s.ServePersonalTileJSON))
+	mux.Handle("/personal/{athlete}/tiles.json", errorMiddleware(s.ServePersonalTileJSON))
 	mux.Handle("/global/", errorMiddleware(s.ServeGlobalTile))
+	mux.Handle("/global/tiles.json", errorMiddleware(s.ServeGlobalTileJSON))
+	mux.Handle("/team/{z}/{x}/{y}", errorMiddleware(s.ServeTeamTile))
+	mux.Handle("/team/tiles.json", errorMiddleware(s.ServeTeamTileJSON))
+	mux.Handle("/wmts", errorMiddleware(s.ServeWMTS))
+	mux.Handle("/wms", errorMiddleware(s.ServeWMS))
+	mux.Handle("/static", errorMiddleware(s.ServeStaticMap))
+	mux.Handle("/health", errorMiddleware(s.ServeHealth))
+	mux.Handle("POST /admin/seed", errorMiddleware(s.ServeSeed))
+	mux.Handle("GET /admin/seed", errorMiddleware(s.ServeSeedJobs))
+	mux.Handle("GET /admin/seed/{id}", errorMiddleware(s.ServeSeedJob))
+	mux.Handle("DELETE /admin/seed/{id}", errorMiddleware(s.ServeCancelSeedJob))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	if err := http.ListenAndServe(":8080", mux); err != nil {
+	server := &http.Server{Addr: ":8080", Handler: mux}
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		// let in flight requests finish before stopping the service
+		if err := server.Shutdown(context.Background()); err != nil {
+			logger.Printf("shutting down: %v", err)
+		}
+	}()
+
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
 		panic(err)
 	}
-
-	var wg sync.WaitGroup
-	wg.Wait()
+	<-shutdown
+	s.Close()
 }
@@ -0,0 +1,274 @@
+// Package pmtiles reads and writes PMTiles v3 archives,
+// https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+package pmtiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	headerSize = 127
+	// rootSize is how much of the start of an archive holds the header and
+	// root directory, so clients can fetch both in one request.
+	rootSize = 16384
+)
+
+type Compression uint8
+
+const (
+	CompressionUnknown Compression = 0
+	CompressionNone    Compression = 1
+	CompressionGzip    Compression = 2
+)
+
+type TileType uint8
+
+const (
+	TileTypeUnknown TileType = 0
+	TileTypePNG     TileType = 2
+)
+
+// Header is the fixed size header at the start of an archive.
+type Header struct {
+	RootOffset          uint64
+	RootLength          uint64
+	MetadataOffset      uint64
+	MetadataLength      uint64
+	LeafDirsOffset      uint64
+	LeafDirsLength      uint64
+	TileDataOffset      uint64
+	TileDataLength      uint64
+	AddressedTilesCount uint64
+	TileEntriesCount    uint64
+	TileContentsCount   uint64
+	Clustered           bool
+	InternalCompression Compression
+	TileCompression     Compression
+	TileType            TileType
+	MinZoom             uint8
+	MaxZoom             uint8
+	// bounds and center are in degrees
+	MinLon, MinLat, MaxLon, MaxLat float64
+	CenterZoom                     uint8
+	CenterLon, CenterLat           float64
+}
+
+func e7(degrees float64) int32 {
+	return int32(degrees * 1e7)
+}
+
+func fromE7(v uint32) float64 {
+	return float64(int32(v)) / 1e7
+}
+
+func (h Header) marshal() []byte {
+	b := make([]byte, headerSize)
+	copy(b, "PMTiles")
+	b[7] = 3
+	le := binary.LittleEndian
+	for i, v := range []uint64{
+		h.RootOffset, h.RootLength, h.MetadataOffset, h.MetadataLength,
+		h.LeafDirsOffset, h.LeafDirsLength, h.TileDataOffset, h.TileDataLength,
+		h.AddressedTilesCount, h.TileEntriesCount, h.TileContentsCount,
+	} {
+		le.PutUint64(b[8+8*i:], v)
+	}
+	if h.Clustered {
+		b[96] = 1
+	}
+	b[97] = byte(h.InternalCompression)
+	b[98] = byte(h.TileCompression)
+	b[99] = byte(h.TileType)
+	b[100] = h.MinZoom
+	b[101] = h.MaxZoom
+	le.PutUint32(b[102:], uint32(e7(h.MinLon)))
+	le.PutUint32(b[106:], uint32(e7(h.MinLat)))
+	le.PutUint32(b[110:], uint32(e7(h.MaxLon)))
+	le.PutUint32(b[114:], uint32(e7(h.MaxLat)))
+	b[118] = h.CenterZoom
+	le.PutUint32(b[119:], uint32(e7(h.CenterLon)))
+	le.PutUint32(b[123:], uint32(e7(h.CenterLat)))
+	return b
+}
+
+func unmarshalHeader(b []byte) (Header, error) {
+	var h Header
+	if len(b) < headerSize || string(b[:7]) != "PMTiles" {
+		return h, errors.New("not a PMTiles archive")
+	}
+	if b[7] != 3 {
+		return h, errors.Errorf("unsupported PMTiles version %d", b[7])
+	}
+	le := binary.LittleEndian
+	for i, v := range []*uint64{
+		&h.RootOffset, &h.RootLength, &h.MetadataOffset, &h.MetadataLength,
+		&h.LeafDirsOffset, &h.LeafDirsLength, &h.TileDataOffset, &h.TileDataLength,
+		&h.AddressedTilesCount, &h.TileEntriesCount, &h.TileContentsCount,
+	} {
+		*v = le.Uint64(b[8+8*i:])
+	}
+	h.Clustered = b[96] == 1
+	h.InternalCompression = Compression(b[97])
+	h.TileCompression = Compression(b[98])
+	h.TileType = TileType(b[99])
+	h.MinZoom = b[100]
+	h.MaxZoom = b[101]
+	h.MinLon = fromE7(le.Uint32(b[102:]))
+	h.MinLat = fromE7(le.Uint32(b[106:]))
+	h.MaxLon = fromE7(le.Uint32(b[110:]))
+	h.MaxLat = fromE7(le.Uint32(b[114:]))
+	h.CenterZoom = b[118]
+	h.CenterLon = fromE7(le.Uint32(b[119:]))
+	h.CenterLat = fromE7(le.Uint32(b[123:]))
+	return h, nil
+}
+
+// TileID returns the position of a tile on the Hilbert curve through every
+// zoom level, which orders tiles in an archive.
+func TileID(z uint8, x, y uint32) uint64 {
+	// the number of tiles in lower zoom levels
+	acc := ((uint64(1) << (2 * uint64(z))) - 1) / 3
+	n := uint64(1) << z
+	tx, ty := uint64(x), uint64(y)
+	var d uint64
+	for s := n / 2; s > 0; s /= 2 {
+		var rx, ry uint64
+		if tx&s > 0 {
+			rx = 1
+		}
+		if ty&s > 0 {
+			ry = 1
+		}
+		d += s * s * ((3 * rx) ^ ry)
+		if ry == 0 {
+			if rx == 1 {
+				tx = n - 1 - tx
+				ty = n - 1 - ty
+			}
+			tx, ty = ty, tx
+		}
+	}
+	return acc + d
+}
+
+// entry is a directory entry. A zero RunLength points to a leaf directory
+// rather than tile data.
+type entry struct {
+	TileID    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+func marshalDirectory(entries []entry, compression Compression) ([]byte, error) {
+	var buf []byte
+	buf = binary.AppendUvarint(buf, uint64(len(entries)))
+	var lastID uint64
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, e.TileID-lastID)
+		lastID = e.TileID
+	}
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(e.RunLength))
+	}
+	for _, e := range entries {
+		buf = binary.AppendUvarint(buf, uint64(e.Length))
+	}
+	for i, e := range entries {
+		if i > 0 && e.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			buf = binary.AppendUvarint(buf, 0)
+		} else {
+			buf = binary.AppendUvarint(buf, e.Offset+1)
+		}
+	}
+	return compress(buf, compression)
+}
+
+func unmarshalDirectory(data []byte, compression Compression) ([]entry, error) {
+	data, err := decompress(data, compression)
+	if err != nil {
+		return nil, err
+	}
+	r := bytes.NewReader(data)
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading directory")
+	}
+	if n > uint64(len(data)) {
+		return nil, errors.New("corrupt directory")
+	}
+	entries := make([]entry, n)
+	var lastID uint64
+	for i := range entries {
+		delta, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading directory")
+		}
+		lastID += delta
+		entries[i].TileID = lastID
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading directory")
+		}
+		entries[i].RunLength = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading directory")
+		}
+		entries[i].Length = uint32(v)
+	}
+	for i := range entries {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.Wrap(err, "reading directory")
+		}
+		if v == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = v - 1
+		}
+	}
+	return entries, nil
+}
+
+func compress(data []byte, compression Compression) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errors.Errorf("unsupported compression %d", compression)
+}
+
+func decompress(data []byte, compression Compression) ([]byte, error) {
+	switch compression {
+	case CompressionNone:
+		return data, nil
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		return io.ReadAll(zr)
+	}
+	return nil, errors.Errorf("unsupported compression %d", compression)
+}
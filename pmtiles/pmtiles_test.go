@@ -0,0 +1,202 @@
+package pmtiles
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTileID(t *testing.T) {
+	assert.Equal(t, uint64(0), TileID(0, 0, 0))
+	assert.Equal(t, uint64(1), TileID(1, 0, 0))
+	assert.Equal(t, uint64(2), TileID(1, 0, 1))
+	assert.Equal(t, uint64(3), TileID(1, 1, 1))
+	assert.Equal(t, uint64(4), TileID(1, 1, 0))
+	assert.Equal(t, uint64(5), TileID(2, 0, 0))
+	assert.Equal(t, uint64(19078479), TileID(12, 3423, 1763))
+
+	// every tile in a zoom level has a unique ID
+	seen := map[uint64]bool{}
+	for x := uint32(0); x < 8; x++ {
+		for y := uint32(0); y < 8; y++ {
+			id := TileID(3, x, y)
+			assert.False(t, seen[id])
+			assert.GreaterOrEqual(t, id, uint64(21))
+			assert.Less(t, id, uint64(85))
+			seen[id] = true
+		}
+	}
+}
+
+func TestHeader(t *testing.T) {
+	h := Header{
+		RootOffset:          127,
+		TileDataLength:      1000,
+		Clustered:           true,
+		InternalCompression: CompressionGzip,
+		TileCompression:     CompressionNone,
+		TileType:            TileTypePNG,
+		MinZoom:             6,
+		MaxZoom:             14,
+		MinLon:              -122.5,
+		MinLat:              47.5,
+		MaxLon:              -122.25,
+		MaxLat:              47.75,
+		CenterZoom:          10,
+		CenterLon:           -122.375,
+		CenterLat:           47.625,
+	}
+	b := h.marshal()
+	assert.Len(t, b, headerSize)
+	parsed, err := unmarshalHeader(b)
+	require.NoError(t, err)
+	assert.Equal(t, h, parsed)
+
+	_, err = unmarshalHeader([]byte("not a pmtiles archive, not at all, nope"))
+	assert.Error(t, err)
+}
+
+func TestWriteRead(t *testing.T) {
+	w, err := NewWriter(t.TempDir())
+	require.NoError(t, err)
+	tiles := map[[3]uint32][]byte{
+		{0, 0, 0}: []byte("world"),
+		{1, 0, 1}: []byte("empty"),
+		{1, 1, 1}: []byte("empty"),
+		{1, 1, 0}: []byte("east"),
+		{2, 3, 0}: []byte("empty"),
+	}
+	for _, zxy := range [][3]uint32{{0, 0, 0}, {1, 0, 1}, {1, 1, 1}, {1, 1, 0}, {2, 3, 0}} {
+		require.NoError(t, w.AddTile(uint8(zxy[0]), zxy[1], zxy[2], tiles[zxy]))
+	}
+	assert.Error(t, w.AddTile(1, 0, 0, []byte("out of order")))
+
+	var buf bytes.Buffer
+	require.NoError(t, w.Finish(&buf, Header{TileType: TileTypePNG, MaxZoom: 2}, map[string]string{"name": "test"}))
+
+	r, err := Open(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), r.Header().AddressedTilesCount)
+	// the two adjacent empty tiles share a run
+	assert.Equal(t, uint64(4), r.Header().TileEntriesCount)
+	assert.Equal(t, uint64(3), r.Header().TileContentsCount)
+	var metadata map[string]string
+	require.NoError(t, r.Metadata(&metadata))
+	assert.Equal(t, "test", metadata["name"])
+
+	for zxy, expected := range tiles {
+		data, ok, err := r.Tile(uint8(zxy[0]), zxy[1], zxy[2])
+		require.NoError(t, err)
+		assert.True(t, ok, zxy)
+		assert.Equal(t, expected, data, zxy)
+	}
+	_, ok, err := r.Tile(1, 0, 0)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	_, ok, err = r.Tile(3, 0, 0)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestWriteRead_leaves(t *testing.T) {
+	w, err := NewWriter(t.TempDir())
+	require.NoError(t, err)
+	random := rand.New(rand.NewSource(1))
+	tiles := map[uint64][]byte{}
+	var id uint64
+	for i := 0; i < 30000; i++ {
+		id += uint64(random.Intn(200) + 1)
+		data := []byte(fmt.Sprintf("%d%s", id, bytes.Repeat([]byte{'.'}, random.Intn(100))))
+		require.NoError(t, w.add(id, data))
+		// check a sample of tiles
+		if i%30 == 0 {
+			tiles[id] = data
+		}
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, w.Finish(&buf, Header{MaxZoom: 14}, map[string]string{}))
+
+	// serve over HTTP to check range requests
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.ServeContent(rw, r, "test.pmtiles", time.Time{}, bytes.NewReader(buf.Bytes()))
+	}))
+	defer server.Close()
+
+	r, err := Open(&HTTPReaderAt{Client: server.Client(), URL: server.URL})
+	require.NoError(t, err)
+	assert.NotZero(t, r.Header().LeafDirsLength)
+	for id, expected := range tiles {
+		e, ok := findEntry(r.root, id)
+		require.True(t, ok)
+		if e.RunLength == 0 {
+			dir, err := r.leaf(e.Offset, e.Length)
+			require.NoError(t, err)
+			e, ok = findEntry(dir, id)
+			require.True(t, ok)
+		}
+		data, err := r.read(r.header.TileDataOffset+e.Offset, uint64(e.Length))
+		require.NoError(t, err)
+		require.Equal(t, expected, data)
+	}
+}
+
+// reference.pmtiles was converted from an MBTiles file by go-pmtiles, the
+// reference implementation. It holds a block of identical z10 tiles, which
+// are deduplicated into runs, and enough scattered z14 tiles that the
+// directory is split into leaves.
+func TestRead_reference(t *testing.T) {
+	f, err := os.Open("testdata/reference.pmtiles")
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := Open(f)
+	require.NoError(t, err)
+
+	h := r.Header()
+	assert.NotZero(t, h.LeafDirsLength)
+	assert.True(t, h.Clustered)
+	assert.Equal(t, CompressionGzip, h.InternalCompression)
+	assert.Equal(t, TileTypePNG, h.TileType)
+	assert.Equal(t, uint8(10), h.MinZoom)
+	assert.Equal(t, uint8(14), h.MaxZoom)
+	assert.Equal(t, -123.0, h.MinLon)
+	assert.Equal(t, 48.0, h.MaxLat)
+	assert.Equal(t, uint8(10), h.CenterZoom)
+	assert.Equal(t, -122.5, h.CenterLon)
+	var metadata map[string]any
+	require.NoError(t, r.Metadata(&metadata))
+	assert.Equal(t, "reference", metadata["name"])
+
+	tiles := map[[3]uint32]string{}
+	for x := uint32(160); x < 168; x++ {
+		for y := uint32(352); y < 360; y++ {
+			tiles[[3]uint32{10, x, y}] = "same"
+		}
+	}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 12000; i++ {
+		x, y := uint32(2048+random.Intn(2048)), uint32(4096+random.Intn(2048))
+		tiles[[3]uint32{14, x, y}] = fmt.Sprintf("%d/%d", x, y)
+	}
+	assert.Equal(t, uint64(len(tiles)), h.AddressedTilesCount)
+
+	for zxy, expected := range tiles {
+		data, ok, err := r.Tile(uint8(zxy[0]), zxy[1], zxy[2])
+		require.NoError(t, err)
+		require.True(t, ok, zxy)
+		require.Equal(t, expected, string(data), zxy)
+	}
+	for _, zxy := range [][3]uint32{{10, 159, 352}, {10, 168, 359}, {14, 2047, 4096}, {14, 4096, 4096}, {13, 1024, 2048}} {
+		_, ok, err := r.Tile(uint8(zxy[0]), zxy[1], zxy[2])
+		require.NoError(t, err)
+		assert.False(t, ok, zxy)
+	}
+}
@@ -0,0 +1,186 @@
+package pmtiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// maxLeafCacheSize limits how many leaf directories a Reader keeps in memory.
+const maxLeafCacheSize = 64
+
+// Reader reads tiles from an archive. It's safe for concurrent use.
+type Reader struct {
+	src    io.ReaderAt
+	header Header
+	root   []entry
+
+	leafLock sync.Mutex
+	leaves   map[uint64][]entry
+}
+
+// Open reads the header and root directory of an archive.
+func Open(src io.ReaderAt) (*Reader, error) {
+	// the header and root directory are always within the first rootSize
+	// bytes, so read them together
+	start := make([]byte, rootSize)
+	n, err := src.ReadAt(start, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	start = start[:n]
+	header, err := unmarshalHeader(start)
+	if err != nil {
+		return nil, err
+	}
+	if header.RootOffset+header.RootLength > uint64(len(start)) {
+		return nil, errors.New("root directory is outside the first 16KiB")
+	}
+	root, err := unmarshalDirectory(start[header.RootOffset:header.RootOffset+header.RootLength], header.InternalCompression)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading root directory")
+	}
+	return &Reader{src: src, header: header, root: root, leaves: map[uint64][]entry{}}, nil
+}
+
+func (r *Reader) Header() Header {
+	return r.header
+}
+
+// Metadata decodes the archive's JSON metadata into v.
+func (r *Reader) Metadata(v any) error {
+	data, err := r.read(r.header.MetadataOffset, r.header.MetadataLength)
+	if err != nil {
+		return err
+	}
+	data, err = decompress(data, r.header.InternalCompression)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (r *Reader) read(offset, length uint64) ([]byte, error) {
+	data := make([]byte, length)
+	n, err := r.src.ReadAt(data, int64(offset))
+	if err != nil && !(errors.Is(err, io.EOF) && uint64(n) == length) {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Tile returns the data for a tile, or false if it isn't in the archive.
+func (r *Reader) Tile(z uint8, x, y uint32) ([]byte, bool, error) {
+	if z < r.header.MinZoom || z > r.header.MaxZoom || uint64(x) >= 1<<z || uint64(y) >= 1<<z {
+		return nil, false, nil
+	}
+	id := TileID(z, x, y)
+	dir := r.root
+	// archives written by spec compliant tools have at most a few levels of
+	// leaf directories
+	for depth := 0; depth < 4; depth++ {
+		e, ok := findEntry(dir, id)
+		if !ok {
+			return nil, false, nil
+		}
+		if e.RunLength > 0 {
+			data, err := r.read(r.header.TileDataOffset+e.Offset, uint64(e.Length))
+			if err != nil {
+				return nil, false, err
+			}
+			if r.header.TileCompression != CompressionNone && r.header.TileCompression != CompressionUnknown {
+				data, err = decompress(data, r.header.TileCompression)
+			}
+			return data, err == nil, err
+		}
+		var err error
+		dir, err = r.leaf(e.Offset, e.Length)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return nil, false, errors.New("leaf directories too deep")
+}
+
+func (r *Reader) leaf(offset uint64, length uint32) ([]entry, error) {
+	r.leafLock.Lock()
+	dir, ok := r.leaves[offset]
+	r.leafLock.Unlock()
+	if ok {
+		return dir, nil
+	}
+
+	data, err := r.read(r.header.LeafDirsOffset+offset, uint64(length))
+	if err != nil {
+		return nil, err
+	}
+	dir, err = unmarshalDirectory(data, r.header.InternalCompression)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading leaf directory")
+	}
+
+	r.leafLock.Lock()
+	if len(r.leaves) >= maxLeafCacheSize {
+		clear(r.leaves)
+	}
+	r.leaves[offset] = dir
+	r.leafLock.Unlock()
+	return dir, nil
+}
+
+// findEntry returns the entry for a tile ID: either a tile entry whose run
+// includes id, or the leaf directory that would contain it.
+func findEntry(entries []entry, id uint64) (entry, bool) {
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].TileID > id
+	}) - 1
+	if i < 0 {
+		return entry{}, false
+	}
+	e := entries[i]
+	if e.RunLength == 0 || id < e.TileID+uint64(e.RunLength) {
+		return e, true
+	}
+	return entry{}, false
+}
+
+// HTTPReaderAt reads a remote archive with HTTP range requests, e.g. from
+// static object storage.
+type HTTPReaderAt struct {
+	Client *http.Client
+	URL    string
+}
+
+func (h *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, h.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	res, err := h.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		return 0, io.EOF
+	default:
+		return 0, errors.Errorf("reading %s: unexpected status %s, range requests may not be supported", h.URL, res.Status)
+	}
+	n, err := io.ReadFull(res.Body, p)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		// the range extended past the end of the archive
+		return n, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,162 @@
+package pmtiles
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// leafSize is the initial number of entries per leaf directory, if the
+// entries don't all fit in the root directory.
+const leafSize = 4096
+
+// Writer builds an archive. Tile data is buffered in a temporary file until
+// the archive is written with Finish.
+type Writer struct {
+	data     *os.File
+	dataSize uint64
+	entries  []entry
+	// contents dedupes identical tiles, which are common for empty areas
+	contents  map[[sha256.Size]byte]entry
+	addressed uint64
+}
+
+// NewWriter creates a Writer with its temporary file in dir, or the default
+// temporary directory if dir is empty.
+func NewWriter(dir string) (*Writer, error) {
+	data, err := os.CreateTemp(dir, "pmtiles-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{data: data, contents: map[[sha256.Size]byte]entry{}}, nil
+}
+
+// AddTile adds a tile to the archive. Tiles must be added in ascending
+// TileID order.
+func (w *Writer) AddTile(z uint8, x, y uint32, data []byte) error {
+	return w.add(TileID(z, x, y), data)
+}
+
+func (w *Writer) add(id uint64, data []byte) error {
+	if len(w.entries) > 0 {
+		last := &w.entries[len(w.entries)-1]
+		if id <= last.TileID+uint64(last.RunLength)-1 {
+			return errors.New("tiles must be added in ascending order")
+		}
+	}
+	w.addressed++
+
+	hash := sha256.Sum256(data)
+	if existing, ok := w.contents[hash]; ok {
+		last := &w.entries[len(w.entries)-1]
+		if last.Offset == existing.Offset && id == last.TileID+uint64(last.RunLength) {
+			last.RunLength++
+			return nil
+		}
+		w.entries = append(w.entries, entry{TileID: id, Offset: existing.Offset, Length: existing.Length, RunLength: 1})
+		return nil
+	}
+
+	if _, err := w.data.Write(data); err != nil {
+		return err
+	}
+	e := entry{TileID: id, Offset: w.dataSize, Length: uint32(len(data)), RunLength: 1}
+	w.dataSize += uint64(len(data))
+	w.contents[hash] = e
+	w.entries = append(w.entries, e)
+	return nil
+}
+
+// directories returns the root directory, and any leaf directories it
+// points to, which together fit in rootSize.
+func (w *Writer) directories() (root, leaves []byte, err error) {
+	root, err = marshalDirectory(w.entries, CompressionGzip)
+	if err != nil {
+		return nil, nil, err
+	}
+	if headerSize+len(root) <= rootSize {
+		return root, nil, nil
+	}
+
+	for size := leafSize; ; size *= 2 {
+		var rootEntries []entry
+		leaves = nil
+		for i := 0; i < len(w.entries); i += size {
+			chunk := w.entries[i:min(i+size, len(w.entries))]
+			leaf, err := marshalDirectory(chunk, CompressionGzip)
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, entry{
+				TileID: chunk[0].TileID,
+				Offset: uint64(len(leaves)),
+				Length: uint32(len(leaf)),
+			})
+			leaves = append(leaves, leaf...)
+		}
+		root, err = marshalDirectory(rootEntries, CompressionGzip)
+		if err != nil {
+			return nil, nil, err
+		}
+		if headerSize+len(root) <= rootSize {
+			return root, leaves, nil
+		}
+	}
+}
+
+// Finish writes the archive to out, filling in the layout fields of h, and
+// removes the temporary file. Metadata is encoded as JSON.
+func (w *Writer) Finish(out io.Writer, h Header, metadata any) error {
+	defer w.Close()
+
+	root, leaves, err := w.directories()
+	if err != nil {
+		return errors.Wrap(err, "building directories")
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	metadataData, err := compress(metadataJSON, CompressionGzip)
+	if err != nil {
+		return err
+	}
+
+	h.InternalCompression = CompressionGzip
+	h.TileCompression = CompressionNone
+	h.Clustered = true
+	h.RootOffset = headerSize
+	h.RootLength = uint64(len(root))
+	h.MetadataOffset = h.RootOffset + h.RootLength
+	h.MetadataLength = uint64(len(metadataData))
+	h.LeafDirsOffset = h.MetadataOffset + h.MetadataLength
+	h.LeafDirsLength = uint64(len(leaves))
+	h.TileDataOffset = h.LeafDirsOffset + h.LeafDirsLength
+	h.TileDataLength = w.dataSize
+	h.AddressedTilesCount = w.addressed
+	h.TileEntriesCount = uint64(len(w.entries))
+	h.TileContentsCount = uint64(len(w.contents))
+
+	for _, section := range [][]byte{h.marshal(), root, metadataData, leaves} {
+		if _, err := out.Write(section); err != nil {
+			return err
+		}
+	}
+	if _, err := w.data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.Copy(out, w.data)
+	return err
+}
+
+// Close discards the archive, removing the temporary file.
+func (w *Writer) Close() error {
+	w.data.Close()
+	if err := os.Remove(w.data.Name()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
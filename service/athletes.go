@@ -0,0 +1,61 @@
+package service
+
+import (
+	"strings"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+// defaultAthlete is how tokens refer to the account configured by
+// STRAVA_REMEMBER_TOKEN and STRAVA4_SESSION.
+const defaultAthlete = "default"
+
+// parseAthleteSessions parses a comma separated list of name=path pairs, where
+// each path is a session file written by cmd/auth.
+func parseAthleteSessions(config string) (map[string]string, error) {
+	sessions := map[string]string{}
+	if config == "" {
+		return sessions, nil
+	}
+	for _, entry := range strings.Split(config, ",") {
+		name, path, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok || name == "" || path == "" {
+			return nil, errors.Errorf("expected name=path, got %q", entry)
+		}
+		if strings.Contains(name, "/") || name == "tiles" || name == defaultAthlete {
+			return nil, errors.Errorf("invalid athlete name %q", name)
+		}
+		if _, ok := sessions[name]; ok {
+			return nil, errors.Errorf("duplicate athlete %s", name)
+		}
+		sessions[name] = path
+	}
+	return sessions, nil
+}
+
+// newAthleteClients creates a Strava client per athlete from their session
+// files. The clients must be closed when they're no longer needed.
+func newAthleteClients(sessions map[string]string, opts ...strava.Option) (map[string]strava.Client, error) {
+	athletes := map[string]strava.Client{}
+	for name, path := range sessions {
+		session, err := strava.ReadSessionFile(path)
+		if err != nil {
+			closeClients(athletes)
+			return nil, errors.Wrapf(err, "athlete %s", name)
+		}
+		client, err := strava.NewClient(session.RememberToken, session.Session, opts...)
+		if err != nil {
+			closeClients(athletes)
+			return nil, errors.Wrapf(err, "athlete %s", name)
+		}
+		athletes[name] = client
+	}
+	return athletes, nil
+}
+
+func closeClients(clients map[string]strava.Client) {
+	for _, client := range clients {
+		client.Close()
+	}
+}
@@ -0,0 +1,97 @@
+package service
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAthleteClients(t *testing.T) {
+	sessions, err := parseAthleteSessions("")
+	require.NoError(t, err)
+	assert.Empty(t, sessions)
+
+	dir := t.TempDir()
+	alice := filepath.Join(dir, "alice.env.auth")
+	// Payload: {"sub":98765}
+	require.NoError(t, os.WriteFile(alice, []byte("STRAVA_REMEMBER_TOKEN=eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOjk4NzY1fQ.fakesig\nSTRAVA4_SESSION=session\n"), 0600))
+
+	sessions, err = parseAthleteSessions("alice=" + alice)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"alice": alice}, sessions)
+
+	athletes, err := newAthleteClients(sessions)
+	require.NoError(t, err)
+	defer closeClients(athletes)
+	require.Contains(t, athletes, "alice")
+	id, err := athletes["alice"].AthleteID()
+	require.NoError(t, err)
+	assert.Equal(t, "98765", id)
+
+	for _, bad := range []string{
+		"alice",
+		"=" + alice,
+		"alice=" + alice + ",alice=" + alice,
+		"tiles=" + alice,
+		"default=" + alice,
+	} {
+		_, err := parseAthleteSessions(bad)
+		assert.Error(t, err, bad)
+	}
+
+	_, err = newAthleteClients(map[string]string{"bob": filepath.Join(dir, "missing")})
+	assert.ErrorContains(t, err, "athlete bob")
+}
+
+func TestTileService_PersonalAthlete(t *testing.T) {
+	requestCount := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/tiles/45654/orange/6/2/3@2x.png", r.URL.Path)
+		rw.WriteHeader(http.StatusOK)
+		requestCount++
+	}))
+
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+	aliceClient := mockStravaClient{}
+	defer aliceClient.AssertExpectations(t)
+
+	aliceClient.On("HttpClient").Return(mockServer.Client())
+	aliceClient.On("AthleteID").Return("45654", nil)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		athletes:     map[string]strava.Client{"alice": &aliceClient},
+		logger:       log.Default(),
+
+		personalHeatmapDomain: mockServer.URL,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/personal/alice/6/2/3", nil)
+	req.SetPathValue("athlete", "alice")
+	w := httptest.NewRecorder()
+
+	err := s.ServePersonalTile(w, req)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, requestCount)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	// Unknown athletes aren't found.
+	req = httptest.NewRequest("GET", "https://example.com/personal/bob/6/2/3", nil)
+	req.SetPathValue("athlete", "bob")
+	w = httptest.NewRecorder()
+
+	err = s.ServePersonalTile(w, req)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, requestCount)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,136 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+type Kind string
+
+const (
+	KindPersonal Kind = "personal"
+	KindGlobal   Kind = "global"
+	// KindTeam tiles are composited from several athletes' personal tiles.
+	KindTeam Kind = "team"
+	// KindAdmin isn't a layer, it's the token endpoint for the admin API.
+	KindAdmin Kind = "admin"
+)
+
+// TileKey identifies a single rendered tile. Any input that changes the image
+// Strava returns must be part of the key.
+type TileKey struct {
+	Kind      Kind
+	AthleteID string
+	Sports    string
+	HeatColor strava.Heat
+	Z         uint64
+	X         uint64
+	Y         uint64
+
+	FilterStart string
+	FilterEnd   string
+
+	IncludeCommutes bool
+
+	RevealPrivacyZones           bool
+	RevealOnlyMeActivities       bool
+	RevealFollowerOnlyActivities bool
+	RevealPublicActivities       bool
+
+	// Underzoom tiles are synthesized from their children rather than
+	// fetched from Strava.
+	Underzoom bool
+	// Source is the location of the PMTiles archive the tile comes from, or
+	// empty for Strava.
+	Source string
+}
+
+func (k TileKey) String() string {
+	s := fmt.Sprintf(
+		"%s/%s/%s/%s/%d/%d/%d/%s/%s/%t/%t/%t/%t/%t",
+		k.Kind,
+		k.AthleteID,
+		k.Sports,
+		k.HeatColor,
+		k.Z,
+		k.X,
+		k.Y,
+		k.FilterStart,
+		k.FilterEnd,
+		k.IncludeCommutes,
+		k.RevealPrivacyZones,
+		k.RevealOnlyMeActivities,
+		k.RevealFollowerOnlyActivities,
+		k.RevealPublicActivities,
+	)
+	// only added when set so existing cache entries keep their keys
+	if k.Underzoom {
+		s += "/underzoom"
+	}
+	if k.Source != "" {
+		s += "/source=" + k.Source
+	}
+	return s
+}
+
+// hash returns a stable, filesystem safe digest of the key.
+func (k TileKey) hash() string {
+	sum := sha256.Sum256([]byte(k.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+// CachedTile is a tile read from a TileCache.
+type CachedTile struct {
+	Data []byte
+	// Modified is when the tile last changed on Strava. Revalidating an
+	// unchanged tile doesn't move it forward.
+	Modified time.Time
+	// Stale tiles have expired, and should be revalidated with Strava before
+	// they're used.
+	Stale bool
+}
+
+// TileCache stores tile images so repeat requests don't go to Strava.
+type TileCache interface {
+	// Get returns the cached tile for key, if present.
+	Get(key TileKey) (CachedTile, bool, error)
+	// Put stores a tile last modified at modified, marking it as freshly
+	// checked with Strava.
+	Put(key TileKey, data []byte, modified time.Time) error
+}
+
+// newTileCacheFromEnv builds the tile cache configured by CACHE_DIR,
+// CACHE_TTL and CACHE_MAX_SIZE. It returns nil if caching is disabled.
+func newTileCacheFromEnv() (TileCache, error) {
+	dir := os.Getenv("CACHE_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+
+	ttl := 7 * 24 * time.Hour
+	if raw := os.Getenv("CACHE_TTL"); raw != "" {
+		var err error
+		ttl, err = time.ParseDuration(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad CACHE_TTL")
+		}
+	}
+
+	var maxSize int64
+	if raw := os.Getenv("CACHE_MAX_SIZE"); raw != "" {
+		var err error
+		maxSize, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad CACHE_MAX_SIZE")
+		}
+	}
+
+	return NewFileCache(dir, ttl, maxSize)
+}
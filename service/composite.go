@@ -0,0 +1,104 @@
+package service
+
+import (
+	"bytes"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+
+	"github.com/pkg/errors"
+)
+
+// stravaTileSize is the width and height of Strava's @2x tiles.
+const stravaTileSize = 512
+
+type blendMode string
+
+const (
+	// blendMax keeps the brightest value of each channel, so overlapping
+	// lines look like a single heatmap.
+	blendMax blendMode = "max"
+	// blendAdd sums channels, so overlapping lines get brighter.
+	blendAdd blendMode = "add"
+)
+
+func parseBlendMode(raw string) (blendMode, error) {
+	switch blendMode(raw) {
+	case "", blendMax:
+		return blendMax, nil
+	case blendAdd:
+		return blendAdd, nil
+	}
+	return "", errors.New("expected max or add")
+}
+
+// parseTint parses a hex color like "ff8800".
+func parseTint(raw string) (color.RGBA, error) {
+	b, err := hex.DecodeString(raw)
+	if err != nil || len(b) != 3 {
+		return color.RGBA{}, errors.New("expected a hex color like ff8800")
+	}
+	return color.RGBA{R: b[0], G: b[1], B: b[2], A: 0xff}, nil
+}
+
+// decodeTile decodes PNG tile data into a premultiplied RGBA image.
+func decodeTile(data []byte) (*image.RGBA, error) {
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba, nil
+	}
+	rgba := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(rgba, rgba.Rect, img, img.Bounds().Min, draw.Src)
+	return rgba, nil
+}
+
+func encodeTile(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// tintTile recolors every pixel of img to tint, keeping its alpha.
+func tintTile(img *image.RGBA, tint color.RGBA) {
+	for i := 0; i < len(img.Pix); i += 4 {
+		a := uint32(img.Pix[i+3])
+		img.Pix[i] = uint8(uint32(tint.R) * a / 0xff)
+		img.Pix[i+1] = uint8(uint32(tint.G) * a / 0xff)
+		img.Pix[i+2] = uint8(uint32(tint.B) * a / 0xff)
+	}
+}
+
+// fadeTile scales the opacity of every pixel of img.
+func fadeTile(img *image.RGBA, opacity float64) {
+	for i, v := range img.Pix {
+		img.Pix[i] = uint8(float64(v) * opacity)
+	}
+}
+
+// compositeTiles blends layers of the same size into dst.
+func compositeTiles(dst *image.RGBA, layers []*image.RGBA, mode blendMode) {
+	for _, layer := range layers {
+		if layer.Rect != dst.Rect {
+			// Strava tiles are all the same size, so this shouldn't happen,
+			// but don't index out of bounds if it does.
+			fitted := image.NewRGBA(dst.Rect)
+			draw.Draw(fitted, dst.Rect, layer, layer.Rect.Min, draw.Src)
+			layer = fitted
+		}
+		for i, v := range layer.Pix {
+			switch mode {
+			case blendAdd:
+				dst.Pix[i] = uint8(min(uint32(dst.Pix[i])+uint32(v), 0xff))
+			default:
+				dst.Pix[i] = max(dst.Pix[i], v)
+			}
+		}
+	}
+}
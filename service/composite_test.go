@@ -0,0 +1,58 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// solidTile returns a size×size tile filled with c.
+func solidTile(size int, c color.RGBA) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+func TestCompositeTiles(t *testing.T) {
+	a := solidTile(2, color.RGBA{R: 200, G: 10, B: 0, A: 200})
+	b := solidTile(2, color.RGBA{R: 100, G: 50, B: 0, A: 100})
+
+	dst := image.NewRGBA(a.Rect)
+	compositeTiles(dst, []*image.RGBA{a, b}, blendMax)
+	assert.Equal(t, color.RGBA{R: 200, G: 50, B: 0, A: 200}, dst.RGBAAt(0, 0))
+
+	dst = image.NewRGBA(a.Rect)
+	compositeTiles(dst, []*image.RGBA{a, b}, blendAdd)
+	assert.Equal(t, color.RGBA{R: 255, G: 60, B: 0, A: 255}, dst.RGBAAt(1, 1))
+}
+
+func TestTintTile(t *testing.T) {
+	img := solidTile(2, color.RGBA{R: 100, G: 50, B: 0, A: 0x80})
+	tintTile(img, color.RGBA{R: 0xff, G: 0, B: 0xff, A: 0xff})
+	assert.Equal(t, color.RGBA{R: 0x80, G: 0, B: 0x80, A: 0x80}, img.RGBAAt(0, 0))
+}
+
+func TestParseTint(t *testing.T) {
+	c, err := parseTint("ff8800")
+	require.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0xff, G: 0x88, B: 0, A: 0xff}, c)
+
+	_, err = parseTint("red")
+	assert.Error(t, err)
+	_, err = parseTint("ff88")
+	assert.Error(t, err)
+}
+
+func TestEncodeDecodeTile(t *testing.T) {
+	img := solidTile(2, color.RGBA{R: 100, G: 50, B: 0, A: 0xff})
+	data, err := encodeTile(img)
+	require.NoError(t, err)
+	decoded, err := decodeTile(data)
+	require.NoError(t, err)
+	assert.Equal(t, img.Pix, decoded.Pix)
+}
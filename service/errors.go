@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+var ErrNotFound = errors.New("not found")
+
+type ErrBadCoord struct {
+	coord string
+}
+
+func (err ErrBadCoord) Error() string {
+	return fmt.Sprintf("invalid tile %s", err.coord)
+}
+
+type ErrBadQuery struct {
+	err   error
+	query string
+}
+
+func (err ErrBadQuery) Unwrap() error {
+	return err.err
+}
+
+func (err ErrBadQuery) Error() string {
+	return fmt.Sprintf("invalid query parameter %s: %v", err.query, err.err)
+}
+
+// ErrUnauthorized means the request's api token is missing or incorrect.
+type ErrUnauthorized struct {
+	err error
+}
+
+func (err ErrUnauthorized) Unwrap() error {
+	return err.err
+}
+
+func (err ErrUnauthorized) Error() string {
+	return err.err.Error()
+}
+
+// ErrForbidden means the request's api token isn't allowed to access what
+// was requested.
+type ErrForbidden struct {
+	err error
+}
+
+func (err ErrForbidden) Unwrap() error {
+	return err.err
+}
+
+func (err ErrForbidden) Error() string {
+	return err.err.Error()
+}
+
+// ErrConflict means the request can't be done with how the proxy is
+// configured.
+type ErrConflict struct {
+	err error
+}
+
+func (err ErrConflict) Unwrap() error {
+	return err.err
+}
+
+func (err ErrConflict) Error() string {
+	return err.err.Error()
+}
+
+// defaultRetryAfter is how long clients are asked to wait when Strava is
+// throttling requests but doesn't say for how long.
+const defaultRetryAfter = time.Minute
+
+// ErrUpstreamThrottled means Strava responded 429 Too Many Requests.
+type ErrUpstreamThrottled struct {
+	retryAfter time.Duration
+}
+
+func (err ErrUpstreamThrottled) Error() string {
+	return fmt.Sprintf("strava is throttling requests, retry after %s", err.retryAfter)
+}
+
+// ErrUpstreamUnavailable means Strava responded with a server error, or
+// something other than a tile that the proxy can't pass on.
+type ErrUpstreamUnavailable struct {
+	status int
+}
+
+func (err ErrUpstreamUnavailable) Error() string {
+	return fmt.Sprintf("strava responded %d %s", err.status, http.StatusText(err.status))
+}
+
+// upstreamStatusError returns the error for a Strava response that means it's
+// throttling or failing, or nil if the response can be forwarded as it is.
+func upstreamStatusError(status int, header http.Header) error {
+	if status == http.StatusTooManyRequests {
+		return ErrUpstreamThrottled{retryAfter: parseRetryAfter(header.Get("Retry-After"))}
+	}
+	if status >= 500 {
+		return ErrUpstreamUnavailable{status: status}
+	}
+	return nil
+}
+
+// parseRetryAfter reads a Retry-After header, either in seconds or as a date.
+func parseRetryAfter(raw string) time.Duration {
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(raw); err == nil {
+		if d := t.Sub(now()); d > 0 {
+			return d
+		}
+	}
+	return defaultRetryAfter
+}
+
+// errorResponse is how an error is reported to clients.
+type errorResponse struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+
+	retryAfter time.Duration
+}
+
+// setRetryAfter tells clients when to retry, for errors that say.
+func (res errorResponse) setRetryAfter(rw http.ResponseWriter) {
+	if res.retryAfter > 0 {
+		rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(res.retryAfter.Seconds()))))
+	}
+}
+
+// classifyError returns how err is reported to clients. ok is false for
+// errors that aren't caused by the request or Strava, which are reported as
+// internal server errors without details.
+func classifyError(err error) (res errorResponse, ok bool) {
+	var (
+		badCoord    ErrBadCoord
+		badQuery    ErrBadQuery
+		unauthorize ErrUnauthorized
+		forbidden   ErrForbidden
+		conflict    ErrConflict
+		throttled   ErrUpstreamThrottled
+		unavailable ErrUpstreamUnavailable
+		netErr      net.Error
+	)
+	switch {
+	case errors.As(err, &badCoord), errors.As(err, &badQuery):
+		return errorResponse{Status: http.StatusBadRequest, Code: "bad_request", Message: err.Error()}, true
+	case errors.As(err, &unauthorize):
+		return errorResponse{Status: http.StatusUnauthorized, Code: "unauthorized", Message: err.Error()}, true
+	case errors.As(err, &forbidden):
+		return errorResponse{Status: http.StatusForbidden, Code: "forbidden", Message: err.Error()}, true
+	case errors.Is(err, ErrNotFound):
+		return errorResponse{Status: http.StatusNotFound, Code: "not_found", Message: "not found"}, true
+	case errors.As(err, &conflict):
+		return errorResponse{Status: http.StatusConflict, Code: "conflict", Message: err.Error()}, true
+	case errors.Is(err, strava.ErrSessionExpired):
+		// an upstream failure like Strava being down, but with its own code
+		// since it needs cmd/auth to be run again rather than waiting
+		return errorResponse{Status: http.StatusBadGateway, Code: "upstream_auth_expired", Message: err.Error()}, true
+	case errors.As(err, &throttled):
+		return errorResponse{Status: http.StatusTooManyRequests, Code: "upstream_throttled", Message: err.Error(), retryAfter: throttled.retryAfter}, true
+	case errors.Is(err, context.Canceled):
+		// the client gave up, so there's no one to respond to
+		return errorResponse{}, false
+	case errors.As(err, &unavailable) && unavailable.status == http.StatusGatewayTimeout,
+		errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errorResponse{Status: http.StatusGatewayTimeout, Code: "upstream_timeout", Message: "strava didn't respond in time"}, true
+	case errors.As(err, &unavailable), errors.As(err, &netErr):
+		return errorResponse{Status: http.StatusBadGateway, Code: "upstream_unavailable", Message: "strava is unavailable"}, true
+	}
+	return errorResponse{Status: http.StatusInternalServerError, Code: "internal", Message: "internal server error"}, false
+}
+
+// writeError responds to errors caused by the request or by Strava, and
+// returns any others for the caller to report.
+func (s *Service) writeError(rw http.ResponseWriter, r *http.Request, err error) error {
+	res, ok := classifyError(err)
+	if !ok {
+		return err
+	}
+	if res.Status >= 500 {
+		s.logger.Printf("error: %s, %v", r.URL.String(), err)
+	}
+	writeErrorResponse(rw, r, res)
+	return nil
+}
+
+// WriteError responds to an error returned by a handler. Errors that aren't
+// caused by the request or Strava are reported as internal server errors.
+func WriteError(rw http.ResponseWriter, r *http.Request, err error) {
+	res, _ := classifyError(err)
+	writeErrorResponse(rw, r, res)
+}
+
+// writeErrorResponse writes an error as JSON if the client accepts it, or as
+// plain text otherwise.
+func writeErrorResponse(rw http.ResponseWriter, r *http.Request, res errorResponse) {
+	if res.Status == 0 {
+		return
+	}
+	res.setRetryAfter(rw)
+	if acceptsJSON(r) {
+		writeJSON(rw, res.Status, struct {
+			Error errorResponse `json:"error"`
+		}{res})
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.WriteHeader(res.Status)
+	rw.Write([]byte(res.Message))
+}
+
+// acceptsJSON reports whether the request's Accept header asks for JSON.
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteError(t *testing.T) {
+	s := Service{logger: log.Default()}
+
+	for _, test := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{ErrBadQuery{query: "color", err: errors.New("unknown")}, http.StatusBadRequest, "bad_request"},
+		{ErrBadCoord{coord: "z"}, http.StatusBadRequest, "bad_request"},
+		{ErrUnauthorized{err: errors.New("incorrect api token")}, http.StatusUnauthorized, "unauthorized"},
+		{ErrForbidden{err: errors.New("not allowed")}, http.StatusForbidden, "forbidden"},
+		{ErrNotFound, http.StatusNotFound, "not_found"},
+		{errors.Wrap(strava.ErrSessionExpired, "athlete me"), http.StatusBadGateway, "upstream_auth_expired"},
+		{ErrUpstreamThrottled{retryAfter: time.Minute}, http.StatusTooManyRequests, "upstream_throttled"},
+		{ErrUpstreamUnavailable{status: http.StatusInternalServerError}, http.StatusBadGateway, "upstream_unavailable"},
+		{ErrUpstreamUnavailable{status: http.StatusGatewayTimeout}, http.StatusGatewayTimeout, "upstream_timeout"},
+	} {
+		req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+		req.Header.Set("Accept", "application/json, image/png;q=0.9")
+		w := httptest.NewRecorder()
+		require.NoError(t, s.writeError(w, req, test.err))
+		assert.Equal(t, test.status, w.Code, test.err)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		var body struct {
+			Error errorResponse `json:"error"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Equal(t, test.status, body.Error.Status)
+		assert.Equal(t, test.code, body.Error.Code)
+		assert.NotEmpty(t, body.Error.Message)
+	}
+
+	// plain text unless JSON is asked for
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	req.Header.Set("Accept", "image/png,*/*")
+	w := httptest.NewRecorder()
+	require.NoError(t, s.writeError(w, req, ErrForbidden{err: errors.New("not allowed to access zoom 14")}))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "not allowed to access zoom 14", w.Body.String())
+
+	// other errors are left to the middleware, which doesn't describe them
+	err := errors.New("disk on fire")
+	assert.Equal(t, err, s.writeError(w, req, err))
+	w = httptest.NewRecorder()
+	WriteError(w, req, err)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.NotContains(t, w.Body.String(), "disk")
+}
+
+func TestTileService_UpstreamErrors(t *testing.T) {
+	status := http.StatusTooManyRequests
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if status == http.StatusTooManyRequests {
+			rw.Header().Set("Retry-After", "120")
+		}
+		if status == http.StatusGatewayTimeout {
+			time.Sleep(50 * time.Millisecond)
+		}
+		rw.WriteHeader(status)
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(&http.Client{Timeout: 20 * time.Millisecond})
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Equal(t, "120", w.Header().Get("Retry-After"))
+
+	status = http.StatusInternalServerError
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	status = http.StatusGatewayTimeout
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusGatewayTimeout, w.Code)
+
+	mockServer.Close()
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 30*time.Second, parseRetryAfter("30"))
+	assert.Equal(t, defaultRetryAfter, parseRetryAfter(""))
+	assert.Equal(t, defaultRetryAfter, parseRetryAfter("soon"))
+
+	later := time.Now().Add(5 * time.Minute).UTC().Format(http.TimeFormat)
+	assert.InDelta(t, 5*time.Minute, parseRetryAfter(later), float64(2*time.Second))
+}
@@ -0,0 +1,257 @@
+package service
+
+import (
+	"container/list"
+	"encoding/binary"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	fileCacheExt = ".tile"
+	// legacyFileCacheExt is for tiles cached before files began with their
+	// modification time. They're read as modified when last checked.
+	legacyFileCacheExt = ".png"
+	// fileCacheHeaderSize is the length of the modification time, in unix
+	// nanoseconds, at the start of each file
+	fileCacheHeaderSize = 8
+	// fileCacheTmpExt is for tiles that are still being written
+	fileCacheTmpExt = ".tmp"
+)
+
+type fileCacheEntry struct {
+	name   string
+	size   int64
+	legacy bool
+}
+
+// FileCache is a TileCache that stores tiles as files in a directory. Each file
+// starts with when the tile was last modified, and the file's own modification
+// time is when it was last fetched or revalidated. Entries that haven't been
+// checked within ttl are returned as stale, and once the total size of the
+// cache exceeds maxSize the least recently used entries are removed. A zero
+// ttl or maxSize disables the respective limit.
+type FileCache struct {
+	dir     string
+	ttl     time.Duration
+	maxSize int64
+
+	lock    sync.Mutex
+	lru     *list.List // front is most recently used
+	entries map[string]*list.Element
+	size    int64
+}
+
+func NewFileCache(dir string, ttl time.Duration, maxSize int64) (*FileCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "creating cache directory")
+	}
+	c := &FileCache{
+		dir:     dir,
+		ttl:     ttl,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: map[string]*list.Element{},
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load indexes tiles already on disk, treating the least recently checked as
+// least recently used, since access order isn't persisted across restarts.
+// Temporary files left by a crash are removed.
+func (c *FileCache) load() error {
+	type found struct {
+		fileCacheEntry
+		modTime time.Time
+	}
+	var existing []found
+	err := filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		entry := fileCacheEntry{name: strings.TrimSuffix(d.Name(), filepath.Ext(d.Name()))}
+		switch filepath.Ext(d.Name()) {
+		case fileCacheExt:
+		case legacyFileCacheExt:
+			entry.legacy = true
+		case fileCacheTmpExt:
+			// left by a write that didn't finish
+			if err := os.Remove(path); err != nil {
+				return errors.Wrap(err, "removing temporary file")
+			}
+			return nil
+		default:
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry.size = info.Size()
+		existing = append(existing, found{fileCacheEntry: entry, modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "indexing cache directory")
+	}
+
+	sort.Slice(existing, func(i, j int) bool {
+		return existing[i].modTime.After(existing[j].modTime)
+	})
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, f := range existing {
+		entry := f.fileCacheEntry
+		if _, ok := c.entries[entry.name]; ok {
+			// an older copy left when a legacy tile was replaced
+			if err := os.Remove(c.path(entry)); err != nil {
+				return errors.Wrap(err, "removing replaced tile")
+			}
+			continue
+		}
+		c.entries[entry.name] = c.lru.PushBack(&entry)
+		c.size += entry.size
+	}
+	return c.evict()
+}
+
+func (c *FileCache) path(entry fileCacheEntry) string {
+	ext := fileCacheExt
+	if entry.legacy {
+		ext = legacyFileCacheExt
+	}
+	return filepath.Join(c.dir, entry.name[:2], entry.name+ext)
+}
+
+func (c *FileCache) Get(key TileKey) (CachedTile, bool, error) {
+	name := key.hash()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	el, ok := c.entries[name]
+	if !ok {
+		return CachedTile{}, false, nil
+	}
+	entry := el.Value.(*fileCacheEntry)
+	path := c.path(*entry)
+	info, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.remove(el)
+		return CachedTile{}, false, nil
+	} else if err != nil {
+		return CachedTile{}, false, err
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		c.remove(el)
+		return CachedTile{}, false, nil
+	} else if err != nil {
+		return CachedTile{}, false, err
+	}
+	modified := info.ModTime()
+	if !entry.legacy {
+		if len(data) < fileCacheHeaderSize {
+			c.remove(el)
+			return CachedTile{}, false, nil
+		}
+		modified = time.Unix(0, int64(binary.BigEndian.Uint64(data)))
+		data = data[fileCacheHeaderSize:]
+	}
+	c.lru.MoveToFront(el)
+	return CachedTile{
+		Data:     data,
+		Modified: modified,
+		Stale:    c.ttl > 0 && time.Since(info.ModTime()) > c.ttl,
+	}, true, nil
+}
+
+func (c *FileCache) Put(key TileKey, data []byte, modified time.Time) error {
+	entry := fileCacheEntry{name: key.hash(), size: int64(fileCacheHeaderSize + len(data))}
+	path := c.path(entry)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so readers never see a partial tile
+	tmp, err := os.CreateTemp(filepath.Dir(path), entry.name+".*"+fileCacheTmpExt)
+	if err != nil {
+		return err
+	}
+	header := binary.BigEndian.AppendUint64(nil, uint64(modified.UnixNano()))
+	if _, err := tmp.Write(append(header, data...)); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if el, ok := c.entries[entry.name]; ok {
+		existing := el.Value.(*fileCacheEntry)
+		if existing.legacy {
+			if err := os.Remove(c.path(*existing)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+		c.size -= existing.size
+		*existing = entry
+		c.lru.MoveToFront(el)
+	} else {
+		c.entries[entry.name] = c.lru.PushFront(&entry)
+	}
+	c.size += entry.size
+	return c.evict()
+}
+
+// evict removes least recently used entries until the cache fits in maxSize.
+// c.lock must be held.
+func (c *FileCache) evict() error {
+	if c.maxSize <= 0 {
+		return nil
+	}
+	for c.size > c.maxSize {
+		el := c.lru.Back()
+		if el == nil {
+			return nil
+		}
+		if err := c.remove(el); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes an entry from the index and disk. c.lock must be held.
+func (c *FileCache) remove(el *list.Element) error {
+	entry := el.Value.(*fileCacheEntry)
+	c.lru.Remove(el)
+	delete(c.entries, entry.name)
+	c.size -= entry.size
+	if err := os.Remove(c.path(*entry)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package service
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileCache(t *testing.T) {
+	c, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	key := TileKey{Kind: KindGlobal, Sports: "all", HeatColor: "blue", Z: 1, X: 2, Y: 3}
+	_, ok, err := c.Get(key)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, c.Put(key, []byte("tile"), time.Now()))
+	tile, ok, err := c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("tile"), tile.Data)
+	assert.False(t, tile.Stale)
+	assert.WithinDuration(t, time.Now(), tile.Modified, time.Minute)
+
+	// Any difference in the key is a different tile.
+	_, ok, err = c.Get(TileKey{Kind: KindGlobal, Sports: "all", HeatColor: "red", Z: 1, X: 2, Y: 3})
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestFileCache_ttl(t *testing.T) {
+	dir := t.TempDir()
+	c, err := NewFileCache(dir, time.Hour, 0)
+	require.NoError(t, err)
+
+	key := TileKey{Kind: KindGlobal, Z: 1, X: 2, Y: 3}
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, c.Put(key, []byte("tile"), old))
+
+	// freshness counts from when the tile was checked, not when it changed
+	tile, ok, err := c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, tile.Stale)
+	assert.WithinDuration(t, old, tile.Modified, time.Second)
+
+	// expired tiles are kept to be revalidated
+	expireCached(t, c, key)
+	tile, ok, err = c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, tile.Stale)
+	assert.WithinDuration(t, old, tile.Modified, time.Second)
+
+	// revalidating keeps the modification time
+	require.NoError(t, c.Put(key, []byte("tile"), tile.Modified))
+	tile, ok, err = c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, tile.Stale)
+	assert.WithinDuration(t, old, tile.Modified, time.Second)
+
+	// both are kept across restarts
+	c, err = NewFileCache(dir, time.Hour, 0)
+	require.NoError(t, err)
+	tile, ok, err = c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, tile.Stale)
+	assert.WithinDuration(t, old, tile.Modified, time.Second)
+	expireCached(t, c, key)
+	c, err = NewFileCache(dir, time.Hour, 0)
+	require.NoError(t, err)
+	tile, ok, err = c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.True(t, tile.Stale)
+	assert.WithinDuration(t, old, tile.Modified, time.Second)
+}
+
+// expireCached makes a cached tile look like it was last checked long ago.
+func expireCached(t *testing.T, c *FileCache, key TileKey) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	checked := time.Now().Add(-24 * time.Hour)
+	path := c.path(*c.entries[key.hash()].Value.(*fileCacheEntry))
+	require.NoError(t, os.Chtimes(path, checked, checked))
+}
+
+func TestFileCache_legacy(t *testing.T) {
+	dir := t.TempDir()
+	key := TileKey{Kind: KindGlobal, Z: 1, X: 2, Y: 3}
+	legacy := filepath.Join(dir, key.hash()[:2], key.hash()+legacyFileCacheExt)
+	require.NoError(t, os.MkdirAll(filepath.Dir(legacy), 0700))
+	require.NoError(t, os.WriteFile(legacy, []byte("tile"), 0600))
+	checked := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(legacy, checked, checked))
+
+	// tiles cached without their modification time were modified when checked
+	c, err := NewFileCache(dir, time.Hour, 0)
+	require.NoError(t, err)
+	tile, ok, err := c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("tile"), tile.Data)
+	assert.True(t, tile.Stale)
+	assert.WithinDuration(t, checked, tile.Modified, time.Second)
+
+	// and replaced once they're revalidated
+	require.NoError(t, c.Put(key, tile.Data, tile.Modified))
+	assert.NoFileExists(t, legacy)
+	assert.Equal(t, int64(fileCacheHeaderSize+4), c.size)
+	c, err = NewFileCache(dir, time.Hour, 0)
+	require.NoError(t, err)
+	tile, ok, err = c.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("tile"), tile.Data)
+	assert.False(t, tile.Stale)
+	assert.WithinDuration(t, checked, tile.Modified, time.Second)
+}
+
+func TestFileCache_lru(t *testing.T) {
+	dir := t.TempDir()
+	// room for two four byte tiles
+	maxSize := int64(2 * (fileCacheHeaderSize + 4))
+	c, err := NewFileCache(dir, 0, maxSize)
+	require.NoError(t, err)
+
+	a := TileKey{Kind: KindGlobal, Z: 1, X: 0, Y: 0}
+	b := TileKey{Kind: KindGlobal, Z: 1, X: 0, Y: 1}
+	d := TileKey{Kind: KindGlobal, Z: 1, X: 1, Y: 0}
+
+	require.NoError(t, c.Put(a, []byte("aaaa"), time.Now()))
+	require.NoError(t, c.Put(b, []byte("bbbb"), time.Now()))
+	// Touch a so b is least recently used.
+	_, ok, err := c.Get(a)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, c.Put(d, []byte("dddd"), time.Now()))
+
+	_, ok, _ = c.Get(a)
+	assert.True(t, ok)
+	_, ok, _ = c.Get(b)
+	assert.False(t, ok)
+	_, ok, _ = c.Get(d)
+	assert.True(t, ok)
+
+	// Existing tiles are picked up on restart, and unfinished writes removed.
+	tmp := filepath.Join(dir, d.hash()[:2], d.hash()+".123"+fileCacheTmpExt)
+	require.NoError(t, os.WriteFile(tmp, []byte("partial"), 0600))
+	c, err = NewFileCache(dir, 0, maxSize)
+	require.NoError(t, err)
+	assert.Equal(t, maxSize, c.size)
+	assert.NoFileExists(t, tmp)
+	_, ok, _ = c.Get(d)
+	assert.True(t, ok)
+}
@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// tileResult is the outcome of fetching a tile from Strava, which can be
+// shared by every request waiting for it.
+type tileResult struct {
+	data     []byte
+	modified time.Time
+	// if Strava didn't respond with a tile, its response is kept to be
+	// forwarded, with the body read into body
+	status int
+	header http.Header
+	body   []byte
+	err    error
+}
+
+// response recreates Strava's response for one of the requests sharing it.
+func (r tileResult) response() *http.Response {
+	return &http.Response{
+		Status:        strconv.Itoa(r.status) + " " + http.StatusText(r.status),
+		StatusCode:    r.status,
+		Header:        r.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(r.body)),
+		ContentLength: int64(len(r.body)),
+	}
+}
+
+// tileFlight is a fetch in progress.
+type tileFlight struct {
+	done    chan struct{}
+	result  tileResult
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// tileFlights coalesces concurrent fetches of the same upstream URL into
+// one request, similar to how CloudFront cookie refreshes are coalesced.
+type tileFlights struct {
+	lock    sync.Mutex
+	flights map[string]*tileFlight
+}
+
+// do calls fetch for url, or waits for a call already in progress. fetch's
+// context is only cancelled once every caller waiting for it has given up.
+func (f *tileFlights) do(ctx context.Context, url string, fetch func(ctx context.Context) tileResult) (tileResult, error) {
+	f.lock.Lock()
+	if f.flights == nil {
+		f.flights = map[string]*tileFlight{}
+	}
+	flight, ok := f.flights[url]
+	if !ok {
+		fetchCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		flight = &tileFlight{done: make(chan struct{}), cancel: cancel}
+		f.flights[url] = flight
+		go func() {
+			result := fetch(fetchCtx)
+			cancel()
+			f.lock.Lock()
+			if f.flights[url] == flight {
+				delete(f.flights, url)
+			}
+			f.lock.Unlock()
+			flight.result = result
+			close(flight.done)
+		}()
+	}
+	flight.waiters++
+	f.lock.Unlock()
+
+	select {
+	case <-flight.done:
+		return flight.result, nil
+	case <-ctx.Done():
+		f.lock.Lock()
+		flight.waiters--
+		if flight.waiters == 0 {
+			flight.cancel()
+			// later requests start a new fetch rather than joining a
+			// cancelled one
+			if f.flights[url] == flight {
+				delete(f.flights, url)
+			}
+		}
+		f.lock.Unlock()
+		return tileResult{}, ctx.Err()
+	}
+}
@@ -0,0 +1,159 @@
+package service
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func flightWaiters(s *Service) int {
+	s.flights.lock.Lock()
+	defer s.flights.lock.Unlock()
+	waiters := 0
+	for _, flight := range s.flights.flights {
+		waiters += flight.waiters
+	}
+	return waiters
+}
+
+func TestLoadTile_coalesced(t *testing.T) {
+	var requestCount atomic.Int32
+	var missing atomic.Bool
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestCount.Add(1)
+		<-release
+		if missing.Load() {
+			rw.Header().Set("X-Test", "missing")
+			rw.WriteHeader(http.StatusNotFound)
+			rw.Write([]byte("not found"))
+			return
+		}
+		rw.Write([]byte("tile"))
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	s := &Service{
+		stravaClient:        &stravaClient,
+		logger:              log.Default(),
+		globalHeatmapDomain: mockServer.URL,
+	}
+	p := Params{z: 10, x: 163, y: 357, sports: "all", heatColor: "blue"}
+
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tile, res, err := s.loadTile(context.Background(), KindGlobal, &stravaClient, p)
+			assert.NoError(t, err)
+			assert.Nil(t, res)
+			assert.Equal(t, []byte("tile"), tile.Data)
+		}()
+	}
+	require.Eventually(t, func() bool { return flightWaiters(s) == 5 }, time.Second, time.Millisecond)
+	release <- struct{}{}
+	wg.Wait()
+	assert.Equal(t, int32(1), requestCount.Load())
+
+	// once the fetch is done, the next request fetches again
+	go func() { release <- struct{}{} }()
+	_, _, err := s.loadTile(context.Background(), KindGlobal, &stravaClient, p)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), requestCount.Load())
+
+	// responses other than tiles are copied to each request
+	missing.Store(true)
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tile, res, err := s.loadTile(context.Background(), KindGlobal, &stravaClient, p)
+			assert.NoError(t, err)
+			assert.Nil(t, tile.Data)
+			if assert.NotNil(t, res) {
+				defer res.Body.Close()
+				assert.Equal(t, http.StatusNotFound, res.StatusCode)
+				assert.Equal(t, "missing", res.Header.Get("X-Test"))
+				body, _ := io.ReadAll(res.Body)
+				assert.Equal(t, "not found", string(body))
+			}
+		}()
+	}
+	require.Eventually(t, func() bool { return flightWaiters(s) == 3 }, time.Second, time.Millisecond)
+	release <- struct{}{}
+	wg.Wait()
+	assert.Equal(t, int32(3), requestCount.Load())
+}
+
+func TestLoadTile_coalescedCancel(t *testing.T) {
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{})
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		select {
+		case <-release:
+			rw.Write([]byte("tile"))
+		case <-r.Context().Done():
+			close(cancelled)
+		}
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	s := &Service{
+		stravaClient:        &stravaClient,
+		logger:              log.Default(),
+		globalHeatmapDomain: mockServer.URL,
+	}
+	p := Params{z: 10, x: 163, y: 357, sports: "all", heatColor: "blue"}
+
+	// the request that started the fetch giving up doesn't affect others
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, _, err := s.loadTile(ctx, KindGlobal, &stravaClient, p)
+		first <- err
+	}()
+	<-started
+	second := make(chan []byte)
+	go func() {
+		tile, _, err := s.loadTile(context.Background(), KindGlobal, &stravaClient, p)
+		assert.NoError(t, err)
+		second <- tile.Data
+	}()
+	require.Eventually(t, func() bool { return flightWaiters(s) == 2 }, time.Second, time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+	close(release)
+	assert.Equal(t, []byte("tile"), <-second)
+
+	// once every request gives up, so does the fetch
+	release = make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, _, err := s.loadTile(ctx, KindGlobal, &stravaClient, p)
+		first <- err
+	}()
+	<-started
+	cancel()
+	assert.ErrorIs(t, <-first, context.Canceled)
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("upstream request wasn't cancelled")
+	}
+}
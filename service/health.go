@@ -0,0 +1,41 @@
+package service
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+)
+
+type health struct {
+	Status string `json:"status"`
+	// Auth is the state of each athlete's Strava session.
+	Auth map[string]strava.AuthState `json:"auth"`
+}
+
+// ServeHealth reports whether the proxy can reach Strava. It responds with
+// 503 if any session has expired, so monitoring can alert that cmd/auth needs
+// to be run again.
+func (s *Service) ServeHealth(rw http.ResponseWriter, r *http.Request) error {
+	h := health{
+		Status: "ok",
+		Auth: map[string]strava.AuthState{
+			defaultAthlete: s.stravaClient.AuthState(),
+		},
+	}
+	for name, client := range s.athletes {
+		h.Auth[name] = client.AuthState()
+	}
+
+	status := http.StatusOK
+	for _, state := range h.Auth {
+		if state == strava.AuthStateExpired {
+			h.Status = "session expired"
+			status = http.StatusServiceUnavailable
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	return json.NewEncoder(rw).Encode(h)
+}
@@ -0,0 +1,50 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeHealth(t *testing.T) {
+	stravaClient := mockStravaClient{}
+	stravaClient.On("AuthState").Return(strava.AuthStateOK)
+	aliceClient := mockStravaClient{}
+	aliceClient.On("AuthState").Return(strava.AuthStateUnknown)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		athletes:     map[string]strava.Client{"alice": &aliceClient},
+		logger:       log.Default(),
+	}
+
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeHealth(w, httptest.NewRequest("GET", "https://example.com/health", nil)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var h health
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &h))
+	assert.Equal(t, health{
+		Status: "ok",
+		Auth: map[string]strava.AuthState{
+			"default": strava.AuthStateOK,
+			"alice":   strava.AuthStateUnknown,
+		},
+	}, h)
+
+	bobClient := mockStravaClient{}
+	bobClient.On("AuthState").Return(strava.AuthStateExpired)
+	s.athletes["bob"] = &bobClient
+
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeHealth(w, httptest.NewRequest("GET", "https://example.com/health", nil)))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &h))
+	assert.Equal(t, "session expired", h.Status)
+	assert.Equal(t, strava.AuthStateExpired, h.Auth["bob"])
+}
@@ -0,0 +1,62 @@
+package service
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"os"
+)
+
+// defaultCacheControls are the Cache-Control headers sent with each kind of
+// tile. Personal heatmaps change whenever an activity is uploaded and are
+// private, while the global heatmap is only rebuilt every month or so.
+var defaultCacheControls = map[Kind]string{
+	KindPersonal: "private, max-age=3600",
+	KindTeam:     "private, max-age=3600",
+	KindGlobal:   "public, max-age=86400",
+}
+
+// cacheControlsFromEnv reads overrides for the Cache-Control headers from
+// CACHE_CONTROL_PERSONAL, CACHE_CONTROL_GLOBAL and CACHE_CONTROL_TEAM.
+func cacheControlsFromEnv() map[Kind]string {
+	controls := map[Kind]string{}
+	for kind, env := range map[Kind]string{
+		KindPersonal: "CACHE_CONTROL_PERSONAL",
+		KindGlobal:   "CACHE_CONTROL_GLOBAL",
+		KindTeam:     "CACHE_CONTROL_TEAM",
+	} {
+		if raw := os.Getenv(env); raw != "" {
+			controls[kind] = raw
+		}
+	}
+	return controls
+}
+
+// cacheControl returns the Cache-Control header for a kind of tile.
+func (s *Service) cacheControl(kind Kind) string {
+	if control, ok := s.cacheControls[kind]; ok {
+		return control
+	}
+	return defaultCacheControls[kind]
+}
+
+// tileETag is a strong ETag for tile data, from a hash of its content.
+func tileETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeTile writes a tile with caching headers for its kind. If the request's
+// If-None-Match or If-Modified-Since headers show the client already has it,
+// the response is 304 Not Modified instead.
+func (s *Service) writeTile(rw http.ResponseWriter, r *http.Request, kind Kind, tile Tile) error {
+	header := rw.Header()
+	header.Set("Content-Type", "image/png")
+	header.Set("Cache-Control", s.cacheControl(kind))
+	header.Set("ETag", tileETag(tile.Data))
+	// ServeContent handles the conditional headers, and only sets
+	// Last-Modified if the time is known
+	http.ServeContent(rw, r, "", tile.Modified, bytes.NewReader(tile.Data))
+	return nil
+}
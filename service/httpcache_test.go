@@ -0,0 +1,169 @@
+package service
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTileService_CachingHeaders(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte("tile"))
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "tile", w.Body.String())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "public, max-age=86400", w.Header().Get("Cache-Control"))
+	etag := w.Header().Get("ETag")
+	assert.Equal(t, tileETag([]byte("tile")), etag)
+	lastModified := w.Header().Get("Last-Modified")
+	assert.NotEmpty(t, lastModified)
+
+	// the same content has the same ETag, and clients that already have it
+	// aren't sent it again
+	req = httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	req.Header.Set("If-None-Match", etag)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+	assert.Empty(t, w.Body.String())
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+
+	req = httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	req = httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	req.Header.Set("If-Modified-Since", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusNotModified, w.Code)
+
+	// the header is configurable per kind
+	s.cacheControls = map[Kind]string{KindGlobal: "no-store"}
+	req = httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+}
+
+func TestTileService_ForwardHeaders(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Cache-Control", "max-age=60")
+		http.SetCookie(rw, &http.Cookie{Name: "CloudFront-Policy", Value: "secret"})
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("not found"))
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "not found", w.Body.String())
+	assert.Equal(t, "max-age=60", w.Header().Get("Cache-Control"))
+	assert.Empty(t, w.Header().Values("Set-Cookie"))
+}
+
+func TestLoadTile_revalidate(t *testing.T) {
+	var ifModifiedSince string
+	status := http.StatusNotModified
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ifModifiedSince = r.Header.Get("If-Modified-Since")
+		rw.WriteHeader(status)
+		if status == http.StatusOK {
+			rw.Write([]byte("new tile"))
+		}
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	stravaClient.On("RefreshCloudFrontCookies").Return(nil)
+
+	cache, err := NewFileCache(t.TempDir(), time.Hour, 0)
+	require.NoError(t, err)
+	s := &Service{
+		stravaClient:        &stravaClient,
+		logger:              log.Default(),
+		cache:               cache,
+		globalHeatmapDomain: mockServer.URL,
+	}
+	p := Params{z: 10, x: 163, y: 357, sports: "all", heatColor: "blue"}
+	key, _, err := s.tileRequest(KindGlobal, &stravaClient, p)
+	require.NoError(t, err)
+	expire := func() { expireCached(t, cache, key) }
+
+	old := time.Now().Add(-2 * time.Hour).Truncate(time.Second)
+	require.NoError(t, cache.Put(key, []byte("tile"), old))
+	expire()
+
+	// an unchanged tile is served from the cache, and fresh again, but still
+	// last modified when it was first fetched
+	tile, res, err := s.loadTile(t.Context(), KindGlobal, &stravaClient, p)
+	require.NoError(t, err)
+	require.Nil(t, res)
+	assert.Equal(t, []byte("tile"), tile.Data)
+	assert.True(t, old.Equal(tile.Modified))
+	assert.Equal(t, old.UTC().Format(http.TimeFormat), ifModifiedSince)
+	cached, ok, err := cache.Get(key)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.False(t, cached.Stale)
+	assert.True(t, old.Equal(cached.Modified))
+
+	// so the next revalidation asks about the same time
+	expire()
+	_, _, err = s.loadTile(t.Context(), KindGlobal, &stravaClient, p)
+	require.NoError(t, err)
+	assert.Equal(t, old.UTC().Format(http.TimeFormat), ifModifiedSince)
+
+	// a changed tile replaces the cached one
+	expire()
+	status = http.StatusOK
+	tile, _, err = s.loadTile(t.Context(), KindGlobal, &stravaClient, p)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new tile"), tile.Data)
+	cached, _, err = cache.Get(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new tile"), cached.Data)
+
+	// if Strava can't be reached, the stale tile is better than nothing
+	expire()
+	mockServer.Close()
+	tile, _, err = s.loadTile(t.Context(), KindGlobal, &stravaClient, p)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new tile"), tile.Data)
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"image"
+	"math"
+	"net/http"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+)
+
+// maxOverzoom is the highest zoom level tiles are served at. Above
+// strava.HeatmapMaxZoom, tiles are upscaled from their ancestor at that zoom.
+const maxOverzoom = 18
+
+// checkTile returns which of a tile's coordinates is out of range, or "" if
+// it's a valid tile from minUnderzoom to maxOverzoom.
+func checkTile(z, x, y uint64) string {
+	if z < minUnderzoom || z > maxOverzoom {
+		return "z"
+	}
+	if x >= geo.Tiles(z) {
+		return "x"
+	}
+	if y >= geo.Tiles(z) {
+		return "y"
+	}
+	return ""
+}
+
+// overzoomParent returns the params for the ancestor of p's tile at
+// strava.HeatmapMaxZoom, and how many levels below it p is.
+func overzoomParent(p Params) (Params, uint64) {
+	levels := p.z - strava.HeatmapMaxZoom
+	parent := p
+	parent.z = strava.HeatmapMaxZoom
+	parent.x = p.x >> levels
+	parent.y = p.y >> levels
+	return parent, levels
+}
+
+// loadOverzoomTile loads a tile above strava.HeatmapMaxZoom by cropping the
+// part of its ancestor it covers and scaling it up to a full tile.
+func (s *Service) loadOverzoomTile(ctx context.Context, kind Kind, stravaClient strava.Client, p Params) (Tile, *http.Response, error) {
+	parentParams, levels := overzoomParent(p)
+	parent, res, err := s.source(kind).LoadTile(ctx, stravaClient, parentParams)
+	if err != nil || res != nil {
+		return Tile{}, res, err
+	}
+	img, err := decodeTile(parent.Data)
+	if err != nil {
+		return Tile{}, nil, err
+	}
+
+	n := uint64(1) << levels
+	size := img.Rect.Dx()
+	crop := image.Rect(
+		int(p.x%n)*size/int(n),
+		int(p.y%n)*size/int(n),
+		int(p.x%n+1)*size/int(n),
+		int(p.y%n+1)*size/int(n),
+	)
+	data, err := encodeTile(upscaleTile(img, crop, size))
+	if err != nil {
+		return Tile{}, nil, err
+	}
+	return Tile{Data: data, Modified: parent.Modified}, nil, nil
+}
+
+// upscaleTile scales the crop of src up to a size×size image with bilinear
+// interpolation. Pixels at the crop's edges blend with their neighbors in src
+// rather than being clamped, so adjacent tiles line up.
+func upscaleTile(src *image.RGBA, crop image.Rectangle, size int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	scaleX := float64(crop.Dx()) / float64(size)
+	scaleY := float64(crop.Dy()) / float64(size)
+	maxX, maxY := src.Rect.Max.X-1, src.Rect.Max.Y-1
+	for y := range size {
+		sy := float64(crop.Min.Y) + (float64(y)+0.5)*scaleY - 0.5
+		y0 := int(math.Floor(sy))
+		fy := sy - float64(y0)
+		y1 := min(max(y0+1, 0), maxY)
+		y0 = min(max(y0, 0), maxY)
+		for x := range size {
+			sx := float64(crop.Min.X) + (float64(x)+0.5)*scaleX - 0.5
+			x0 := int(math.Floor(sx))
+			fx := sx - float64(x0)
+			x1 := min(max(x0+1, 0), maxX)
+			x0 = min(max(x0, 0), maxX)
+
+			p00 := src.Pix[src.PixOffset(x0, y0):][:4]
+			p10 := src.Pix[src.PixOffset(x1, y0):][:4]
+			p01 := src.Pix[src.PixOffset(x0, y1):][:4]
+			p11 := src.Pix[src.PixOffset(x1, y1):][:4]
+			out := dst.Pix[dst.PixOffset(x, y):][:4]
+			for c := range 4 {
+				top := float64(p00[c])*(1-fx) + float64(p10[c])*fx
+				bottom := float64(p01[c])*(1-fx) + float64(p11[c])*fx
+				out[c] = uint8(math.Round(top*(1-fy) + bottom*fy))
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,119 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTileService_BadCoords(t *testing.T) {
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+	}
+
+	for path, coord := range map[string]string{
+		"/tiles/3/8/0":      "x",
+		"/tiles/3/0/8":      "y",
+		"/tiles/14/16384/0": "x",
+		// below minUnderzoom, so not sent to Strava
+		"/tiles/2/0/0":  "z",
+		"/tiles/0/0/0":  "z",
+		"/tiles/19/0/0": "z",
+		"/tiles/99/0/0": "z",
+	} {
+		req := httptest.NewRequest("GET", "https://example.com"+path, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		assert.Equal(t, http.StatusBadRequest, w.Code, path)
+		assert.Contains(t, w.Body.String(), ErrBadCoord{coord: coord}.Error(), path)
+	}
+}
+
+func TestTileService_Overzoom(t *testing.T) {
+	// the left half of the parent tile has lines, the right half doesn't
+	parent := image.NewRGBA(image.Rect(0, 0, stravaTileSize, stravaTileSize))
+	red := color.RGBA{R: 0xff, A: 0xff}
+	draw.Draw(parent, image.Rect(0, 0, stravaTileSize/2, stravaTileSize), image.NewUniform(red), image.Point{}, draw.Src)
+	parentData, err := encodeTile(parent)
+	require.NoError(t, err)
+
+	var paths []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		if r.URL.Path == "/identified/globalheat/all/blue/14/100/201@2x.png" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write(parentData)
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	load := func(path string) *image.RGBA {
+		req := httptest.NewRequest("GET", "https://example.com/tiles/"+path, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		require.Equal(t, http.StatusOK, w.Code, path)
+		img, err := decodeTile(w.Body.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, stravaTileSize, stravaTileSize), img.Rect)
+		return img
+	}
+
+	// z16 tiles are a quarter of their z14 parent across
+	img := load("16/401/800")
+	assert.Equal(t, []string{"/identified/globalheat/all/blue/14/100/200@2x.png"}, paths)
+	assert.Equal(t, red, img.RGBAAt(stravaTileSize/2, stravaTileSize/2))
+	assert.Equal(t, red, img.RGBAAt(0, 0))
+
+	img = load("16/403/803")
+	assert.Equal(t, "/identified/globalheat/all/blue/14/100/200@2x.png", paths[1])
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(stravaTileSize/2, stravaTileSize/2))
+
+	// the edge between tiles blends with the neighboring pixels of the parent
+	img = load("15/200/400")
+	assert.Equal(t, red, img.RGBAAt(0, 0))
+	edge := img.RGBAAt(stravaTileSize-1, 0).A
+	assert.Greater(t, edge, uint8(0))
+	assert.Less(t, edge, uint8(0xff))
+
+	// missing parents are missing children
+	req := httptest.NewRequest("GET", "https://example.com/tiles/15/200/402", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestUpscaleTile(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	src.SetRGBA(1, 1, color.RGBA{R: 200, A: 200})
+
+	// a single pixel fills the tile, fading towards its neighbors
+	dst := upscaleTile(src, image.Rect(1, 1, 2, 2), 8)
+	center := dst.RGBAAt(3, 3)
+	corner := dst.RGBAAt(0, 0)
+	assert.Greater(t, center.A, uint8(150))
+	assert.Equal(t, center.R, center.A)
+	assert.Less(t, corner.A, center.A)
+	assert.Greater(t, corner.A, uint8(0))
+
+	// sampling is clamped to the source
+	dst = upscaleTile(src, image.Rect(0, 0, 1, 1), 8)
+	assert.Equal(t, color.RGBA{}, dst.RGBAAt(0, 0))
+}
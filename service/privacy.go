@@ -0,0 +1,54 @@
+package service
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// Privacy controls which activities are revealed on personal tiles.
+type Privacy struct {
+	RevealPrivacyZones           bool `json:"reveal_privacy_zones"`
+	RevealOnlyMeActivities       bool `json:"reveal_only_me_activities"`
+	RevealFollowerOnlyActivities bool `json:"reveal_follower_only_activities"`
+	RevealPublicActivities       bool `json:"reveal_public_activities"`
+}
+
+// parsePrivacy reads per-request privacy options. Options not present in q
+// default to the ceiling, and a request can only hide more than the ceiling,
+// never reveal more.
+func parsePrivacy(q url.Values, ceiling Privacy) (p Privacy, err error) {
+	p.RevealPrivacyZones, err = parseReveal(q, "reveal_privacy_zones", ceiling.RevealPrivacyZones)
+	if err != nil {
+		return p, err
+	}
+	p.RevealOnlyMeActivities, err = parseReveal(q, "reveal_only_me_activities", ceiling.RevealOnlyMeActivities)
+	if err != nil {
+		return p, err
+	}
+	p.RevealFollowerOnlyActivities, err = parseReveal(q, "reveal_follower_only_activities", ceiling.RevealFollowerOnlyActivities)
+	if err != nil {
+		return p, err
+	}
+	p.RevealPublicActivities, err = parseReveal(q, "reveal_public_activities", ceiling.RevealPublicActivities)
+	if err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func parseReveal(q url.Values, query string, ceiling bool) (bool, error) {
+	raw := q.Get(query)
+	if raw == "" {
+		return ceiling, nil
+	}
+	reveal, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, ErrBadQuery{query: query, err: errors.New("expected true or false")}
+	}
+	if reveal && !ceiling {
+		return false, ErrBadQuery{query: query, err: errors.New("not allowed by server")}
+	}
+	return reveal, nil
+}
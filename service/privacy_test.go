@@ -0,0 +1,51 @@
+package service
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePrivacy(t *testing.T) {
+	all := Privacy{
+		RevealPrivacyZones:           true,
+		RevealOnlyMeActivities:       true,
+		RevealFollowerOnlyActivities: true,
+		RevealPublicActivities:       true,
+	}
+	publicOnly := Privacy{RevealPublicActivities: true}
+
+	// Defaults to the ceiling.
+	p, err := parsePrivacy(url.Values{}, all)
+	require.NoError(t, err)
+	assert.Equal(t, all, p)
+
+	// Can narrow.
+	p, err = parsePrivacy(url.Values{
+		"reveal_privacy_zones":            []string{"false"},
+		"reveal_only_me_activities":       []string{"false"},
+		"reveal_follower_only_activities": []string{"false"},
+	}, all)
+	require.NoError(t, err)
+	assert.Equal(t, publicOnly, p)
+
+	// Explicitly asking for what's allowed is fine.
+	p, err = parsePrivacy(url.Values{"reveal_public_activities": []string{"true"}}, publicOnly)
+	require.NoError(t, err)
+	assert.Equal(t, publicOnly, p)
+
+	// Can't exceed the ceiling.
+	for _, query := range []string{
+		"reveal_privacy_zones",
+		"reveal_only_me_activities",
+		"reveal_follower_only_activities",
+	} {
+		_, err = parsePrivacy(url.Values{query: []string{"true"}}, publicOnly)
+		assert.ErrorAs(t, err, &ErrBadQuery{}, query)
+	}
+
+	_, err = parsePrivacy(url.Values{"reveal_public_activities": []string{"maybe"}}, all)
+	assert.ErrorAs(t, err, &ErrBadQuery{})
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxRenderTiles limits how many tiles are fetched to render a single
+	// image.
+	maxRenderTiles = 100
+	// maxRenderSize is the largest width or height of a rendered image.
+	maxRenderSize = 2048
+)
+
+// mapView is the area covered by a rendered image, in a CRS that's linear
+// across the image.
+type mapView struct {
+	minX, minY, maxX, maxY float64
+	width, height          int
+	// toMercator converts the view's CRS to web mercator meters
+	toMercator func(x, y float64) (float64, float64)
+}
+
+// resolution returns the horizontal web mercator meters per pixel at the
+// center of the view.
+func (v mapView) resolution() float64 {
+	centerY := (v.minY + v.maxY) / 2
+	x0, _ := v.toMercator(v.minX, centerY)
+	x1, _ := v.toMercator(v.maxX, centerY)
+	return (x1 - x0) / float64(v.width)
+}
+
+// zoom returns the lowest heatmap zoom level with at least the view's
+// resolution, from minUnderzoom up to maxZoom.
+func (v mapView) zoom(maxZoom uint64) uint64 {
+	tileResolution := 2 * geo.MercatorExtent / stravaTileSize
+	// allow a little rounding error, so views exactly matching a zoom
+	// level's resolution don't use the next one
+	z := math.Ceil(math.Log2(tileResolution/v.resolution()) - 0.01)
+	if math.IsNaN(z) || z < minUnderzoom {
+		return minUnderzoom
+	}
+	if z > float64(maxZoom) {
+		return maxZoom
+	}
+	return uint64(z)
+}
+
+// tilePixel returns the position of the center of image pixel (x, y) on the
+// tile plane at zoom z, in pixels from its top left.
+func (v mapView) tilePixel(x, y int, z uint64) (float64, float64) {
+	cx := v.minX + (float64(x)+0.5)*(v.maxX-v.minX)/float64(v.width)
+	cy := v.maxY - (float64(y)+0.5)*(v.maxY-v.minY)/float64(v.height)
+	mx, my := v.toMercator(cx, cy)
+	tx, ty := geo.MercatorToTile(mx, my, z)
+	return tx * stravaTileSize, ty * stravaTileSize
+}
+
+// tileRange returns the tiles at zoom z needed to render the view. Columns
+// aren't wrapped, so views crossing the antimeridian have columns outside
+// the tile plane.
+func (v mapView) tileRange(z uint64) (minX, minY, maxX, maxY int64) {
+	minX, minY, maxX, maxY = math.MaxInt64, math.MaxInt64, math.MinInt64, math.MinInt64
+	for _, corner := range [][2]int{{0, 0}, {v.width - 1, 0}, {0, v.height - 1}, {v.width - 1, v.height - 1}} {
+		px, py := v.tilePixel(corner[0], corner[1], z)
+		tx := int64(math.Floor(px / stravaTileSize))
+		ty := int64(math.Floor(py / stravaTileSize))
+		minX, maxX = min(minX, tx), max(maxX, tx)
+		minY, maxY = min(minY, ty), max(maxY, ty)
+	}
+	last := int64(geo.Tiles(z)) - 1
+	return minX, max(minY, 0), maxX, min(maxY, last)
+}
+
+// ErrTooManyTiles means rendering a view would need more than maxRenderTiles
+// tiles.
+type ErrTooManyTiles struct {
+	count int64
+}
+
+func (err ErrTooManyTiles) Error() string {
+	return fmt.Sprintf("area needs %d tiles, more than the limit of %d; zoom in or request a smaller image", err.count, maxRenderTiles)
+}
+
+// renderView stitches the tiles covering a view at zoom z into an image of
+// the view, resampling them to its CRS.
+func (s *Service) renderView(ctx context.Context, kind Kind, stravaClient strava.Client, p Params, v mapView, z uint64) (*image.RGBA, error) {
+	minX, minY, maxX, maxY := v.tileRange(z)
+	if count := (maxX - minX + 1) * (maxY - minY + 1); count > maxRenderTiles {
+		return nil, ErrTooManyTiles{count: count}
+	}
+
+	type tileAddr struct{ x, y int64 }
+	var lock sync.Mutex
+	tiles := map[tileAddr]*image.RGBA{}
+	var firstErr error
+	var wg sync.WaitGroup
+	n := int64(geo.Tiles(z))
+	for ty := minY; ty <= maxY; ty++ {
+		for tx := minX; tx <= maxX; tx++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tp := p
+				tp.z = z
+				tp.x = uint64((tx%n + n) % n)
+				tp.y = uint64(ty)
+				tile, err := s.loadTileImage(ctx, kind, stravaClient, tp)
+				lock.Lock()
+				defer lock.Unlock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = errors.Wrapf(err, "tile %d/%d/%d", tp.z, tp.x, tp.y)
+					}
+					return
+				}
+				tiles[tileAddr{tx, ty}] = tile
+			}()
+		}
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, v.width, v.height))
+	for y := 0; y < v.height; y++ {
+		for x := 0; x < v.width; x++ {
+			px, py := v.tilePixel(x, y, z)
+			tx := int64(math.Floor(px / stravaTileSize))
+			ty := int64(math.Floor(py / stravaTileSize))
+			tile := tiles[tileAddr{tx, ty}]
+			if tile == nil {
+				continue
+			}
+			// nearest neighbor, which keeps heatmap lines crisp
+			sx := int(math.Floor(px) - float64(tx*stravaTileSize))
+			sy := int(math.Floor(py) - float64(ty*stravaTileSize))
+			if !(image.Point{sx, sy}.In(tile.Rect)) {
+				continue
+			}
+			copy(img.Pix[img.PixOffset(x, y):][:4], tile.Pix[tile.PixOffset(sx, sy):][:4])
+		}
+	}
+	return img, nil
+}
+
+// loadTileImage fetches and decodes a tile, returning nil if there's no tile
+// there.
+func (s *Service) loadTileImage(ctx context.Context, kind Kind, stravaClient strava.Client, p Params) (*image.RGBA, error) {
+	tile, res, err := s.loadTile(ctx, kind, stravaClient, p)
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if res != nil {
+		res.Body.Close()
+		if res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusNoContent {
+			return nil, nil
+		}
+		return nil, ErrUpstreamUnavailable{status: res.StatusCode}
+	}
+	return decodeTile(tile.Data)
+}
+
+// drawOver draws layers on top of each other onto dst.
+func drawOver(dst *image.RGBA, layers ...*image.RGBA) {
+	for _, layer := range layers {
+		draw.Draw(dst, dst.Rect, layer, layer.Rect.Min, draw.Over)
+	}
+}
+
+// parseFloats reads n comma separated numbers.
+func parseFloats(raw, query string, n int) ([]float64, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != n {
+		return nil, ErrBadQuery{query: query, err: errors.Errorf("expected %d comma separated numbers", n)}
+	}
+	values := make([]float64, n)
+	for i, part := range parts {
+		var err error
+		values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, ErrBadQuery{query: query, err: err}
+		}
+	}
+	return values, nil
+}
+
+// writeImage encodes a rendered image as format, image/png or image/jpeg.
+func writeImage(rw http.ResponseWriter, img image.Image, format string) error {
+	var buf bytes.Buffer
+	var err error
+	if format == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return err
+	}
+	rw.Header().Set("Content-Type", format)
+	rw.WriteHeader(http.StatusOK)
+	_, err = rw.Write(buf.Bytes())
+	return err
+}
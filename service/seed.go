@@ -0,0 +1,478 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxSeedTiles limits the number of tiles in a seed job.
+	maxSeedTiles = 100000
+	// maxSeedJobs is how many finished jobs are kept for reporting.
+	maxSeedJobs = 100
+	// maxActiveSeedJobs limits how many jobs can be running or queued at once.
+	maxActiveSeedJobs = 10
+	// maxSeedRegionSize limits the size of a GeoJSON region in a request body.
+	maxSeedRegionSize = 1 << 20
+	// maxSeedBuffer limits the distance around a route that's seeded, in
+	// meters.
+	maxSeedBuffer = 50000
+
+	defaultSeedConcurrency = 2
+)
+
+const (
+	seedRunning   = "running"
+	seedDone      = "done"
+	seedCancelled = "cancelled"
+)
+
+// seedStatus is the progress of a seed job.
+type seedStatus struct {
+	ID      string `json:"id"`
+	Status  string `json:"status"`
+	Layer   Kind   `json:"layer"`
+	Athlete string `json:"athlete,omitempty"`
+	MinZoom uint64 `json:"min_zoom"`
+	MaxZoom uint64 `json:"max_zoom"`
+
+	Total int `json:"total"`
+	// Fetched tiles are now cached, and Empty tiles are ones Strava has
+	// nothing for.
+	Fetched int `json:"fetched"`
+	Empty   int `json:"empty"`
+	Failed  int `json:"failed"`
+	// Error is the most recent failure.
+	Error string `json:"error,omitempty"`
+
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// seedJob fetches every tile of a layer in a region, so they're cached
+// before they're needed.
+type seedJob struct {
+	kind         Kind
+	stravaClient strava.Client
+	p            Params
+	tiles        []geo.Tile
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	lock   sync.Mutex
+	status seedStatus
+}
+
+func (job *seedJob) snapshot() seedStatus {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.status
+}
+
+type seedTask struct {
+	job  *seedJob
+	tile geo.Tile
+}
+
+// seeder runs seed jobs on a fixed number of workers, shared by every job so
+// seeding can't overwhelm Strava however many jobs are queued.
+type seeder struct {
+	tasks chan seedTask
+	fetch func(ctx context.Context, job *seedJob, t geo.Tile)
+
+	lock   sync.Mutex
+	jobs   []*seedJob
+	nextID int
+}
+
+func newSeeder(workers int, fetch func(ctx context.Context, job *seedJob, t geo.Tile)) *seeder {
+	sd := &seeder{tasks: make(chan seedTask), fetch: fetch}
+	for range workers {
+		go func() {
+			for task := range sd.tasks {
+				if task.job.ctx.Err() == nil {
+					sd.fetch(task.job.ctx, task.job, task.tile)
+				}
+				task.job.wg.Done()
+			}
+		}()
+	}
+	return sd
+}
+
+// newSeederFromEnv creates the seeder for s, with SEED_CONCURRENCY workers.
+func newSeederFromEnv(s *Service) (*seeder, error) {
+	workers := defaultSeedConcurrency
+	if raw := os.Getenv("SEED_CONCURRENCY"); raw != "" {
+		var err error
+		workers, err = strconv.Atoi(raw)
+		if err != nil || workers <= 0 {
+			return nil, errors.New("bad SEED_CONCURRENCY, expected a positive number")
+		}
+	}
+	return newSeeder(workers, s.seedTile), nil
+}
+
+// start adds a job and starts queueing its tiles, or returns ErrConflict if
+// too many jobs are already running.
+func (sd *seeder) start(job *seedJob) (seedStatus, error) {
+	sd.lock.Lock()
+	active := 0
+	for _, other := range sd.jobs {
+		if other.snapshot().Finished == nil {
+			active++
+		}
+	}
+	if active >= maxActiveSeedJobs {
+		sd.lock.Unlock()
+		return seedStatus{}, ErrConflict{err: errors.Errorf("%d seed jobs are already running, wait for one to finish or cancel it", active)}
+	}
+
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	job.status.Status = seedRunning
+	job.status.Total = len(job.tiles)
+	job.status.Started = now()
+	sd.nextID++
+	job.status.ID = strconv.Itoa(sd.nextID)
+	sd.jobs = append(sd.jobs, job)
+	sd.prune()
+	sd.lock.Unlock()
+
+	go sd.run(job)
+	return job.snapshot(), nil
+}
+
+// prune forgets the oldest finished jobs once there are too many.
+func (sd *seeder) prune() {
+	for i := 0; len(sd.jobs) > maxSeedJobs && i < len(sd.jobs); {
+		if sd.jobs[i].snapshot().Finished != nil {
+			sd.jobs = slices.Delete(sd.jobs, i, i+1)
+		} else {
+			i++
+		}
+	}
+}
+
+func (sd *seeder) run(job *seedJob) {
+	defer job.cancel()
+queue:
+	for _, t := range job.tiles {
+		job.wg.Add(1)
+		select {
+		case <-job.ctx.Done():
+			job.wg.Done()
+			break queue
+		case sd.tasks <- seedTask{job: job, tile: t}:
+		}
+	}
+	job.wg.Wait()
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	if job.status.Status == seedRunning {
+		job.status.Status = seedDone
+	}
+	finished := now()
+	job.status.Finished = &finished
+}
+
+func (sd *seeder) job(id string) (*seedJob, bool) {
+	sd.lock.Lock()
+	defer sd.lock.Unlock()
+	for _, job := range sd.jobs {
+		if job.status.ID == id {
+			return job, true
+		}
+	}
+	return nil, false
+}
+
+// seedTile fetches a tile for a job through the tile cache, recording the
+// result.
+func (s *Service) seedTile(ctx context.Context, job *seedJob, t geo.Tile) {
+	p := job.p
+	p.z, p.x, p.y = t.Z, t.X, t.Y
+	tile, res, err := s.loadTile(ctx, job.kind, job.stravaClient, p)
+	if res != nil {
+		res.Body.Close()
+	}
+	if ctx.Err() != nil {
+		// cancelled tiles aren't counted
+		return
+	}
+
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	switch {
+	case errors.Is(err, ErrNotFound):
+		job.status.Empty++
+	case err != nil:
+		job.status.Failed++
+		job.status.Error = errors.Wrapf(err, "tile %d/%d/%d", t.Z, t.X, t.Y).Error()
+	case res == nil && tile.Data != nil:
+		job.status.Fetched++
+	case res != nil && (res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusNoContent):
+		job.status.Empty++
+	default:
+		job.status.Failed++
+		status := "no data"
+		if res != nil {
+			status = res.Status
+		}
+		job.status.Error = errors.Errorf("tile %d/%d/%d: %s", t.Z, t.X, t.Y, status).Error()
+	}
+}
+
+// authenticateAdmin checks the request's token can use the admin API.
+func (s *Service) authenticateAdmin(r *http.Request) (*Token, error) {
+	token, err := s.authenticate(r.URL.Query().Get("api_token"))
+	if err != nil {
+		return nil, err
+	}
+	return token, token.authorizeAdmin()
+}
+
+// parseSeedRegion reads the area to seed from the bbox parameter
+// (min_lon,min_lat,max_lon,max_lat), or the body. With the buffer parameter
+// (meters), the body is a GPX or GeoJSON route and the area is the corridor
+// around it, otherwise it's a GeoJSON polygon.
+func parseSeedRegion(r *http.Request) (geo.Region, error) {
+	q := r.URL.Query()
+	if raw := q.Get("bbox"); raw != "" {
+		if q.Has("buffer") {
+			return nil, ErrBadQuery{query: "buffer", err: errors.New("can't be combined with bbox")}
+		}
+		values, err := parseFloats(raw, "bbox", 4)
+		if err != nil {
+			return nil, err
+		}
+		bbox := geo.BBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+		if !bbox.Valid() {
+			return nil, ErrBadQuery{query: "bbox", err: errors.New("expected min_lon,min_lat,max_lon,max_lat")}
+		}
+		return bbox, nil
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxSeedRegionSize))
+	if err != nil {
+		return nil, ErrBadQuery{query: "bbox", err: errors.Wrap(err, "reading body")}
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, ErrBadQuery{query: "bbox", err: errors.New("expected bbox, or a polygon or route in the body")}
+	}
+
+	if !q.Has("buffer") {
+		region, err := geo.ParseGeoJSON(data)
+		if err != nil {
+			return nil, ErrBadQuery{query: "bbox", err: errors.Wrap(err, "bad GeoJSON body, routes need a buffer")}
+		}
+		return region, nil
+	}
+	buffer, err := strconv.ParseFloat(q.Get("buffer"), 64)
+	if err != nil || buffer <= 0 || buffer > maxSeedBuffer {
+		return nil, ErrBadQuery{query: "buffer", err: errors.Errorf("expected meters, up to %d", maxSeedBuffer)}
+	}
+	var lines []geo.Line
+	if data[0] == '<' {
+		lines, err = geo.ParseGPX(data)
+	} else {
+		lines, err = geo.ParseGeoJSONLines(data)
+	}
+	if err != nil {
+		return nil, ErrBadQuery{query: "buffer", err: errors.Wrap(err, "bad route body")}
+	}
+	return geo.Corridor{Lines: lines, Buffer: buffer}, nil
+}
+
+// parseSeedZooms reads the min_zoom and max_zoom parameters, defaulting to
+// every zoom level the token can access.
+func parseSeedZooms(q url.Values, token *Token) (minZoom, maxZoom uint64, err error) {
+	minZoom, maxZoom = strava.HeatmapMinZoom, token.maxZoom()
+	for _, param := range []struct {
+		name  string
+		value *uint64
+	}{{"min_zoom", &minZoom}, {"max_zoom", &maxZoom}} {
+		if raw := q[param.name]; len(raw) > 0 {
+			*param.value, err = strconv.ParseUint(raw[0], 10, 64)
+			if err != nil || *param.value < minUnderzoom || *param.value > strava.HeatmapMaxZoom {
+				return 0, 0, ErrBadQuery{query: param.name, err: errors.Errorf("expected %d to %d", minUnderzoom, strava.HeatmapMaxZoom)}
+			}
+		}
+	}
+	if minZoom > maxZoom {
+		return 0, 0, ErrBadQuery{query: "min_zoom", err: errors.New("greater than max_zoom")}
+	}
+	return minZoom, maxZoom, nil
+}
+
+// seedTiles lists the tiles in region between minZoom and maxZoom, or errors
+// if there would be too many.
+func seedTiles(region geo.Region, minZoom, maxZoom uint64) ([]geo.Tile, error) {
+	tooMany := ErrBadQuery{query: "max_zoom", err: errors.Errorf("region has more than %d tiles", maxSeedTiles)}
+	var tiles []geo.Tile
+	for z := minZoom; z <= maxZoom; z++ {
+		// corridors are covered segment by segment, other regions by
+		// checking every tile in their bounds
+		if _, ok := region.(geo.Corridor); !ok {
+			minX, minY, maxX, maxY := region.Bounds().TileRange(z)
+			if (maxX-minX+1)*(maxY-minY+1) > maxSeedTiles {
+				return nil, tooMany
+			}
+		}
+		covering, ok := geo.CoveringTilesUpTo(region, z, maxSeedTiles-len(tiles))
+		if !ok {
+			return nil, tooMany
+		}
+		tiles = append(tiles, covering...)
+	}
+	return tiles, nil
+}
+
+// ServeSeed starts a job caching every tile of a layer in a region, e.g.
+// before a trip without reception. The layer is personal (the default) or
+// global, and the region either bbox, a GeoJSON polygon in the body, or the
+// area within buffer meters of a route in the body, between min_zoom and
+// max_zoom. Other layer parameters are the same as for tiles.
+// It responds with the job's status.
+func (s *Service) ServeSeed(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if _, err := s.authenticateAdmin(r); err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	kind := KindPersonal
+	if raw := q.Get("layer"); raw != "" {
+		kind = Kind(raw)
+		if kind != KindPersonal && kind != KindGlobal {
+			return s.writeError(rw, r, ErrBadQuery{query: "layer", err: errors.New("expected personal or global")})
+		}
+	}
+	p, err := s.extractQuery(kind, r, q)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	stravaClient := s.stravaClient
+	if kind == KindPersonal {
+		p.athlete = q.Get("athlete")
+		var ok bool
+		stravaClient, ok = s.athleteClient(p.athlete)
+		if !ok {
+			return s.writeError(rw, r, ErrBadQuery{query: "athlete", err: errors.Errorf("unknown athlete %s", p.athlete)})
+		}
+	}
+
+	minZoom, maxZoom, err := parseSeedZooms(q, p.token)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	p.z = maxZoom
+	if err := p.token.authorize(kind, p); err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	if s.cache == nil {
+		return s.writeError(rw, r, ErrConflict{err: errors.New("tiles aren't cached, set CACHE_DIR to seed them")})
+	}
+	if _, ok := s.sources[kind]; ok {
+		return s.writeError(rw, r, ErrConflict{err: errors.Errorf("%s tiles are served from an archive, not Strava", kind)})
+	}
+
+	region, err := parseSeedRegion(r)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	tiles, err := seedTiles(region, minZoom, maxZoom)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	status, err := s.seeder.start(&seedJob{
+		kind:         kind,
+		stravaClient: stravaClient,
+		p:            p,
+		tiles:        tiles,
+		status: seedStatus{
+			Layer:   kind,
+			Athlete: p.athlete,
+			MinZoom: minZoom,
+			MaxZoom: maxZoom,
+		},
+	})
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	s.logger.Printf("seeding %d %s tiles at zoom %d-%d for token %s", status.Total, kind, minZoom, maxZoom, p.token.Name)
+
+	rw.Header().Set("Location", "/admin/seed/"+status.ID)
+	return writeJSON(rw, http.StatusAccepted, status)
+}
+
+// ServeSeedJobs lists recent seed jobs.
+func (s *Service) ServeSeedJobs(rw http.ResponseWriter, r *http.Request) error {
+	if _, err := s.authenticateAdmin(r); err != nil {
+		return s.writeError(rw, r, err)
+	}
+	s.seeder.lock.Lock()
+	jobs := slices.Clone(s.seeder.jobs)
+	s.seeder.lock.Unlock()
+
+	statuses := make([]seedStatus, len(jobs))
+	for i, job := range jobs {
+		statuses[i] = job.snapshot()
+	}
+	return writeJSON(rw, http.StatusOK, statuses)
+}
+
+// ServeSeedJob reports the progress of the seed job {id}.
+func (s *Service) ServeSeedJob(rw http.ResponseWriter, r *http.Request) error {
+	if _, err := s.authenticateAdmin(r); err != nil {
+		return s.writeError(rw, r, err)
+	}
+	job, ok := s.seeder.job(r.PathValue("id"))
+	if !ok {
+		return s.writeError(rw, r, ErrNotFound)
+	}
+	return writeJSON(rw, http.StatusOK, job.snapshot())
+}
+
+// ServeCancelSeedJob stops the seed job {id}. Tiles already fetched stay
+// cached.
+func (s *Service) ServeCancelSeedJob(rw http.ResponseWriter, r *http.Request) error {
+	token, err := s.authenticateAdmin(r)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	job, ok := s.seeder.job(r.PathValue("id"))
+	if !ok {
+		return s.writeError(rw, r, ErrNotFound)
+	}
+	job.lock.Lock()
+	if job.status.Status == seedRunning {
+		job.status.Status = seedCancelled
+		s.logger.Printf("cancelling seed job %s for token %s", job.status.ID, token.Name)
+	}
+	job.lock.Unlock()
+	job.cancel()
+	return writeJSON(rw, http.StatusOK, job.snapshot())
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) error {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	return json.NewEncoder(rw).Encode(v)
+}
@@ -0,0 +1,325 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func seedJobStatus(t *testing.T, s *Service, id string) seedStatus {
+	req := httptest.NewRequest("GET", "https://example.com/admin/seed/"+id+"?api_token=token", nil)
+	req.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeSeedJob(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	var status seedStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	return status
+}
+
+func TestServeSeed(t *testing.T) {
+	var requestCount atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestCount.Add(1)
+		assert.Contains(t, r.URL.Path, "/globalheat/all/purple/")
+		if strings.Contains(r.URL.Path, "/11/") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write([]byte("tile"))
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := &Service{
+		stravaClient:        &stravaClient,
+		logger:              log.Default(),
+		cache:               cache,
+		apiToken:            "token",
+		globalHeatmapDomain: mockServer.URL,
+	}
+	s.seeder = newSeeder(2, s.seedTile)
+
+	req := httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&color=purple&bbox=-122.4,47.6,-122.3,47.7&min_zoom=10&max_zoom=11", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var status seedStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.Equal(t, "/admin/seed/"+status.ID, w.Header().Get("Location"))
+	assert.Equal(t, KindGlobal, status.Layer)
+	region := geo.BBox{MinLon: -122.4, MinLat: 47.6, MaxLon: -122.3, MaxLat: 47.7}
+	z10, z11 := len(geo.CoveringTiles(region, 10)), len(geo.CoveringTiles(region, 11))
+	assert.Equal(t, z10+z11, status.Total)
+
+	require.Eventually(t, func() bool {
+		return seedJobStatus(t, s, status.ID).Status == seedDone
+	}, 5*time.Second, 10*time.Millisecond)
+	status = seedJobStatus(t, s, status.ID)
+	assert.Equal(t, z10, status.Fetched)
+	assert.Equal(t, z11, status.Empty)
+	assert.Equal(t, 0, status.Failed)
+	assert.NotNil(t, status.Finished)
+
+	// seeded tiles are served from the cache
+	before := requestCount.Load()
+	tile := geo.CoveringTiles(region, 10)[0]
+	req = httptest.NewRequest("GET", fmt.Sprintf("https://example.com/global/tiles/10/%d/%d?api_token=token&color=purple", tile.X, tile.Y), nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, before, requestCount.Load())
+
+	req = httptest.NewRequest("GET", "https://example.com/admin/seed?api_token=token", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeSeedJobs(w, req))
+	var statuses []seedStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&statuses))
+	require.Len(t, statuses, 1)
+	assert.Equal(t, status.ID, statuses[0].ID)
+}
+
+func TestServeSeed_polygon(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := &Service{logger: log.Default(), cache: cache, apiToken: "token"}
+	// no workers, so the job never progresses
+	s.seeder = newSeeder(0, s.seedTile)
+
+	body := `{"type":"Polygon","coordinates":[[[-122.4,47.6],[-122.3,47.6],[-122.3,47.7],[-122.4,47.6]]]}`
+	req := httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&min_zoom=12&max_zoom=12", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+	var status seedStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	bbox := geo.BBox{MinLon: -122.4, MinLat: 47.6, MaxLon: -122.3, MaxLat: 47.7}
+	assert.Greater(t, status.Total, 0)
+	assert.Less(t, status.Total, len(geo.CoveringTiles(bbox, 12)))
+	s.seeder.jobs[0].cancel()
+}
+
+func TestServeSeed_route(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := &Service{logger: log.Default(), cache: cache, apiToken: "token"}
+	s.seeder = newSeeder(0, s.seedTile)
+
+	gpx := `<?xml version="1.0" encoding="UTF-8"?>
+<gpx version="1.1" creator="test" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk><trkseg>
+    <trkpt lat="47.6" lon="-122.4"></trkpt>
+    <trkpt lat="47.7" lon="-122.3"></trkpt>
+    <trkpt lat="47.6" lon="-122.2"></trkpt>
+  </trkseg></trk>
+</gpx>`
+	geoJSON := `{"type": "LineString", "coordinates": [[-122.4, 47.6], [-122.3, 47.7], [-122.2, 47.6]]}`
+	route := geo.Corridor{Lines: []geo.Line{{{Lon: -122.4, Lat: 47.6}, {Lon: -122.3, Lat: 47.7}, {Lon: -122.2, Lat: 47.6}}}, Buffer: 500}
+	for _, body := range []string{gpx, geoJSON} {
+		req := httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&buffer=500&min_zoom=13&max_zoom=14", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeSeed(w, req))
+		require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+
+		var status seedStatus
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+		assert.Equal(t, len(geo.CoveringTiles(route, 13))+len(geo.CoveringTiles(route, 14)), status.Total)
+		// fewer than the route's bounding box
+		assert.Less(t, status.Total, len(geo.CoveringTiles(route.Bounds(), 13))+len(geo.CoveringTiles(route.Bounds(), 14)))
+	}
+	for _, job := range s.seeder.jobs {
+		job.cancel()
+	}
+
+	for _, query := range []string{
+		"buffer=0",
+		"buffer=100000",
+		"buffer=garbage",
+		"buffer=500&bbox=-122.4,47.6,-122.3,47.7",
+	} {
+		req := httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&"+query, strings.NewReader(gpx))
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeSeed(w, req))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	// routes need a buffer
+	req := httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global", strings.NewReader(geoJSON))
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// a route across the world has too many tiles, which is found without
+	// listing them all
+	long := `{"type": "LineString", "coordinates": [[-120, 40], [120, -40]]}`
+	req = httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&buffer=5000&max_zoom=14", strings.NewReader(long))
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "more than")
+
+	// routes with points off the map are rejected before any are walked
+	outside := `<gpx version="1.1"><trk><trkseg><trkpt lat="47.6" lon="-122.4"></trkpt><trkpt lat="47.6" lon="1e12"></trkpt></trkseg></trk></gpx>`
+	req = httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&buffer=500", strings.NewReader(outside))
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "out of range")
+}
+
+func TestServeSeed_400(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := &Service{
+		logger: log.Default(),
+		cache:  cache,
+		tokens: []Token{
+			{Name: "admin", Token: "admin", Endpoints: []Kind{KindAdmin, KindGlobal}},
+			{Name: "tiles", Token: "tiles", Endpoints: []Kind{KindGlobal}},
+		},
+	}
+	s.seeder = newSeeder(0, s.seedTile)
+
+	// tokens must be allowed to use the admin API and the layer
+	for _, query := range []string{
+		"api_token=tiles&layer=global&bbox=-122.4,47.6,-122.3,47.7",
+		"api_token=admin&layer=personal&bbox=-122.4,47.6,-122.3,47.7",
+	} {
+		req := httptest.NewRequest("POST", "https://example.com/admin/seed?"+query, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeSeed(w, req))
+		assert.Equal(t, http.StatusForbidden, w.Code, query)
+	}
+
+	for _, query := range []string{
+		"api_token=admin&layer=team&bbox=-122.4,47.6,-122.3,47.7",
+		"api_token=admin&layer=global",
+		"api_token=admin&layer=global&bbox=-122.3,47.6,-122.4,47.7",
+		"api_token=admin&layer=global&bbox=-122.4,47.6,-122.3,47.7&min_zoom=12&max_zoom=10",
+		"api_token=admin&layer=global&bbox=-122.4,47.6,-122.3,47.7&max_zoom=15",
+		// tiles below minUnderzoom can't be served
+		"api_token=admin&layer=global&bbox=-122.4,47.6,-122.3,47.7&min_zoom=2",
+		"api_token=admin&layer=global&bbox=-122.4,47.6,-122.3,47.7&min_zoom=0&max_zoom=0",
+		"api_token=admin&layer=global&bbox=-180,-85,180,85&max_zoom=14",
+	} {
+		req := httptest.NewRequest("POST", "https://example.com/admin/seed?"+query, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeSeed(w, req))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+	assert.Empty(t, s.seeder.jobs)
+
+	// the admin API is never anonymous
+	s.tokens = nil
+	req := httptest.NewRequest("POST", "https://example.com/admin/seed?layer=global&bbox=-122.4,47.6,-122.3,47.7", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	// seeding without a cache does nothing
+	s.apiToken = "token"
+	s.cache = nil
+	req = httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&bbox=-122.4,47.6,-122.3,47.7", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestServeCancelSeedJob(t *testing.T) {
+	release := make(chan struct{})
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		rw.Write([]byte("tile"))
+	}))
+	defer mockServer.Close()
+	defer close(release)
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := &Service{
+		stravaClient:        &stravaClient,
+		logger:              log.Default(),
+		cache:               cache,
+		apiToken:            "token",
+		globalHeatmapDomain: mockServer.URL,
+	}
+	s.seeder = newSeeder(1, s.seedTile)
+
+	req := httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&bbox=-122.4,47.6,-122.3,47.7&min_zoom=10&max_zoom=12", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeSeed(w, req))
+	require.Equal(t, http.StatusAccepted, w.Code)
+	var status seedStatus
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+
+	req = httptest.NewRequest("DELETE", "https://example.com/admin/seed/"+status.ID+"?api_token=token", nil)
+	req.SetPathValue("id", status.ID)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeCancelSeedJob(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	require.Eventually(t, func() bool {
+		return seedJobStatus(t, s, status.ID).Finished != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	status = seedJobStatus(t, s, status.ID)
+	assert.Equal(t, seedCancelled, status.Status)
+	assert.Less(t, status.Fetched+status.Empty+status.Failed, status.Total)
+
+	req = httptest.NewRequest("DELETE", "https://example.com/admin/seed/404?api_token=token", nil)
+	req.SetPathValue("id", "404")
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeCancelSeedJob(w, req))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestServeSeed_tooManyJobs(t *testing.T) {
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := &Service{logger: log.Default(), cache: cache, apiToken: "token"}
+	// without workers, jobs stay running until they're cancelled
+	s.seeder = newSeeder(0, s.seedTile)
+	defer func() {
+		for _, job := range s.seeder.jobs {
+			job.cancel()
+		}
+	}()
+
+	seed := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "https://example.com/admin/seed?api_token=token&layer=global&bbox=-122.4,47.6,-122.3,47.7&min_zoom=10&max_zoom=10", nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeSeed(w, req))
+		return w
+	}
+	for range maxActiveSeedJobs {
+		require.Equal(t, http.StatusAccepted, seed().Code)
+	}
+	w := seed()
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Len(t, s.seeder.jobs, maxActiveSeedJobs)
+
+	// finished jobs don't count
+	s.seeder.jobs[0].cancel()
+	require.Eventually(t, func() bool {
+		return s.seeder.jobs[0].snapshot().Finished != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusAccepted, seed().Code)
+}
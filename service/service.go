@@ -1,7 +1,7 @@
 package service
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"log"
 	"net/http"
@@ -10,6 +10,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/apexskier/strava-tile-proxy/strava"
 	"github.com/pkg/errors"
@@ -17,13 +18,33 @@ import (
 
 var logger = log.New(os.Stdout, "service", log.LstdFlags)
 
-var tileXYZRe = regexp.MustCompile(`/(?P<z>\d+)/(?P<x>\d+)/(?P<y>\d+)$`)
+var tileXYZRe = regexp.MustCompile(`/(?P<z>\d+)/(?P<x>\d+)/(?P<y>\d+)(?:@(?P<scale>[12])x)?$`)
+
+var lastRe = regexp.MustCompile(`^(\d+)([dwmy])$`)
+
+// dateFormat is the format Strava expects for filter_start and filter_end.
+const dateFormat = "2006-01-02"
+
+var now = time.Now
 
 type Service struct {
 	stravaClient strava.Client
-	logger       *log.Logger
+	// athletes are additional Strava accounts whose personal heatmaps are
+	// served at /personal/{athlete}/...
+	athletes map[string]strava.Client
+	logger   *log.Logger
+	cache    TileCache
+	// sources replace Strava as where tiles of a kind come from
+	sources map[Kind]TileSource
+	seeder  *seeder
+	// flights coalesces identical requests to Strava
+	flights tileFlights
+	// cacheControls overrides the Cache-Control header sent with each kind of
+	// tile
+	cacheControls map[Kind]string
 
 	apiToken string
+	tokens   []Token
 
 	personalHeatmapDomain string
 	globalHeatmapDomain   string
@@ -32,21 +53,52 @@ type Service struct {
 	revealOnlyMeActivities       bool
 	revealFollowerOnlyActivities bool
 	revealPublicActivities       bool
+
+	includeCommutes bool
+
+	// stopWatching ends the goroutines watching session files
+	stopWatching context.CancelFunc
 }
 
-func New() (*Service, error) {
-	rememberToken := os.Getenv("STRAVA_REMEMBER_TOKEN")
-	if rememberToken == "" {
-		return nil, errors.New("missing STRAVA_REMEMBER_TOKEN")
+// New creates a Service configured from environment variables. If
+// sessionPath is set, Strava credentials are read from that file instead of
+// the environment, and reloaded whenever it changes.
+func New(sessionPath string) (*Service, error) {
+	session := strava.Session{
+		RememberToken: os.Getenv(strava.EnvRememberToken),
+		Session:       os.Getenv(strava.EnvSession),
 	}
-	stravaSession := os.Getenv("STRAVA4_SESSION")
-	if stravaSession == "" {
-		return nil, errors.New("missing STRAVA4_SESSION")
+	if sessionPath != "" {
+		var err error
+		session, err = strava.ReadSessionFile(sessionPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad session file")
+		}
 	}
-	stravaClient, err := strava.NewClient(rememberToken, stravaSession)
+	if session.RememberToken == "" {
+		return nil, errors.New("missing " + strava.EnvRememberToken)
+	}
+	if session.Session == "" {
+		return nil, errors.New("missing " + strava.EnvSession)
+	}
+	var clientOpts []strava.Option
+	if raw := os.Getenv("CLOUDFRONT_REFRESH_MARGIN"); raw != "" {
+		margin, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad CLOUDFRONT_REFRESH_MARGIN")
+		}
+		clientOpts = append(clientOpts, strava.WithRefreshMargin(margin))
+	}
+	limitOpts, err := hostLimitersFromEnv()
 	if err != nil {
 		return nil, err
 	}
+	clientOpts = append(clientOpts, limitOpts...)
+
+	athleteSessions, err := parseAthleteSessions(os.Getenv("ATHLETE_SESSIONS"))
+	if err != nil {
+		return nil, errors.Wrap(err, "bad ATHLETE_SESSIONS")
+	}
 
 	revealPrivacyZones, err := strconv.ParseBool(os.Getenv("REVEAL_PRIVACY_ZONES"))
 	if err != nil {
@@ -65,42 +117,127 @@ func New() (*Service, error) {
 		return nil, errors.Wrap(err, "bad REVEAL_PUBLIC_ACTIVITIES")
 	}
 
+	includeCommutes := true
+	if raw := os.Getenv("INCLUDE_COMMUTES"); raw != "" {
+		includeCommutes, err = strconv.ParseBool(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad INCLUDE_COMMUTES")
+		}
+	}
+
 	apiToken := os.Getenv("API_TOKEN")
 
-	return &Service{
+	var tokens []Token
+	if tokensFile := os.Getenv("API_TOKENS_FILE"); tokensFile != "" {
+		tokens, err = loadTokens(tokensFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad API_TOKENS_FILE")
+		}
+	}
+
+	cache, err := newTileCacheFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := newTileSourcesFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	cacheControls := cacheControlsFromEnv()
+
+	// clients refresh cookies in the background, so they're created once
+	// nothing else can fail
+	stravaClient, err := strava.NewClient(session.RememberToken, session.Session, clientOpts...)
+	if err != nil {
+		return nil, err
+	}
+	athletes, err := newAthleteClients(athleteSessions, clientOpts...)
+	if err != nil {
+		stravaClient.Close()
+		return nil, errors.Wrap(err, "bad ATHLETE_SESSIONS")
+	}
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	s := &Service{
 		stravaClient:                 stravaClient,
+		athletes:                     athletes,
 		logger:                       logger,
+		cache:                        cache,
+		sources:                      sources,
+		cacheControls:                cacheControls,
 		apiToken:                     apiToken,
+		tokens:                       tokens,
 		personalHeatmapDomain:        strava.PersonalHeatmapDomain,
 		globalHeatmapDomain:          strava.GlobalHeatmapDomain,
 		revealPrivacyZones:           revealPrivacyZones,
 		revealOnlyMeActivities:       revealOnlyMeActivities,
 		revealFollowerOnlyActivities: revealFollowerOnlyActivities,
 		revealPublicActivities:       revealPublicActivities,
-	}, nil
-}
-
-var ErrNotFound = errors.New("not found")
-
-type ErrBadCoord struct {
-	coord string
-}
+		includeCommutes:              includeCommutes,
+		stopWatching:                 stopWatching,
+	}
+	s.seeder, err = newSeederFromEnv(s)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
 
-func (err ErrBadCoord) Error() string {
-	return fmt.Sprintf("invalid tile %s", err.coord)
-}
+	if sessionPath != "" {
+		go s.watchSessionFile(watchCtx, sessionPath, stravaClient, sessionWatchInterval)
+	}
+	for name, path := range athleteSessions {
+		go s.watchSessionFile(watchCtx, path, athletes[name], sessionWatchInterval)
+	}
 
-type ErrBadQuery struct {
-	err   error
-	query string
+	return s, nil
 }
 
-func (err ErrBadQuery) Unwrap() error {
-	return err.err
+// Close stops watching session files and refreshing Strava cookies in the
+// background.
+func (s *Service) Close() error {
+	if s.stopWatching != nil {
+		s.stopWatching()
+	}
+	if s.stravaClient != nil {
+		s.stravaClient.Close()
+	}
+	closeClients(s.athletes)
+	return nil
 }
 
-func (err ErrBadQuery) Error() string {
-	return fmt.Sprintf("invalid query parameter %s: %v", err.query, err.err)
+// defaultRateLimit is the limit on requests to each Strava tile host, as
+// "rate,burst,max_in_flight".
+const defaultRateLimit = "10,20,6"
+
+// hostLimitersFromEnv builds the options throttling requests to Strava's tile
+// hosts, configured by RATE_LIMIT_PERSONAL and RATE_LIMIT_GLOBAL. The same
+// limiters are shared by every athlete's client.
+func hostLimitersFromEnv() ([]strava.Option, error) {
+	var opts []strava.Option
+	for _, host := range []struct {
+		env    string
+		domain string
+	}{
+		{"RATE_LIMIT_PERSONAL", strava.PersonalHeatmapDomain},
+		{"RATE_LIMIT_GLOBAL", strava.GlobalHeatmapDomain},
+	} {
+		raw := os.Getenv(host.env)
+		if raw == "" {
+			raw = defaultRateLimit
+		}
+		limit, err := strava.ParseLimit(raw)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad "+host.env)
+		}
+		u, err := url.Parse(host.domain)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, strava.WithHostLimiter(u.Hostname(), strava.NewLimiter(limit)))
+	}
+	return opts, nil
 }
 
 type Params struct {
@@ -109,20 +246,114 @@ type Params struct {
 	z         uint64
 	sports    string
 	heatColor strava.Heat
+
+	// filterStart and filterEnd are formatted with dateFormat, and empty if
+	// unbounded
+	filterStart string
+	filterEnd   string
+
+	includeCommutes bool
+
+	privacy Privacy
+
+	// athlete is the name of the account for personal tiles, or empty for the
+	// default account
+	athlete string
+
+	// tileSize is the width and height of tiles served, which are resized
+	// from Strava's if different
+	tileSize int
+
+	token *Token
+}
+
+// layerQueryParams are the query parameters that describe a layer, as opposed
+// to a single tile, and are carried through to tile URLs in metadata.
+var layerQueryParams = []string{
+	"api_token",
+	"color",
+	"sports",
+	"start",
+	"end",
+	"last",
+	"year",
+	"commutes",
+	"reveal_privacy_zones",
+	"reveal_only_me_activities",
+	"reveal_follower_only_activities",
+	"reveal_public_activities",
+	"athletes",
+	"blend",
+	"tint",
+	"tile_size",
+	"athlete",
+}
+
+// defaultHeatColors are the colors used when a request doesn't specify one.
+var defaultHeatColors = map[Kind]strava.Heat{
+	KindPersonal: strava.HeatOrange,
+	KindGlobal:   strava.HeatBlue,
+	KindTeam:     strava.HeatOrange,
 }
 
-func (s *Service) extractParams(u *url.URL) (p Params, err error) {
-	q := u.Query()
+func (s *Service) extractParams(kind Kind, r *http.Request) (p Params, err error) {
+	p, err = s.extractQuery(kind, r, r.URL.Query())
+	if err != nil {
+		return p, err
+	}
+
+	tileRouteMatches := tileXYZRe.FindStringSubmatch(r.URL.Path)
+	if len(tileRouteMatches) == 0 {
+		return p, ErrNotFound
+	}
+	p.z, err = strconv.ParseUint(tileRouteMatches[1], 10, 64)
+	if err != nil {
+		return p, ErrBadCoord{coord: "z"}
+	}
+	p.x, err = strconv.ParseUint(tileRouteMatches[2], 10, 64)
+	if err != nil {
+		return p, ErrBadCoord{coord: "x"}
+	}
+	p.y, err = strconv.ParseUint(tileRouteMatches[3], 10, 64)
+	if err != nil {
+		return p, ErrBadCoord{coord: "y"}
+	}
+	if coord := checkTile(p.z, p.x, p.y); coord != "" {
+		return p, ErrBadCoord{coord: coord}
+	}
+	if scale := tileRouteMatches[4]; scale != "" {
+		size := tileSizeFromScale(scale)
+		if r.URL.Query().Has("tile_size") && size != p.tileSize {
+			return p, ErrBadQuery{query: "tile_size", err: errors.Errorf("doesn't match @%sx", scale)}
+		}
+		p.tileSize = size
+	}
+
+	if err := p.token.authorize(kind, p); err != nil {
+		return p, err
+	}
+
+	return
+}
 
+// extractQuery reads the parameters that apply to every tile in a layer,
+// without checking they're authorized.
+func (s *Service) extractQuery(kind Kind, r *http.Request, q url.Values) (p Params, err error) {
 	var providedToken string
 	providedTokens := q["api_token"]
 	if len(providedTokens) > 0 {
 		providedToken = providedTokens[0]
 	}
-	if providedToken != s.apiToken {
-		return p, ErrBadQuery{query: "api_token", err: errors.New("incorrect api token")}
+	p.token, err = s.authenticate(providedToken)
+	if err != nil {
+		return p, err
 	}
 
+	if kind == KindPersonal {
+		p.athlete = r.PathValue("athlete")
+	}
+
+	p.heatColor = defaultHeatColors[kind]
 	if heats, ok := q["color"]; ok && len(heats) > 0 {
 		p.heatColor, err = strava.ParseHeat(heats[0])
 		if err != nil {
@@ -135,152 +366,360 @@ func (s *Service) extractParams(u *url.URL) (p Params, err error) {
 		p.sports = strings.Join(sports, ",")
 	}
 
-	tileRouteMatches := tileXYZRe.FindStringSubmatch(u.Path)
-	if len(tileRouteMatches) == 0 {
-		return p, ErrNotFound
-	}
-	p.z, err = strconv.ParseUint(tileRouteMatches[1], 10, 64)
+	p.filterStart, p.filterEnd, err = parseDateRange(q)
 	if err != nil {
-		return p, ErrBadCoord{coord: "z"}
+		return p, err
 	}
-	p.x, err = strconv.ParseUint(tileRouteMatches[2], 10, 64)
+
+	p.tileSize, err = parseTileSize(q)
 	if err != nil {
-		return p, ErrBadCoord{coord: "x"}
+		return p, err
 	}
-	p.y, err = strconv.ParseUint(tileRouteMatches[3], 10, 64)
+
+	p.includeCommutes = s.includeCommutes
+	if raw := q.Get("commutes"); raw != "" {
+		p.includeCommutes, err = strconv.ParseBool(raw)
+		if err != nil {
+			return p, ErrBadQuery{query: "commutes", err: errors.New("expected true or false")}
+		}
+	}
+
+	p.privacy, err = parsePrivacy(q, p.token.privacyCeiling(Privacy{
+		RevealPrivacyZones:           s.revealPrivacyZones,
+		RevealOnlyMeActivities:       s.revealOnlyMeActivities,
+		RevealFollowerOnlyActivities: s.revealFollowerOnlyActivities,
+		RevealPublicActivities:       s.revealPublicActivities,
+	}))
 	if err != nil {
-		return p, ErrBadCoord{coord: "y"}
+		return p, err
 	}
 
 	return
 }
 
+// parseDateRange reads the activity date range from the start and end
+// parameters, or one of the relative last (e.g. "90d", "6m") or year (e.g.
+// "2025") shorthands.
+func parseDateRange(q url.Values) (start, end string, err error) {
+	var startTime, endTime time.Time
+	if raw := q.Get("start"); raw != "" {
+		startTime, err = time.Parse(dateFormat, raw)
+		if err != nil {
+			return "", "", ErrBadQuery{query: "start", err: errors.New("expected YYYY-MM-DD")}
+		}
+	}
+	if raw := q.Get("end"); raw != "" {
+		endTime, err = time.Parse(dateFormat, raw)
+		if err != nil {
+			return "", "", ErrBadQuery{query: "end", err: errors.New("expected YYYY-MM-DD")}
+		}
+	}
+
+	if raw := q.Get("last"); raw != "" {
+		if !startTime.IsZero() || !endTime.IsZero() {
+			return "", "", ErrBadQuery{query: "last", err: errors.New("can't be combined with start or end")}
+		}
+		matches := lastRe.FindStringSubmatch(raw)
+		if len(matches) == 0 {
+			return "", "", ErrBadQuery{query: "last", err: errors.New("expected a number followed by d, w, m or y")}
+		}
+		n, err := strconv.Atoi(matches[1])
+		if err != nil {
+			return "", "", ErrBadQuery{query: "last", err: err}
+		}
+		today := now()
+		switch matches[2] {
+		case "d":
+			startTime = today.AddDate(0, 0, -n)
+		case "w":
+			startTime = today.AddDate(0, 0, -7*n)
+		case "m":
+			startTime = today.AddDate(0, -n, 0)
+		case "y":
+			startTime = today.AddDate(-n, 0, 0)
+		}
+	}
+
+	if raw := q.Get("year"); raw != "" {
+		if !startTime.IsZero() || !endTime.IsZero() {
+			return "", "", ErrBadQuery{query: "year", err: errors.New("can't be combined with start, end or last")}
+		}
+		year, err := strconv.Atoi(raw)
+		if err != nil || year < 1 || year > 9999 {
+			return "", "", ErrBadQuery{query: "year", err: errors.New("expected a four digit year")}
+		}
+		startTime = time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		endTime = time.Date(year, time.December, 31, 0, 0, 0, 0, time.UTC)
+	}
+
+	if !startTime.IsZero() && !endTime.IsZero() && endTime.Before(startTime) {
+		return "", "", ErrBadQuery{query: "end", err: errors.New("before start")}
+	}
+	if !startTime.IsZero() {
+		start = startTime.Format(dateFormat)
+	}
+	if !endTime.IsZero() {
+		end = endTime.Format(dateFormat)
+	}
+	return start, end, nil
+}
+
 func (s *Service) ServeGlobalTile(rw http.ResponseWriter, r *http.Request) error {
-	p, err := s.extractParams(r.URL)
+	p, err := s.extractParams(KindGlobal, r)
 	if err != nil {
-		var badCoordErr ErrBadCoord
-		var badQueryErr ErrBadQuery
-		if errors.As(err, &badCoordErr) {
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte(err.Error()))
-			return nil
-		} else if errors.As(err, &badQueryErr) {
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte(err.Error()))
-			return nil
-		} else if errors.Is(err, ErrNotFound) {
-			rw.WriteHeader(http.StatusNotFound)
-			return nil
-		}
-		return err
+		return s.writeError(rw, r, err)
+	}
+
+	s.logger.Printf("global tile %d/%d/%d for token %s", p.z, p.x, p.y, p.token.Name)
+
+	return s.serveTile(rw, r, KindGlobal, s.stravaClient, p)
+}
+
+func (s *Service) ServePersonalTile(rw http.ResponseWriter, r *http.Request) error {
+	p, err := s.extractParams(KindPersonal, r)
+	if err != nil {
+		return s.writeError(rw, r, err)
 	}
 
-	if p.heatColor == "" {
-		p.heatColor = strava.HeatBlue
+	s.logger.Printf("personal tile %d/%d/%d for token %s", p.z, p.x, p.y, p.token.Name)
+
+	stravaClient, ok := s.athleteClient(p.athlete)
+	if !ok {
+		return s.writeError(rw, r, ErrNotFound)
 	}
+	return s.serveTile(rw, r, KindPersonal, stravaClient, p)
+}
 
-	tileQueryParams := url.Values{
-		"v": []string{"19"},
+// athleteClient returns the Strava client for a named athlete, or the default
+// client if name is empty.
+func (s *Service) athleteClient(name string) (strava.Client, bool) {
+	if name == "" {
+		return s.stravaClient, true
 	}
-	url := fmt.Sprintf(
-		s.globalHeatmapDomain+strava.GlobalHeatmapPath,
-		p.sports,
-		p.heatColor,
-		p.z,
-		p.x,
-		p.y,
-		tileQueryParams.Encode(),
-	)
-	tileResponse, err := s.stravaClient.HttpClient().Get(url)
+	client, ok := s.athletes[name]
+	return client, ok
+}
+
+// serveTile writes the tile for p, or forwards Strava's response if it didn't
+// return one.
+func (s *Service) serveTile(rw http.ResponseWriter, r *http.Request, kind Kind, stravaClient strava.Client, p Params) error {
+	tile, res, err := s.loadTile(r.Context(), kind, stravaClient, p)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	if res != nil {
+		defer res.Body.Close()
+		return forwardResponse(res, rw)
+	}
+	tile, err = resizeTile(tile, p.tileSize)
 	if err != nil {
 		return err
 	}
-	if tileResponse.StatusCode == http.StatusForbidden || tileResponse.StatusCode == http.StatusUnauthorized {
-		// refresh CloudFront cookies and retry once
-		s.logger.Println("refreshing CloudFront cookies")
-		if err := s.stravaClient.RefreshCloudFrontCookies(); err != nil {
-			return err
-		}
-		tileResponse, err = s.stravaClient.HttpClient().Get(url)
-		if err != nil {
-			return err
+	return s.writeTile(rw, r, kind, tile)
+}
+
+// tileRequest returns the cache key and Strava URL for a tile.
+func (s *Service) tileRequest(kind Kind, stravaClient strava.Client, p Params) (TileKey, string, error) {
+	if kind == KindGlobal {
+		url := strava.GlobalHeatmapURL(s.globalHeatmapDomain, p.sports, p.heatColor, p.z, p.x, p.y)
+		key := TileKey{
+			Kind:      KindGlobal,
+			Sports:    p.sports,
+			HeatColor: p.heatColor,
+			Z:         p.z,
+			X:         p.x,
+			Y:         p.y,
 		}
+		return key, url, nil
+	}
+
+	athleteID, err := stravaClient.AthleteID()
+	if err != nil {
+		return TileKey{}, "", err
 	}
-	return forwardResponse(tileResponse, rw)
+	url := strava.PersonalHeatmapURL(s.personalHeatmapDomain, athleteID, p.heatColor, p.z, p.x, p.y, strava.HeatmapFilter{
+		Sports:                       p.sports,
+		Start:                        p.filterStart,
+		End:                          p.filterEnd,
+		IncludeCommutes:              p.includeCommutes,
+		RevealPrivacyZones:           p.privacy.RevealPrivacyZones,
+		RevealOnlyMeActivities:       p.privacy.RevealOnlyMeActivities,
+		RevealFollowerOnlyActivities: p.privacy.RevealFollowerOnlyActivities,
+		RevealPublicActivities:       p.privacy.RevealPublicActivities,
+	})
+	key := TileKey{
+		Kind:                         KindPersonal,
+		AthleteID:                    athleteID,
+		Sports:                       p.sports,
+		HeatColor:                    p.heatColor,
+		Z:                            p.z,
+		X:                            p.x,
+		Y:                            p.y,
+		FilterStart:                  p.filterStart,
+		FilterEnd:                    p.filterEnd,
+		IncludeCommutes:              p.includeCommutes,
+		RevealPrivacyZones:           p.privacy.RevealPrivacyZones,
+		RevealOnlyMeActivities:       p.privacy.RevealOnlyMeActivities,
+		RevealFollowerOnlyActivities: p.privacy.RevealFollowerOnlyActivities,
+		RevealPublicActivities:       p.privacy.RevealPublicActivities,
+	}
+	return key, url, nil
 }
 
-func (s *Service) ServePersonalTile(rw http.ResponseWriter, r *http.Request) error {
-	p, err := s.extractParams(r.URL)
+// refreshStatuses are the Strava response codes, per kind of tile, that mean
+// CloudFront cookies need to be refreshed.
+var refreshStatuses = map[Kind][]int{
+	KindGlobal:   {http.StatusForbidden, http.StatusUnauthorized},
+	KindPersonal: {http.StatusUnauthorized},
+}
+
+// loadTile returns a tile from the source for kind. Outside the zoom levels
+// Strava serves, tiles are upscaled from an ancestor or downsampled from
+// descendants instead. If the source responds with something other than a
+// tile, that response is returned instead and must be closed by the caller.
+func (s *Service) loadTile(ctx context.Context, kind Kind, stravaClient strava.Client, p Params) (Tile, *http.Response, error) {
+	if p.z > strava.HeatmapMaxZoom {
+		return s.loadOverzoomTile(ctx, kind, stravaClient, p)
+	}
+	if p.z < strava.HeatmapMinZoom {
+		return s.loadUnderzoomTile(ctx, kind, stravaClient, p)
+	}
+	return s.source(kind).LoadTile(ctx, stravaClient, p)
+}
+
+func (src stravaSource) CacheKey(stravaClient strava.Client, p Params) (TileKey, error) {
+	key, _, err := src.s.tileRequest(src.kind, stravaClient, p)
+	return key, err
+}
+
+// LoadTile fetches a tile from Strava, or from the cache if possible. Stale
+// cached tiles are revalidated with Strava, and served as they are if that
+// fails. Strava throttling or failing is returned as an error. Concurrent
+// requests for the same tile share one fetch.
+func (src stravaSource) LoadTile(ctx context.Context, stravaClient strava.Client, p Params) (Tile, *http.Response, error) {
+	s, kind := src.s, src.kind
+	key, url, err := s.tileRequest(kind, stravaClient, p)
 	if err != nil {
-		var badCoordErr ErrBadCoord
-		var badQueryErr ErrBadQuery
-		if errors.As(err, &badCoordErr) {
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte(err.Error()))
-			return nil
-		} else if errors.As(err, &badQueryErr) {
-			rw.WriteHeader(http.StatusBadRequest)
-			rw.Write([]byte(err.Error()))
-			return nil
-		} else if errors.Is(err, ErrNotFound) {
-			rw.WriteHeader(http.StatusNotFound)
-			return nil
+		return Tile{}, nil, err
+	}
+
+	var cached *CachedTile
+	if s.cache != nil {
+		tile, ok, err := s.cache.Get(key)
+		if err != nil {
+			s.logger.Printf("reading cached tile %s: %v", key, err)
+		} else if ok && !tile.Stale {
+			return Tile{Data: tile.Data, Modified: tile.Modified}, nil, nil
+		} else if ok {
+			cached = &tile
 		}
-		return err
 	}
 
-	if p.heatColor == "" {
-		p.heatColor = strava.HeatOrange
+	result, err := s.flights.do(ctx, url, func(ctx context.Context) tileResult {
+		return s.fetchTileResult(ctx, stravaClient, key, url, cached, refreshStatuses[kind]...)
+	})
+	if err != nil {
+		return Tile{}, nil, err
+	}
+	err = result.err
+	if err == nil {
+		err = upstreamStatusError(result.status, result.header)
 	}
+	if err != nil {
+		if cached != nil {
+			s.logger.Printf("revalidating cached tile %s: %v", key, err)
+			return Tile{Data: cached.Data, Modified: cached.Modified}, nil, nil
+		}
+		return Tile{}, nil, err
+	}
+	if result.status != http.StatusOK {
+		return Tile{}, result.response(), nil
+	}
+	return Tile{Data: result.data, Modified: result.modified}, nil, nil
+}
 
-	tileQueryParams := url.Values{
-		strava.ParamFilterType:           []string{string(p.sports)},
-		strava.ParamRespectPrivacyZones:  []string{strconv.FormatBool(!s.revealPrivacyZones)},
-		strava.ParamIncludeEveryone:      []string{strconv.FormatBool(s.revealPublicActivities)},
-		strava.ParamIncludeFollowersOnly: []string{strconv.FormatBool(s.revealFollowerOnlyActivities)},
-		strava.ParamIncludeOnlyMe:        []string{strconv.FormatBool(s.revealOnlyMeActivities)},
+// fetchTileResult fetches a tile from Strava and caches it, reading the whole
+// response so it can be shared between requests. If cached is set, it's
+// revalidated with a conditional request and reused if Strava says it hasn't
+// changed.
+func (s *Service) fetchTileResult(ctx context.Context, stravaClient strava.Client, key TileKey, url string, cached *CachedTile, refreshStatuses ...int) tileResult {
+	var modifiedSince time.Time
+	if cached != nil {
+		modifiedSince = cached.Modified
 	}
-	athleteID, err := s.stravaClient.AthleteID()
+	tileResponse, err := s.fetchTile(ctx, stravaClient, url, modifiedSince, refreshStatuses...)
 	if err != nil {
-		return err
+		return tileResult{err: err}
 	}
-	url := fmt.Sprintf(
-		s.personalHeatmapDomain+strava.PersonalHeatmapPath,
-		athleteID,
-		p.heatColor,
-		p.z,
-		p.x,
-		p.y,
-		tileQueryParams.Encode(),
-	)
-	tileResponse, err := s.stravaClient.HttpClient().Get(url)
+	defer tileResponse.Body.Close()
+	data, err := io.ReadAll(tileResponse.Body)
 	if err != nil {
-		return err
+		return tileResult{err: err}
 	}
-	if tileResponse.StatusCode == http.StatusUnauthorized {
-		// refresh CloudFront cookies and retry once
-		s.logger.Println("refreshing CloudFront cookies")
-		if err := s.stravaClient.RefreshCloudFrontCookies(); err != nil {
-			return err
+	modified := now()
+	if tileResponse.StatusCode == http.StatusNotModified && cached != nil {
+		data = cached.Data
+		modified = cached.Modified
+	} else if tileResponse.StatusCode != http.StatusOK {
+		return tileResult{status: tileResponse.StatusCode, header: tileResponse.Header, body: data}
+	}
+	if s.cache != nil {
+		if err := s.cache.Put(key, data, modified); err != nil {
+			s.logger.Printf("caching tile %s: %v", key, err)
 		}
-		tileResponse, err = s.stravaClient.HttpClient().Get(url)
+	}
+	return tileResult{status: http.StatusOK, data: data, modified: modified}
+}
+
+// fetchTile requests a tile from Strava, conditionally if modifiedSince is
+// set. If Strava responds with one of refreshStatuses, CloudFront cookies are
+// refreshed and the request retried once.
+func (s *Service) fetchTile(ctx context.Context, stravaClient strava.Client, url string, modifiedSince time.Time, refreshStatuses ...int) (*http.Response, error) {
+	get := func() (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		if !modifiedSince.IsZero() {
+			req.Header.Set("If-Modified-Since", modifiedSince.UTC().Format(http.TimeFormat))
+		}
+		return stravaClient.HttpClient().Do(req)
 	}
-	return forwardResponse(tileResponse, rw)
-}
 
-func forwardResponse(res *http.Response, rw http.ResponseWriter) error {
-	rw.WriteHeader(res.StatusCode)
-	_, err := io.Copy(rw, res.Body)
+	tileResponse, err := get()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	for _, status := range refreshStatuses {
+		if tileResponse.StatusCode != status {
+			continue
+		}
+		tileResponse.Body.Close()
+		// refresh CloudFront cookies and retry once
+		s.logger.Println("refreshing CloudFront cookies")
+		if err := stravaClient.RefreshCloudFrontCookies(); err != nil {
+			if errors.Is(err, strava.ErrSessionExpired) {
+				s.logger.Println("strava session expired, run cmd/auth to log in again")
+			}
+			return nil, err
+		}
+		return get()
+	}
+	return tileResponse, nil
+}
+
+// forwardResponse copies Strava's response to the client. Cookies are left
+// out, since they're the proxy's CloudFront credentials.
+func forwardResponse(res *http.Response, rw http.ResponseWriter) error {
 	for key, values := range res.Header {
+		if http.CanonicalHeaderKey(key) == "Set-Cookie" {
+			continue
+		}
 		for _, val := range values {
 			rw.Header().Add(key, val)
 		}
 	}
-	return nil
+	rw.WriteHeader(res.StatusCode)
+	_, err := io.Copy(rw, res.Body)
+	return err
 }
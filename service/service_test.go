@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/apexskier/strava-tile-proxy/strava"
 	"github.com/stretchr/testify/assert"
@@ -32,6 +33,16 @@ func (m *mockStravaClient) AthleteID() (string, error) {
 	return args.String(0), args.Error(1)
 }
 
+func (m *mockStravaClient) AuthState() strava.AuthState {
+	args := m.Called()
+	return args.Get(0).(strava.AuthState)
+}
+
+func (m *mockStravaClient) SetSession(session strava.Session) error {
+	args := m.Called(session)
+	return args.Error(0)
+}
+
 func TestTileService_BadApiToken(t *testing.T) {
 	stravaClient := mockStravaClient{}
 	defer stravaClient.AssertExpectations(t)
@@ -42,19 +53,19 @@ func TestTileService_BadApiToken(t *testing.T) {
 		apiToken:     "token",
 	}
 
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3?api_token=garbage", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?api_token=garbage", nil)
 	w := httptest.NewRecorder()
 
 	err := s.ServeGlobalTile(w, req)
 
 	require.NoError(t, err)
-	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
 }
 
 func TestTileService_GlobalOK(t *testing.T) {
 	requestCount := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/server-a/identified/globalheat/all/blue/1/2/3@2x.png", r.URL.Path)
+		assert.Equal(t, "/server-a/identified/globalheat/all/blue/6/2/3@2x.png", r.URL.Path)
 		q := r.URL.Query()
 		assert.Equal(t, []string{"19"}, q["v"])
 		rw.WriteHeader(http.StatusOK)
@@ -74,7 +85,7 @@ func TestTileService_GlobalOK(t *testing.T) {
 		globalHeatmapDomain: mockServer.URL + "/server-a",
 	}
 
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3?api_token=token", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?api_token=token", nil)
 	w := httptest.NewRecorder()
 
 	err := s.ServeGlobalTile(w, req)
@@ -87,7 +98,7 @@ func TestTileService_GlobalOK(t *testing.T) {
 func TestTileService_GlobalOK_custom_params(t *testing.T) {
 	requestCount := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/server-a/identified/globalheat/winter/purple/1/2/3@2x.png", r.URL.Path)
+		assert.Equal(t, "/server-a/identified/globalheat/winter/purple/6/2/3@2x.png", r.URL.Path)
 		q := r.URL.Query()
 		assert.Equal(t, []string{"19"}, q["v"])
 		rw.WriteHeader(http.StatusOK)
@@ -106,7 +117,7 @@ func TestTileService_GlobalOK_custom_params(t *testing.T) {
 		globalHeatmapDomain: mockServer.URL + "/server-a",
 	}
 
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3?color=purple&sports=winter", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?color=purple&sports=winter", nil)
 	w := httptest.NewRecorder()
 
 	err := s.ServeGlobalTile(w, req)
@@ -119,7 +130,7 @@ func TestTileService_GlobalOK_custom_params(t *testing.T) {
 func TestTileService_PersonalOK(t *testing.T) {
 	requestCount := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/tiles/12321/orange/1/2/3@2x.png", r.URL.Path)
+		assert.Equal(t, "/tiles/12321/orange/6/2/3@2x.png", r.URL.Path)
 		q := r.URL.Query()
 		assert.Equal(t, []string{"true"}, q["include_everyone"])
 		assert.Equal(t, []string{"true"}, q["include_followers_only"])
@@ -146,7 +157,7 @@ func TestTileService_PersonalOK(t *testing.T) {
 		revealPublicActivities:       true,
 	}
 
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
 	w := httptest.NewRecorder()
 
 	err := s.ServePersonalTile(w, req)
@@ -159,7 +170,7 @@ func TestTileService_PersonalOK(t *testing.T) {
 func TestTileService_PersonalOK_custom_params(t *testing.T) {
 	requestCount := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/tiles/12321/purple/1/2/3@2x.png", r.URL.Path)
+		assert.Equal(t, "/tiles/12321/purple/6/2/3@2x.png", r.URL.Path)
 		q := r.URL.Query()
 		assert.Equal(t, []string{"winter"}, q["filter_type"])
 		rw.WriteHeader(http.StatusOK)
@@ -183,7 +194,7 @@ func TestTileService_PersonalOK_custom_params(t *testing.T) {
 		revealPublicActivities:       true,
 	}
 
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3?color=purple&sports=winter", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?color=purple&sports=winter", nil)
 	w := httptest.NewRecorder()
 
 	err := s.ServePersonalTile(w, req)
@@ -196,7 +207,7 @@ func TestTileService_PersonalOK_custom_params(t *testing.T) {
 func TestTileService_Personal401(t *testing.T) {
 	requestCount := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/tiles/12321/orange/1/2/3@2x.png", r.URL.Path)
+		assert.Equal(t, "/tiles/12321/orange/6/2/3@2x.png", r.URL.Path)
 		if requestCount == 0 {
 			rw.WriteHeader(http.StatusUnauthorized)
 		} else {
@@ -223,7 +234,7 @@ func TestTileService_Personal401(t *testing.T) {
 		revealPublicActivities:       true,
 	}
 
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
 	w := httptest.NewRecorder()
 
 	err := s.ServePersonalTile(w, req)
@@ -266,7 +277,7 @@ func TestTileService_400(t *testing.T) {
 	}
 
 	w := httptest.NewRecorder()
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3?color=garbage", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?color=garbage", nil)
 	err := s.ServePersonalTile(w, req)
 
 	require.NoError(t, err)
@@ -276,7 +287,7 @@ func TestTileService_400(t *testing.T) {
 func TestTileService_Global403(t *testing.T) {
 	requestCount := 0
 	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
-		assert.Equal(t, "/server-a/identified/globalheat/all/blue/1/2/3@2x.png", r.URL.Path)
+		assert.Equal(t, "/server-a/identified/globalheat/all/blue/6/2/3@2x.png", r.URL.Path)
 		if requestCount == 0 {
 			rw.WriteHeader(http.StatusUnauthorized)
 		} else {
@@ -298,7 +309,7 @@ func TestTileService_Global403(t *testing.T) {
 		globalHeatmapDomain: mockServer.URL + "/server-a",
 	}
 
-	req := httptest.NewRequest("GET", "https://example.com/tiles/1/2/3", nil)
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
 	w := httptest.NewRecorder()
 
 	err := s.ServeGlobalTile(w, req)
@@ -307,3 +318,261 @@ func TestTileService_Global403(t *testing.T) {
 	assert.Equal(t, 2, requestCount)
 	assert.Equal(t, http.StatusOK, w.Code)
 }
+
+func TestTileService_GlobalCached(t *testing.T) {
+	requestCount := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+		rw.Write([]byte("tile"))
+		requestCount++
+	}))
+
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+		cache:        cache,
+
+		globalHeatmapDomain: mockServer.URL + "/server-a",
+	}
+
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+		w := httptest.NewRecorder()
+
+		err := s.ServeGlobalTile(w, req)
+
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "tile", w.Body.String())
+	}
+	assert.Equal(t, 1, requestCount)
+
+	// A different color isn't served from the cache.
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?color=red", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, 2, requestCount)
+}
+
+func TestTileService_PersonalDateRange(t *testing.T) {
+	defer func(orig func() time.Time) { now = orig }(now)
+	now = func() time.Time { return time.Date(2025, time.June, 15, 12, 0, 0, 0, time.UTC) }
+
+	tests := []struct {
+		query string
+		start []string
+		end   []string
+	}{
+		{"start=2024-05-01&end=2024-09-30", []string{"2024-05-01"}, []string{"2024-09-30"}},
+		{"start=2024-05-01", []string{"2024-05-01"}, nil},
+		{"last=90d", []string{"2025-03-17"}, nil},
+		{"last=2w", []string{"2025-06-01"}, nil},
+		{"last=1y", []string{"2024-06-15"}, nil},
+		{"year=2023", []string{"2023-01-01"}, []string{"2023-12-31"}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				assert.Equal(t, test.start, q["filter_start"])
+				assert.Equal(t, test.end, q["filter_end"])
+				rw.WriteHeader(http.StatusOK)
+			}))
+			defer mockServer.Close()
+
+			stravaClient := mockStravaClient{}
+			defer stravaClient.AssertExpectations(t)
+
+			stravaClient.On("HttpClient").Return(mockServer.Client())
+			stravaClient.On("AthleteID").Return("12321", nil)
+
+			s := Service{
+				stravaClient: &stravaClient,
+				logger:       log.Default(),
+
+				personalHeatmapDomain: mockServer.URL,
+			}
+
+			req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?"+test.query, nil)
+			w := httptest.NewRecorder()
+
+			err := s.ServePersonalTile(w, req)
+
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+}
+
+func TestTileService_PersonalDateRange_400(t *testing.T) {
+	for _, query := range []string{
+		"start=garbage",
+		"end=2024-13-01",
+		"start=2024-05-01&end=2024-04-01",
+		"last=90",
+		"last=90d&start=2024-05-01",
+		"year=20x5",
+		"year=2024&last=1y",
+	} {
+		t.Run(query, func(t *testing.T) {
+			stravaClient := mockStravaClient{}
+			s := Service{
+				stravaClient: &stravaClient,
+				logger:       log.Default(),
+			}
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?"+query, nil)
+			err := s.ServePersonalTile(w, req)
+
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusBadRequest, w.Code)
+		})
+	}
+}
+
+func TestTileService_PersonalCommutes(t *testing.T) {
+	tests := []struct {
+		serverDefault bool
+		query         string
+		expected      string
+	}{
+		{true, "", "true"},
+		{false, "", "false"},
+		{true, "commutes=false", "false"},
+		{false, "commutes=true", "true"},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, []string{test.expected}, r.URL.Query()["include_commutes"])
+				rw.WriteHeader(http.StatusOK)
+			}))
+			defer mockServer.Close()
+
+			stravaClient := mockStravaClient{}
+			defer stravaClient.AssertExpectations(t)
+
+			stravaClient.On("HttpClient").Return(mockServer.Client())
+			stravaClient.On("AthleteID").Return("12321", nil)
+
+			s := Service{
+				stravaClient: &stravaClient,
+				logger:       log.Default(),
+
+				personalHeatmapDomain: mockServer.URL,
+				includeCommutes:       test.serverDefault,
+			}
+
+			req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?"+test.query, nil)
+			w := httptest.NewRecorder()
+
+			err := s.ServePersonalTile(w, req)
+
+			require.NoError(t, err)
+			assert.Equal(t, http.StatusOK, w.Code)
+		})
+	}
+
+	stravaClient := mockStravaClient{}
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?commutes=sometimes", nil)
+	require.NoError(t, s.ServePersonalTile(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTileService_PersonalPrivacy(t *testing.T) {
+	requestCount := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		assert.Equal(t, []string{"true"}, q["include_everyone"])
+		assert.Equal(t, []string{"false"}, q["include_followers_only"])
+		assert.Equal(t, []string{"false"}, q["include_only_me"])
+		assert.Equal(t, []string{"true"}, q["respect_privacy_zones"])
+		rw.WriteHeader(http.StatusOK)
+		requestCount++
+	}))
+
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	stravaClient.On("AthleteID").Return("12321", nil)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		personalHeatmapDomain:        mockServer.URL,
+		revealPrivacyZones:           true,
+		revealOnlyMeActivities:       true,
+		revealFollowerOnlyActivities: true,
+		revealPublicActivities:       true,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?reveal_privacy_zones=false&reveal_only_me_activities=false&reveal_follower_only_activities=false", nil)
+	w := httptest.NewRecorder()
+
+	err := s.ServePersonalTile(w, req)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, requestCount)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestTileService_PersonalPrivacy_ceiling(t *testing.T) {
+	stravaClient := mockStravaClient{}
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		revealPublicActivities: true,
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?reveal_only_me_activities=true", nil)
+	err := s.ServePersonalTile(w, req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTileService_SessionExpired(t *testing.T) {
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusUnauthorized)
+	}))
+
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	stravaClient.On("RefreshCloudFrontCookies").Return(strava.ErrSessionExpired)
+	stravaClient.On("AthleteID").Return("12321", nil)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		personalHeatmapDomain: mockServer.URL,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3", nil)
+	w := httptest.NewRecorder()
+
+	err := s.ServePersonalTile(w, req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
@@ -0,0 +1,120 @@
+package service
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/pmtiles"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+// Tile is a tile image loaded from a TileSource.
+type Tile struct {
+	Data []byte
+	// Modified is when the tile was fetched from Strava, or zero if unknown.
+	Modified time.Time
+}
+
+// TileSource loads tile images for a kind of layer.
+type TileSource interface {
+	// LoadTile returns a tile, or ErrNotFound if there isn't one. If the
+	// source responds with something other than a tile, that response is
+	// returned instead and must be closed by the caller.
+	LoadTile(ctx context.Context, stravaClient strava.Client, p Params) (Tile, *http.Response, error)
+	// CacheKey identifies the tile LoadTile returns for p, so tiles made from
+	// it can be cached.
+	CacheKey(stravaClient strava.Client, p Params) (TileKey, error)
+}
+
+// stravaSource loads tiles from Strava, through the tile cache.
+type stravaSource struct {
+	s    *Service
+	kind Kind
+}
+
+// source returns where tiles of a kind come from, Strava unless configured
+// otherwise.
+func (s *Service) source(kind Kind) TileSource {
+	if src, ok := s.sources[kind]; ok {
+		return src
+	}
+	return stravaSource{s: s, kind: kind}
+}
+
+// PMTilesSource serves tiles from a PMTiles archive, such as a snapshot
+// written by cmd/export. Tiles are returned as they were exported, regardless
+// of the request's layer parameters.
+type PMTilesSource struct {
+	location string
+	reader   *pmtiles.Reader
+}
+
+// NewPMTilesSource opens an archive from a local path, or an http(s) URL
+// that supports range requests.
+func NewPMTilesSource(location string) (*PMTilesSource, error) {
+	var reader *pmtiles.Reader
+	var err error
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		reader, err = pmtiles.Open(&pmtiles.HTTPReaderAt{
+			Client: &http.Client{Timeout: 30 * time.Second},
+			URL:    location,
+		})
+	} else {
+		var f *os.File
+		f, err = os.Open(location)
+		if err != nil {
+			return nil, err
+		}
+		reader, err = pmtiles.Open(f)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", location)
+	}
+	return &PMTilesSource{location: location, reader: reader}, nil
+}
+
+func (src *PMTilesSource) LoadTile(ctx context.Context, stravaClient strava.Client, p Params) (Tile, *http.Response, error) {
+	if p.z > math.MaxUint8 || p.x > math.MaxUint32 || p.y > math.MaxUint32 {
+		return Tile{}, nil, ErrNotFound
+	}
+	data, ok, err := src.reader.Tile(uint8(p.z), uint32(p.x), uint32(p.y))
+	if err != nil {
+		return Tile{}, nil, err
+	}
+	if !ok {
+		return Tile{}, nil, ErrNotFound
+	}
+	return Tile{Data: data}, nil, nil
+}
+
+// CacheKey identifies tiles by the archive's location and their coordinates,
+// since layer parameters don't change them.
+func (src *PMTilesSource) CacheKey(stravaClient strava.Client, p Params) (TileKey, error) {
+	return TileKey{Source: src.location, Z: p.z, X: p.x, Y: p.y}, nil
+}
+
+// newTileSourcesFromEnv opens the archives configured by PERSONAL_PMTILES
+// and GLOBAL_PMTILES, which replace Strava for that kind of tile.
+func newTileSourcesFromEnv() (map[Kind]TileSource, error) {
+	sources := map[Kind]TileSource{}
+	for kind, env := range map[Kind]string{
+		KindPersonal: "PERSONAL_PMTILES",
+		KindGlobal:   "GLOBAL_PMTILES",
+	} {
+		location := os.Getenv(env)
+		if location == "" {
+			continue
+		}
+		src, err := NewPMTilesSource(location)
+		if err != nil {
+			return nil, errors.Wrap(err, "bad "+env)
+		}
+		sources[kind] = src
+	}
+	return sources, nil
+}
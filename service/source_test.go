@@ -0,0 +1,113 @@
+package service
+
+import (
+	"bytes"
+	"image/color"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/pmtiles"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestArchive(t *testing.T) []byte {
+	w, err := pmtiles.NewWriter(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, w.AddTile(10, 163, 357, []byte("tile")))
+	var buf bytes.Buffer
+	require.NoError(t, w.Finish(&buf, pmtiles.Header{TileType: pmtiles.TileTypePNG, MinZoom: 10, MaxZoom: 10}, map[string]string{}))
+	return buf.Bytes()
+}
+
+func TestPMTilesSource(t *testing.T) {
+	archive := writeTestArchive(t)
+	path := filepath.Join(t.TempDir(), "global.pmtiles")
+	require.NoError(t, os.WriteFile(path, archive, 0600))
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.ServeContent(rw, r, "global.pmtiles", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer server.Close()
+
+	for _, location := range []string{path, server.URL + "/global.pmtiles"} {
+		src, err := NewPMTilesSource(location)
+		require.NoError(t, err)
+
+		// Strava isn't used
+		stravaClient := mockStravaClient{}
+		defer stravaClient.AssertExpectations(t)
+		s := Service{
+			stravaClient: &stravaClient,
+			logger:       log.Default(),
+			sources:      map[Kind]TileSource{KindGlobal: src},
+		}
+
+		req := httptest.NewRequest("GET", "https://example.com/global/tiles/10/163/357", nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "tile", w.Body.String())
+
+		req = httptest.NewRequest("GET", "https://example.com/global/tiles/10/163/358", nil)
+		w = httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+	}
+
+	_, err := NewPMTilesSource(filepath.Join(t.TempDir(), "missing.pmtiles"))
+	assert.Error(t, err)
+}
+
+func TestPMTilesSource_underzoom(t *testing.T) {
+	data, err := encodeTile(solidTile(stravaTileSize, color.RGBA{R: 0xff, A: 0xff}))
+	require.NoError(t, err)
+	w, err := pmtiles.NewWriter(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, w.AddTile(6, 10, 24, data))
+	var archive bytes.Buffer
+	require.NoError(t, w.Finish(&archive, pmtiles.Header{TileType: pmtiles.TileTypePNG, MinZoom: 6, MaxZoom: 6}, map[string]string{}))
+	path := filepath.Join(t.TempDir(), "global.pmtiles")
+	require.NoError(t, os.WriteFile(path, archive.Bytes(), 0600))
+	src, err := NewPMTilesSource(path)
+	require.NoError(t, err)
+
+	// Strava isn't used
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+		cache:        cache,
+		sources:      map[Kind]TileSource{KindGlobal: src},
+	}
+
+	// a tile synthesized from Strava doesn't stand in for the archive's
+	p := Params{z: 5, x: 5, y: 12, sports: "all", heatColor: "blue"}
+	stravaKey, err := stravaSource{s: &s, kind: KindGlobal}.CacheKey(&stravaClient, p)
+	require.NoError(t, err)
+	stravaKey.Underzoom = true
+	require.NoError(t, cache.Put(stravaKey, []byte("from strava"), time.Now()))
+	archiveKey, err := src.CacheKey(&stravaClient, p)
+	require.NoError(t, err)
+	archiveKey.Underzoom = true
+	assert.NotEqual(t, stravaKey.hash(), archiveKey.hash())
+
+	req := httptest.NewRequest("GET", "https://example.com/global/tiles/5/5/12", nil)
+	rec := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(rec, req))
+	require.Equal(t, http.StatusOK, rec.Code)
+	img, err := decodeTile(rec.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0xff, A: 0xff}, img.RGBAAt(100, 100))
+	cached, ok, err := cache.Get(archiveKey)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, rec.Body.Bytes(), cached.Data)
+}
@@ -0,0 +1,226 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultStaticWidth  = 600
+	defaultStaticHeight = 400
+)
+
+// staticLayer is one heatmap drawn into a static map.
+type staticLayer struct {
+	kind    Kind
+	opacity float64
+}
+
+// parseStaticLayers reads the layers to draw, bottom first, and their
+// opacity, e.g. layers=global,personal&opacity=global:0.5.
+func parseStaticLayers(q url.Values) ([]staticLayer, error) {
+	raw := q.Get("layers")
+	if raw == "" {
+		raw = string(KindPersonal)
+	}
+	var layers []staticLayer
+	for _, name := range strings.Split(raw, ",") {
+		kind := Kind(name)
+		if kind != KindPersonal && kind != KindGlobal {
+			return nil, ErrBadQuery{query: "layers", err: errors.New("expected personal or global")}
+		}
+		for _, layer := range layers {
+			if layer.kind == kind {
+				return nil, ErrBadQuery{query: "layers", err: errors.Errorf("%s is listed more than once", kind)}
+			}
+		}
+		layers = append(layers, staticLayer{kind: kind, opacity: 1})
+	}
+
+	for _, raw := range q["opacity"] {
+		for _, entry := range strings.Split(raw, ",") {
+			name, value, ok := strings.Cut(entry, ":")
+			if !ok {
+				return nil, ErrBadQuery{query: "opacity", err: errors.New("expected layer:opacity")}
+			}
+			opacity, err := strconv.ParseFloat(value, 64)
+			if err != nil || opacity < 0 || opacity > 1 {
+				return nil, ErrBadQuery{query: "opacity", err: errors.New("expected an opacity from 0 to 1")}
+			}
+			found := false
+			for i := range layers {
+				if layers[i].kind == Kind(name) {
+					layers[i].opacity = opacity
+					found = true
+				}
+			}
+			if !found {
+				return nil, ErrBadQuery{query: "opacity", err: errors.Errorf("%s isn't one of the layers", name)}
+			}
+		}
+	}
+	return layers, nil
+}
+
+// parseStaticSize reads an image size like "600x400".
+func parseStaticSize(raw string) (width, height int, err error) {
+	if raw == "" {
+		return defaultStaticWidth, defaultStaticHeight, nil
+	}
+	w, h, ok := strings.Cut(raw, "x")
+	if ok {
+		width, err = strconv.Atoi(w)
+	}
+	if ok && err == nil {
+		height, err = strconv.Atoi(h)
+	}
+	if !ok || err != nil || width <= 0 || height <= 0 || width > maxRenderSize || height > maxRenderSize {
+		return 0, 0, ErrBadQuery{query: "size", err: errors.Errorf("expected WIDTHxHEIGHT, up to %dx%d", maxRenderSize, maxRenderSize)}
+	}
+	return width, height, nil
+}
+
+// parseStaticView reads the area of a static map, from either center and zoom
+// or bbox. Zoom levels are the same as tiles, so a static map at zoom z shows
+// tile pixels at their original size. A bbox is expanded to match the aspect
+// ratio of the image, so the map isn't stretched.
+func parseStaticView(q url.Values, width, height int) (view mapView, z uint64, hasZoom bool, err error) {
+	view = mapView{
+		width:  width,
+		height: height,
+		toMercator: func(x, y float64) (float64, float64) {
+			return x, y
+		},
+	}
+
+	if raw := q.Get("bbox"); raw != "" {
+		values, err := parseFloats(raw, "bbox", 4)
+		if err != nil {
+			return view, 0, false, err
+		}
+		bbox := geo.BBox{MinLon: values[0], MinLat: values[1], MaxLon: values[2], MaxLat: values[3]}
+		if !bbox.Valid() {
+			return view, 0, false, ErrBadQuery{query: "bbox", err: errors.New("expected min_lon,min_lat,max_lon,max_lat")}
+		}
+		view.minX, view.minY = geo.LonLatToMercator(bbox.MinLon, bbox.MinLat)
+		view.maxX, view.maxY = geo.LonLatToMercator(bbox.MaxLon, bbox.MaxLat)
+		resolution := max((view.maxX-view.minX)/float64(width), (view.maxY-view.minY)/float64(height))
+		centerX, centerY := (view.minX+view.maxX)/2, (view.minY+view.maxY)/2
+		view.minX, view.maxX = centerX-resolution*float64(width)/2, centerX+resolution*float64(width)/2
+		view.minY, view.maxY = centerY-resolution*float64(height)/2, centerY+resolution*float64(height)/2
+		return view, 0, false, nil
+	}
+
+	raw := q.Get("center")
+	if raw == "" {
+		return view, 0, false, ErrBadQuery{query: "center", err: errors.New("expected center and zoom, or bbox")}
+	}
+	center, err := parseFloats(raw, "center", 2)
+	if err != nil {
+		return view, 0, false, err
+	}
+	z, err = strconv.ParseUint(q.Get("zoom"), 10, 64)
+	if err != nil || z < strava.HeatmapMinZoom || z > strava.HeatmapMaxZoom {
+		return view, 0, false, ErrBadQuery{query: "zoom", err: errors.Errorf("expected %d to %d", strava.HeatmapMinZoom, strava.HeatmapMaxZoom)}
+	}
+	centerX, centerY := geo.LonLatToMercator(center[1], center[0])
+	resolution := 2 * geo.MercatorExtent / stravaTileSize / float64(geo.Tiles(z))
+	view.minX, view.maxX = centerX-resolution*float64(width)/2, centerX+resolution*float64(width)/2
+	view.minY, view.maxY = centerY-resolution*float64(height)/2, centerY+resolution*float64(height)/2
+	return view, z, true, nil
+}
+
+// ServeStaticMap renders a single image of one or more heatmap layers, for
+// embedding snapshots where a slippy map isn't possible. The area is either
+// center (lat,lon) and zoom, or bbox (min_lon,min_lat,max_lon,max_lat), and
+// size is the image's WIDTHxHEIGHT. Other layer parameters apply to every
+// layer, and athlete selects whose personal heatmap is drawn.
+func (s *Service) ServeStaticMap(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	layers, err := parseStaticLayers(q)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	width, height, err := parseStaticSize(q.Get("size"))
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	view, z, hasZoom, err := parseStaticView(q, width, height)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	format := q.Get("format")
+	switch format {
+	case "", "png":
+		format = "image/png"
+	case "jpeg", "jpg":
+		format = "image/jpeg"
+	default:
+		return s.writeError(rw, r, ErrBadQuery{query: "format", err: errors.New("expected png or jpeg")})
+	}
+	var background *color.RGBA
+	if raw := q.Get("background"); raw != "" {
+		c, err := parseTint(raw)
+		if err != nil {
+			return s.writeError(rw, r, ErrBadQuery{query: "background", err: err})
+		}
+		background = &c
+	} else if format == "image/jpeg" {
+		background = &color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	}
+
+	params := make([]Params, len(layers))
+	clients := make([]strava.Client, len(layers))
+	for i, layer := range layers {
+		params[i], err = s.extractQuery(layer.kind, r, q)
+		if err != nil {
+			return s.writeError(rw, r, err)
+		}
+		if layer.kind == KindPersonal {
+			params[i].athlete = q.Get("athlete")
+		}
+		clients[i], err = s.layerClient(layer.kind, params[i])
+		if err != nil {
+			return s.writeError(rw, r, err)
+		}
+		params[i].z = z
+		if !hasZoom {
+			params[i].z = view.zoom(params[i].token.maxZoom())
+		}
+		if err := params[i].token.authorize(layer.kind, params[i]); err != nil {
+			return s.writeError(rw, r, err)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if background != nil {
+		draw.Draw(img, img.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+	}
+	for i, layer := range layers {
+		p := params[i]
+		s.logger.Printf("static %s map %dx%d at zoom %d for token %s", layer.kind, width, height, p.z, p.token.Name)
+		layerImg, err := s.renderView(r.Context(), layer.kind, clients[i], p, view, p.z)
+		var tooManyErr ErrTooManyTiles
+		if errors.As(err, &tooManyErr) {
+			return s.writeError(rw, r, ErrBadQuery{query: "size", err: err})
+		} else if err != nil {
+			return s.writeError(rw, r, err)
+		}
+		if layer.opacity < 1 {
+			fadeTile(layerImg, layer.opacity)
+		}
+		drawOver(img, layerImg)
+	}
+
+	return writeImage(rw, img, format)
+}
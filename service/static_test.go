@@ -0,0 +1,143 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStaticLayers(t *testing.T) {
+	layers, err := parseStaticLayers(map[string][]string{})
+	require.NoError(t, err)
+	assert.Equal(t, []staticLayer{{kind: KindPersonal, opacity: 1}}, layers)
+
+	layers, err = parseStaticLayers(map[string][]string{
+		"layers":  {"global,personal"},
+		"opacity": {"global:0.5"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []staticLayer{{kind: KindGlobal, opacity: 0.5}, {kind: KindPersonal, opacity: 1}}, layers)
+
+	_, err = parseStaticLayers(map[string][]string{"layers": {"team"}})
+	assert.Error(t, err)
+	_, err = parseStaticLayers(map[string][]string{"opacity": {"personal:2"}})
+	assert.Error(t, err)
+	// opacity for a layer that isn't drawn is probably a typo
+	_, err = parseStaticLayers(map[string][]string{"opacity": {"global:0.5"}})
+	assert.Error(t, err)
+}
+
+func TestServeStaticMap(t *testing.T) {
+	var tile bytes.Buffer
+	require.NoError(t, png.Encode(&tile, solidTile(stravaTileSize, color.RGBA{B: 0xff, A: 0xff})))
+
+	var requested []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		if !strings.HasPrefix(r.URL.Path, "/identified/globalheat/") {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(tile.Bytes())
+	}))
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	stravaClient.On("AthleteID").Return("123", nil)
+	aliceClient := mockStravaClient{}
+	aliceClient.On("HttpClient").Return(mockServer.Client())
+	aliceClient.On("AthleteID").Return("456", nil)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		athletes:     map[string]strava.Client{"alice": &aliceClient},
+		logger:       log.Default(),
+
+		globalHeatmapDomain:   mockServer.URL,
+		personalHeatmapDomain: mockServer.URL,
+	}
+
+	staticMap := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/static?"+query, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeStaticMap(w, req))
+		return w
+	}
+
+	// centered on a tile, at its zoom, covers exactly that tile
+	lon, lat := geo.TileToLonLat(4548.5, 2776.5, 13)
+	w := staticMap("layers=global,personal&opacity=global:0.5&size=512x512&zoom=13&center=" +
+		strings.Join([]string{formatFloat(lat), formatFloat(lon)}, ","))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.ElementsMatch(t, []string{
+		"/identified/globalheat/all/blue/13/4548/2776@2x.png",
+		"/tiles/123/orange/13/4548/2776@2x.png",
+	}, requested)
+	img, err := png.Decode(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 512, 512), img.Bounds())
+	_, _, b, a := img.At(10, 500).RGBA()
+	assert.InDelta(t, 0x7fff, a, 0x200)
+	assert.InDelta(t, 0x7fff, b, 0x200)
+
+	// personal layers can be for another athlete
+	requested = nil
+	w = staticMap("athlete=alice&size=512x512&zoom=13&center=" +
+		strings.Join([]string{formatFloat(lat), formatFloat(lon)}, ","))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []string{"/tiles/456/orange/13/4548/2776@2x.png"}, requested)
+
+	// a bbox is fit to the image, and picks a zoom level
+	requested = nil
+	w = staticMap("layers=global&size=600x400&bbox=19.86,50.04,19.95,50.07&format=jpeg")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.NotEmpty(t, requested)
+	for _, path := range requested {
+		assert.True(t, strings.HasPrefix(path, "/identified/globalheat/all/blue/13/"), path)
+	}
+
+	// a wide bbox is drawn below the zoom levels Strava serves, from z6 tiles
+	requested = nil
+	west, north := geo.TileToLonLat(1, 3, 3)
+	east, south := geo.TileToLonLat(2, 4, 3)
+	w = staticMap("layers=global&size=256x256&bbox=" + strings.Join([]string{formatFloat(west), formatFloat(south), formatFloat(east), formatFloat(north)}, ","))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, requested, 64)
+	for _, path := range requested {
+		assert.True(t, strings.HasPrefix(path, "/identified/globalheat/all/blue/6/"), path)
+	}
+
+	for _, query := range []string{
+		"center=50,19",
+		"center=50,19&zoom=20",
+		"center=50&zoom=10",
+		"bbox=20,50,19,51",
+		"center=50,19&zoom=10&size=10000x10",
+		"center=50,19&zoom=10&format=gif",
+		"center=50,19&zoom=10&layers=team",
+		"center=50,19&zoom=10&layers=global,global",
+		"center=50,19&zoom=10&opacity=globl:0.5",
+		"center=50,19&zoom=10&athlete=bob",
+	} {
+		w := staticMap(query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
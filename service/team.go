@@ -0,0 +1,147 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// teamAthletes returns the names of every athlete, with the default first.
+func (s *Service) teamAthletes() []string {
+	names := make([]string, 0, len(s.athletes))
+	for name := range s.athletes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return append([]string{defaultAthlete}, names...)
+}
+
+// teamQuery is the query parameters specific to team tiles.
+type teamQuery struct {
+	athletes []string
+	blend    blendMode
+	tints    map[string]color.RGBA
+}
+
+// extractTeamQuery reads and authorizes the team specific query parameters.
+func (s *Service) extractTeamQuery(q url.Values, token *Token) (team teamQuery, err error) {
+	team.athletes = s.teamAthletes()
+	if raw := q.Get("athletes"); raw != "" {
+		team.athletes = strings.Split(raw, ",")
+	}
+	included := map[string]bool{}
+	for _, name := range team.athletes {
+		if included[name] {
+			return team, ErrBadQuery{query: "athletes", err: errors.Errorf("athlete %s is listed more than once", name)}
+		}
+		included[name] = true
+		if name != defaultAthlete {
+			if _, ok := s.athletes[name]; !ok {
+				return team, ErrBadQuery{query: "athletes", err: errors.Errorf("unknown athlete %s", name)}
+			}
+		}
+		if err := token.authorizeAthlete(name); err != nil {
+			return team, err
+		}
+	}
+
+	team.blend, err = parseBlendMode(q.Get("blend"))
+	if err != nil {
+		return team, ErrBadQuery{query: "blend", err: err}
+	}
+
+	team.tints = map[string]color.RGBA{}
+	for _, raw := range q["tint"] {
+		for _, entry := range strings.Split(raw, ",") {
+			name, hex, ok := strings.Cut(entry, ":")
+			if !ok {
+				return team, ErrBadQuery{query: "tint", err: errors.New("expected name:rrggbb")}
+			}
+			if !included[name] {
+				return team, ErrBadQuery{query: "tint", err: errors.Errorf("athlete %s isn't in the team", name)}
+			}
+			team.tints[name], err = parseTint(hex)
+			if err != nil {
+				return team, ErrBadQuery{query: "tint", err: err}
+			}
+		}
+	}
+	return team, nil
+}
+
+// ServeTeamTile composites the personal tiles of several athletes into one.
+// The athletes query parameter selects who to include (default everyone),
+// blend chooses how overlapping lines combine, and tint (name:rrggbb)
+// recolors an athlete's lines.
+func (s *Service) ServeTeamTile(rw http.ResponseWriter, r *http.Request) error {
+	p, err := s.extractParams(KindTeam, r)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	team, err := s.extractTeamQuery(r.URL.Query(), p.token)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	s.logger.Printf("team tile %d/%d/%d for token %s", p.z, p.x, p.y, p.token.Name)
+
+	layers := make([]*image.RGBA, len(team.athletes))
+	errs := make([]error, len(team.athletes))
+	var wg sync.WaitGroup
+	for i, name := range team.athletes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			layers[i], errs[i] = s.loadTeamLayer(r, name, p)
+		}()
+	}
+	wg.Wait()
+
+	var found []*image.RGBA
+	for i, layer := range layers {
+		if errs[i] != nil {
+			return s.writeError(rw, r, errors.Wrapf(errs[i], "athlete %s", team.athletes[i]))
+		}
+		if layer == nil {
+			continue
+		}
+		if tint, ok := team.tints[team.athletes[i]]; ok {
+			tintTile(layer, tint)
+		}
+		found = append(found, layer)
+	}
+	bounds := image.Rect(0, 0, stravaTileSize, stravaTileSize)
+	if len(found) > 0 {
+		bounds = found[0].Rect
+	}
+	tile := image.NewRGBA(bounds)
+	compositeTiles(tile, found, team.blend)
+
+	data, err := encodeTile(resizeImage(tile, p.tileSize))
+	if err != nil {
+		return err
+	}
+	return s.writeTile(rw, r, KindTeam, Tile{Data: data})
+}
+
+// loadTeamLayer fetches one athlete's personal tile, returning nil if they
+// have no activities there.
+func (s *Service) loadTeamLayer(r *http.Request, name string, p Params) (*image.RGBA, error) {
+	athlete := name
+	if athlete == defaultAthlete {
+		athlete = ""
+	}
+	stravaClient, ok := s.athleteClient(athlete)
+	if !ok {
+		return nil, errors.Errorf("unknown athlete %s", name)
+	}
+	p.athlete = athlete
+	return s.loadTileImage(r.Context(), KindPersonal, stravaClient, p)
+}
@@ -0,0 +1,93 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTileService_Team(t *testing.T) {
+	red, err := encodeTile(solidTile(2, color.RGBA{R: 0xff, A: 0xff}))
+	require.NoError(t, err)
+	blue, err := encodeTile(solidTile(2, color.RGBA{B: 0xff, A: 0xff}))
+	require.NoError(t, err)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tiles/1/orange/6/2/3@2x.png":
+			rw.Write(red)
+		case "/tiles/2/orange/6/2/3@2x.png":
+			rw.Write(blue)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer mockServer.Close()
+
+	newClient := func(id string) *mockStravaClient {
+		c := &mockStravaClient{}
+		c.On("HttpClient").Return(mockServer.Client())
+		c.On("AthleteID").Return(id, nil)
+		return c
+	}
+
+	s := Service{
+		stravaClient: newClient("1"),
+		athletes: map[string]strava.Client{
+			"alice": newClient("2"),
+			"bob":   newClient("3"),
+		},
+		logger: log.Default(),
+
+		personalHeatmapDomain: mockServer.URL,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/team/6/2/3", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeTeamTile(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	img, err := decodeTile(w.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0xff, B: 0xff, A: 0xff}, img.RGBAAt(0, 0))
+
+	req = httptest.NewRequest("GET", "https://example.com/team/6/2/3?athletes=alice&tint=alice:00ff00", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeTeamTile(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	img, err = decodeTile(w.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, color.RGBA{G: 0xff, A: 0xff}, img.RGBAAt(1, 1))
+
+	// No one has been here.
+	req = httptest.NewRequest("GET", "https://example.com/team/6/2/3?athletes=bob", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeTeamTile(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	img, err = decodeTile(w.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, stravaTileSize, stravaTileSize), img.Rect)
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(0, 0))
+
+	for _, query := range []string{
+		"athletes=carol",
+		"athletes=alice,bob,alice",
+		"blend=multiply",
+		"tint=alice",
+		"tint=alice:red",
+		// tints must name an athlete in the team
+		"tint=carol:00ff00",
+		"athletes=alice&tint=default:00ff00",
+	} {
+		req = httptest.NewRequest("GET", "https://example.com/team/6/2/3?"+query, nil)
+		w = httptest.NewRecorder()
+		require.NoError(t, s.ServeTeamTile(w, req))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
@@ -0,0 +1,139 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const attribution = `<a href="https://www.strava.com" target="_blank">&copy; Strava</a>`
+
+// webMercatorBounds is the extent of the tile grid, in degrees.
+var webMercatorBounds = []float64{-180, -85.05112877980659, 180, 85.05112877980659}
+
+// TileJSON is a TileJSON 3.0 document, https://github.com/mapbox/tilejson-spec
+type TileJSON struct {
+	TileJSON    string    `json:"tilejson"`
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Attribution string    `json:"attribution,omitempty"`
+	Scheme      string    `json:"scheme"`
+	Tiles       []string  `json:"tiles"`
+	MinZoom     uint64    `json:"minzoom"`
+	MaxZoom     uint64    `json:"maxzoom"`
+	Bounds      []float64 `json:"bounds"`
+	Center      []float64 `json:"center,omitempty"`
+	// TileSize isn't part of TileJSON 3.0, but is read by some clients
+	TileSize int `json:"tileSize"`
+}
+
+func (s *Service) ServePersonalTileJSON(rw http.ResponseWriter, r *http.Request) error {
+	return s.serveTileJSON(KindPersonal, rw, r)
+}
+
+func (s *Service) ServeGlobalTileJSON(rw http.ResponseWriter, r *http.Request) error {
+	return s.serveTileJSON(KindGlobal, rw, r)
+}
+
+func (s *Service) ServeTeamTileJSON(rw http.ResponseWriter, r *http.Request) error {
+	return s.serveTileJSON(KindTeam, rw, r)
+}
+
+// serveTileJSON describes a layer, with the same query parameters as its
+// tiles, so clients can be pointed at one URL instead of a tile template.
+func (s *Service) serveTileJSON(kind Kind, rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	p, err := s.extractQuery(kind, r, q)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	if err := p.token.authorize(kind, p); err != nil {
+		return s.writeError(rw, r, err)
+	}
+	if kind == KindTeam {
+		if _, err := s.extractTeamQuery(q, p.token); err != nil {
+			return s.writeError(rw, r, err)
+		}
+	}
+	if _, ok := s.athleteClient(p.athlete); !ok {
+		return s.writeError(rw, r, ErrNotFound)
+	}
+
+	doc := TileJSON{
+		TileJSON:    "3.0.0",
+		Name:        layerName(kind, p),
+		Attribution: attribution,
+		Scheme:      "xyz",
+		Tiles:       []string{layerURL(r, kind, p) + "/{z}/{x}/{y}" + layerQuery(q)},
+		MinZoom:     minUnderzoom,
+		MaxZoom:     p.token.maxTileZoom(),
+		Bounds:      webMercatorBounds,
+		TileSize:    p.tileSize,
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(http.StatusOK)
+	enc := json.NewEncoder(rw)
+	enc.SetEscapeHTML(false)
+	return enc.Encode(doc)
+}
+
+func layerName(kind Kind, p Params) string {
+	switch kind {
+	case KindGlobal:
+		return fmt.Sprintf("Strava global heatmap (%s, %s)", p.sports, p.heatColor)
+	case KindTeam:
+		return fmt.Sprintf("Strava team heatmap (%s, %s)", p.sports, p.heatColor)
+	}
+	if p.athlete != "" {
+		return fmt.Sprintf("Strava personal heatmap for %s (%s, %s)", p.athlete, p.sports, p.heatColor)
+	}
+	return fmt.Sprintf("Strava personal heatmap (%s, %s)", p.sports, p.heatColor)
+}
+
+// baseURL returns the scheme and host the request was made to, respecting
+// headers set by a reverse proxy.
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+		host = forwardedHost
+	}
+	return scheme + "://" + host
+}
+
+// layerURL returns the URL tiles for a layer are served under.
+func layerURL(r *http.Request, kind Kind, p Params) string {
+	switch kind {
+	case KindPersonal:
+		if p.athlete != "" {
+			return baseURL(r) + "/personal/" + url.PathEscape(p.athlete)
+		}
+		return baseURL(r) + "/personal/tiles"
+	case KindTeam:
+		return baseURL(r) + "/team"
+	}
+	return baseURL(r) + "/global/tiles"
+}
+
+// layerQuery returns the query string, including "?", that selects the same
+// layer as q.
+func layerQuery(q url.Values) string {
+	layer := url.Values{}
+	for _, key := range layerQueryParams {
+		if values, ok := q[key]; ok {
+			layer[key] = values
+		}
+	}
+	if len(layer) == 0 {
+		return ""
+	}
+	return "?" + layer.Encode()
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeTileJSON(t *testing.T) {
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+		apiToken:     "token",
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/global/tiles.json?api_token=token&color=purple&sports=winter&x=1", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTileJSON(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+
+	var doc TileJSON
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.0", doc.TileJSON)
+	assert.Equal(t, []string{"https://example.com/global/tiles/{z}/{x}/{y}?api_token=token&color=purple&sports=winter"}, doc.Tiles)
+	assert.Equal(t, uint64(3), doc.MinZoom)
+	assert.Equal(t, uint64(18), doc.MaxZoom)
+	assert.Len(t, doc.Bounds, 4)
+	assert.NotEmpty(t, doc.Attribution)
+
+	// Relative dates stay relative, and reverse proxies are respected.
+	req = httptest.NewRequest("GET", "http://internal:8080/personal/tiles.json?api_token=token&last=90d", nil)
+	req.Header.Set("X-Forwarded-Proto", "https")
+	req.Header.Set("X-Forwarded-Host", "tiles.example.com")
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServePersonalTileJSON(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, []string{"https://tiles.example.com/personal/tiles/{z}/{x}/{y}?api_token=token&last=90d"}, doc.Tiles)
+
+	// Parameters are validated like tiles.
+	req = httptest.NewRequest("GET", "https://example.com/global/tiles.json?api_token=token&color=garbage", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTileJSON(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	req = httptest.NewRequest("GET", "https://example.com/global/tiles.json", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTileJSON(w, req))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestServeTileJSON_token(t *testing.T) {
+	maxZoom := uint64(12)
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+		tokens: []Token{
+			{Name: "friends", Token: "shared", Endpoints: []Kind{KindGlobal}, MaxZoom: &maxZoom},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/global/tiles.json?api_token=shared", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTileJSON(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	var doc TileJSON
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, uint64(12), doc.MaxZoom)
+
+	req = httptest.NewRequest("GET", "https://example.com/personal/tiles.json?api_token=shared", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServePersonalTileJSON(w, req))
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
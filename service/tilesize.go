@@ -0,0 +1,69 @@
+package service
+
+import (
+	"image"
+	"net/url"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// smallTileSize is the width and height of standard, @1x, tiles. They cover
+// the same area as Strava's @2x tiles at the same zoom.
+const smallTileSize = stravaTileSize / 2
+
+// parseTileSize reads the tile_size query parameter, defaulting to Strava's
+// tile size.
+func parseTileSize(q url.Values) (int, error) {
+	raw := q.Get("tile_size")
+	if raw == "" {
+		return stravaTileSize, nil
+	}
+	size, err := strconv.Atoi(raw)
+	if err != nil || (size != smallTileSize && size != stravaTileSize) {
+		return 0, ErrBadQuery{query: "tile_size", err: errors.Errorf("expected %d or %d", smallTileSize, stravaTileSize)}
+	}
+	return size, nil
+}
+
+// tileSizeFromScale returns the tile size for an @1x or @2x path suffix.
+func tileSizeFromScale(scale string) int {
+	if scale == "1" {
+		return smallTileSize
+	}
+	return stravaTileSize
+}
+
+// resizeTile scales tile data to size×size, if it isn't already.
+func resizeTile(tile Tile, size int) (Tile, error) {
+	if size == stravaTileSize {
+		// tiles are stored at Strava's size
+		return tile, nil
+	}
+	img, err := decodeTile(tile.Data)
+	if err != nil {
+		return Tile{}, err
+	}
+	if img.Rect.Dx() == size {
+		return tile, nil
+	}
+	data, err := encodeTile(resizeImage(img, size))
+	if err != nil {
+		return Tile{}, err
+	}
+	return Tile{Data: data, Modified: tile.Modified}, nil
+}
+
+// resizeImage scales a tile image to size×size, with a box filter when
+// halving it and bilinear interpolation otherwise.
+func resizeImage(img *image.RGBA, size int) *image.RGBA {
+	switch img.Rect.Dx() {
+	case size:
+		return img
+	case size * 2:
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		halveTile(dst, image.Point{}, img)
+		return dst
+	}
+	return upscaleTile(img, img.Rect, size)
+}
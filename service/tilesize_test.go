@@ -0,0 +1,148 @@
+package service
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTileService_TileSize(t *testing.T) {
+	// alternating columns, which average out when halved
+	tile := image.NewRGBA(image.Rect(0, 0, stravaTileSize, stravaTileSize))
+	for y := range stravaTileSize {
+		for x := 0; x < stravaTileSize; x += 2 {
+			tile.SetRGBA(x, y, color.RGBA{R: 0xff, A: 0xff})
+		}
+	}
+	tileData, err := encodeTile(tile)
+	require.NoError(t, err)
+
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// Strava's tiles are always fetched at @2x
+		assert.Equal(t, "/identified/globalheat/all/blue/10/2/3@2x.png", r.URL.Path)
+		rw.Write(tileData)
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	for path, size := range map[string]int{
+		"/tiles/10/2/3":                  stravaTileSize,
+		"/tiles/10/2/3@2x":               stravaTileSize,
+		"/tiles/10/2/3@1x":               smallTileSize,
+		"/tiles/10/2/3?tile_size=256":    smallTileSize,
+		"/tiles/10/2/3@1x?tile_size=256": smallTileSize,
+		"/tiles/10/2/3?tile_size=512":    stravaTileSize,
+	} {
+		req := httptest.NewRequest("GET", "https://example.com"+path, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		require.Equal(t, http.StatusOK, w.Code, path)
+		img, err := decodeTile(w.Body.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, size, size), img.Rect, path)
+		if size == smallTileSize {
+			assert.Equal(t, color.RGBA{R: 0x80, A: 0x80}, img.RGBAAt(10, 10), path)
+		}
+	}
+
+	// WMTS tile matrix sets select the tile size
+	for tileMatrixSet, size := range map[string]int{
+		"GoogleMapsCompatible":    smallTileSize,
+		"GoogleMapsCompatible512": stravaTileSize,
+	} {
+		req := httptest.NewRequest("GET", "https://example.com/wmts?REQUEST=GetTile&LAYER=global-all-blue&TILEMATRIX=10&TILEROW=3&TILECOL=2&TILEMATRIXSET="+tileMatrixSet, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeWMTS(w, req))
+		require.Equal(t, http.StatusOK, w.Code, tileMatrixSet)
+		img, err := decodeTile(w.Body.Bytes())
+		require.NoError(t, err)
+		assert.Equal(t, image.Rect(0, 0, size, size), img.Rect, tileMatrixSet)
+	}
+
+	for _, path := range []string{
+		"/tiles/10/2/3@1x?tile_size=512",
+		"/tiles/10/2/3?tile_size=300",
+		"/tiles/10/2/3@3x",
+	} {
+		req := httptest.NewRequest("GET", "https://example.com"+path, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		assert.NotEqual(t, http.StatusOK, w.Code, path)
+	}
+}
+
+func TestServeTileJSON_tileSize(t *testing.T) {
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/global/tiles.json?tile_size=256", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTileJSON(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	var doc TileJSON
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, smallTileSize, doc.TileSize)
+	assert.Equal(t, []string{"https://example.com/global/tiles/{z}/{x}/{y}?tile_size=256"}, doc.Tiles)
+
+	req = httptest.NewRequest("GET", "https://example.com/global/tiles.json", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTileJSON(w, req))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &doc))
+	assert.Equal(t, stravaTileSize, doc.TileSize)
+}
+
+func TestServeWMTS_tileSize(t *testing.T) {
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/wmts?service=WMTS&request=GetCapabilities&tile_size=256", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeWMTS(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var caps struct {
+		Operations []struct {
+			Href struct {
+				Value string `xml:"href,attr"`
+			} `xml:"DCP>HTTP>Get"`
+		} `xml:"OperationsMetadata>Operation"`
+		TileMatrixSet     string `xml:"Contents>TileMatrixSet>Identifier"`
+		WellKnownScaleSet string `xml:"Contents>TileMatrixSet>WellKnownScaleSet"`
+		TileMatrices      []struct {
+			ScaleDenominator float64 `xml:"ScaleDenominator"`
+			TileWidth        int     `xml:"TileWidth"`
+		} `xml:"Contents>TileMatrixSet>TileMatrix"`
+	}
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &caps))
+	// GetTile requests carry the tile size through
+	assert.Equal(t, "https://example.com/wmts?tile_size=256&", caps.Operations[1].Href.Value)
+	assert.Equal(t, "GoogleMapsCompatible", caps.TileMatrixSet)
+	assert.Equal(t, "urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible", caps.WellKnownScaleSet)
+	assert.Equal(t, smallTileSize, caps.TileMatrices[0].TileWidth)
+	assert.InDelta(t, 559082264.0287178, caps.TileMatrices[0].ScaleDenominator, 0.01)
+
+	req = httptest.NewRequest("GET", "https://example.com/wmts?service=WMTS&request=GetCapabilities&tile_size=100", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeWMTS(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
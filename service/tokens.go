@@ -0,0 +1,171 @@
+package service
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+// Token is a named API token and the scope of what it can access. Empty
+// restrictions allow everything.
+type Token struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+
+	Endpoints []Kind        `json:"endpoints,omitempty"`
+	MaxZoom   *uint64       `json:"max_zoom,omitempty"`
+	Sports    []string      `json:"sports,omitempty"`
+	Colors    []strava.Heat `json:"colors,omitempty"`
+	// Athletes limits which accounts' personal tiles can be accessed, with the
+	// main account named "default".
+	Athletes []string `json:"athletes,omitempty"`
+	// Privacy further limits what's revealed on personal tiles, on top of the
+	// server's REVEAL_* settings.
+	Privacy *Privacy `json:"privacy,omitempty"`
+}
+
+// anonymousToken is used when no tokens are configured.
+var anonymousToken = &Token{Name: "anonymous"}
+
+// loadTokens reads a JSON array of tokens from path.
+func loadTokens(path string) ([]Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, errors.Wrap(err, "parsing tokens")
+	}
+	names := map[string]bool{}
+	for i, token := range tokens {
+		if token.Name == "" {
+			return nil, errors.Errorf("token %d is missing a name", i)
+		}
+		if token.Token == "" {
+			return nil, errors.Errorf("token %s is empty", token.Name)
+		}
+		if names[token.Name] {
+			return nil, errors.Errorf("duplicate token name %s", token.Name)
+		}
+		names[token.Name] = true
+		for _, kind := range token.Endpoints {
+			if kind != KindPersonal && kind != KindGlobal && kind != KindTeam && kind != KindAdmin {
+				return nil, errors.Errorf("token %s has unknown endpoint %s", token.Name, kind)
+			}
+		}
+		for _, color := range token.Colors {
+			if _, err := strava.ParseHeat(string(color)); err != nil {
+				return nil, errors.Wrapf(err, "token %s", token.Name)
+			}
+		}
+	}
+	return tokens, nil
+}
+
+// authenticate finds the token matching provided. All tokens are compared in
+// constant time so response timing doesn't leak which, if any, matched.
+func (s *Service) authenticate(provided string) (*Token, error) {
+	if len(s.tokens) == 0 && s.apiToken == "" {
+		return anonymousToken, nil
+	}
+
+	var match *Token
+	for i := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(s.tokens[i].Token), []byte(provided)) == 1 {
+			match = &s.tokens[i]
+		}
+	}
+	if s.apiToken != "" && subtle.ConstantTimeCompare([]byte(s.apiToken), []byte(provided)) == 1 {
+		match = &Token{Name: "default", Token: s.apiToken}
+	}
+	if match == nil {
+		return nil, ErrUnauthorized{err: errors.New("incorrect api token")}
+	}
+	return match, nil
+}
+
+// authorize checks the request is within the scope of the token.
+func (t *Token) authorize(kind Kind, p Params) error {
+	if len(t.Endpoints) > 0 && !slices.Contains(t.Endpoints, kind) {
+		return ErrForbidden{err: errors.Errorf("not allowed to access %s tiles", kind)}
+	}
+	if kind == KindPersonal {
+		if err := t.authorizeAthlete(p.athlete); err != nil {
+			return err
+		}
+	}
+	if t.MaxZoom != nil && p.z > *t.MaxZoom {
+		return ErrForbidden{err: errors.Errorf("not allowed to access zoom %d", p.z)}
+	}
+	if len(t.Colors) > 0 && !slices.Contains(t.Colors, p.heatColor) {
+		return ErrForbidden{err: errors.Errorf("not allowed to access color %s", p.heatColor)}
+	}
+	if len(t.Sports) > 0 {
+		for _, sport := range strings.Split(p.sports, ",") {
+			if !slices.Contains(t.Sports, sport) {
+				return ErrForbidden{err: errors.Errorf("not allowed to access sport %s", sport)}
+			}
+		}
+	}
+	return nil
+}
+
+// authorizeAdmin checks the token can use the admin API. The API is never
+// open to anonymous requests, even when no tokens are configured.
+func (t *Token) authorizeAdmin() error {
+	if t == anonymousToken {
+		return ErrUnauthorized{err: errors.New("admin API requires an api token")}
+	}
+	if len(t.Endpoints) > 0 && !slices.Contains(t.Endpoints, KindAdmin) {
+		return ErrForbidden{err: errors.New("not allowed to access the admin API")}
+	}
+	return nil
+}
+
+// authorizeAthlete checks the token can access an athlete's personal tiles.
+// An empty name is the default athlete.
+func (t *Token) authorizeAthlete(name string) error {
+	if name == "" {
+		name = defaultAthlete
+	}
+	if len(t.Athletes) > 0 && !slices.Contains(t.Athletes, name) {
+		return ErrForbidden{err: errors.Errorf("not allowed to access athlete %s", name)}
+	}
+	return nil
+}
+
+// maxZoom returns the highest heatmap zoom level the token can access.
+func (t *Token) maxZoom() uint64 {
+	if t.MaxZoom != nil && *t.MaxZoom < strava.HeatmapMaxZoom {
+		return *t.MaxZoom
+	}
+	return strava.HeatmapMaxZoom
+}
+
+// maxTileZoom returns the highest zoom level the token can request tiles at,
+// including tiles upscaled beyond what Strava serves.
+func (t *Token) maxTileZoom() uint64 {
+	if t.MaxZoom != nil && *t.MaxZoom < maxOverzoom {
+		return *t.MaxZoom
+	}
+	return maxOverzoom
+}
+
+// privacyCeiling returns the most t may reveal given the server's ceiling.
+func (t *Token) privacyCeiling(server Privacy) Privacy {
+	if t.Privacy == nil {
+		return server
+	}
+	return Privacy{
+		RevealPrivacyZones:           server.RevealPrivacyZones && t.Privacy.RevealPrivacyZones,
+		RevealOnlyMeActivities:       server.RevealOnlyMeActivities && t.Privacy.RevealOnlyMeActivities,
+		RevealFollowerOnlyActivities: server.RevealFollowerOnlyActivities && t.Privacy.RevealFollowerOnlyActivities,
+		RevealPublicActivities:       server.RevealPublicActivities && t.Privacy.RevealPublicActivities,
+	}
+}
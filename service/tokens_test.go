@@ -0,0 +1,157 @@
+package service
+
+import (
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadTokens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	require.NoError(t, os.WriteFile(path, []byte(`[
+		{"name": "me", "token": "secret"},
+		{
+			"name": "friends",
+			"token": "shared",
+			"endpoints": ["global"],
+			"max_zoom": 12,
+			"colors": ["blue", "purple"],
+			"sports": ["all", "winter"],
+			"privacy": {"reveal_public_activities": true}
+		}
+	]`), 0600))
+
+	tokens, err := loadTokens(path)
+	require.NoError(t, err)
+	require.Len(t, tokens, 2)
+	assert.Equal(t, "friends", tokens[1].Name)
+	assert.Equal(t, []Kind{KindGlobal}, tokens[1].Endpoints)
+	assert.Equal(t, uint64(12), *tokens[1].MaxZoom)
+	assert.Equal(t, &Privacy{RevealPublicActivities: true}, tokens[1].Privacy)
+
+	for _, bad := range []string{
+		`[{"token": "secret"}]`,
+		`[{"name": "me"}]`,
+		`[{"name": "me", "token": "a"}, {"name": "me", "token": "b"}]`,
+		`[{"name": "me", "token": "a", "endpoints": ["tiles"]}]`,
+		`[{"name": "me", "token": "a", "colors": ["garbage"]}]`,
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(bad), 0600))
+		_, err := loadTokens(path)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := Service{}
+	token, err := s.authenticate("anything")
+	require.NoError(t, err)
+	assert.Equal(t, anonymousToken, token)
+
+	s = Service{
+		apiToken: "legacy",
+		tokens: []Token{
+			{Name: "me", Token: "secret"},
+			{Name: "friends", Token: "shared"},
+		},
+	}
+	token, err = s.authenticate("shared")
+	require.NoError(t, err)
+	assert.Equal(t, "friends", token.Name)
+
+	token, err = s.authenticate("legacy")
+	require.NoError(t, err)
+	assert.Equal(t, "default", token.Name)
+
+	_, err = s.authenticate("")
+	assert.ErrorAs(t, err, &ErrUnauthorized{})
+	_, err = s.authenticate("secre")
+	assert.ErrorAs(t, err, &ErrUnauthorized{})
+}
+
+func TestTokenAuthorize(t *testing.T) {
+	maxZoom := uint64(12)
+	token := Token{
+		Name:      "friends",
+		Endpoints: []Kind{KindGlobal},
+		MaxZoom:   &maxZoom,
+		Colors:    []strava.Heat{strava.HeatBlue},
+		Sports:    []string{"all", "winter"},
+	}
+
+	assert.NoError(t, token.authorize(KindGlobal, Params{z: 12, heatColor: strava.HeatBlue, sports: "winter"}))
+	assert.Error(t, token.authorize(KindPersonal, Params{z: 12, heatColor: strava.HeatBlue, sports: "winter"}))
+	assert.Error(t, token.authorize(KindGlobal, Params{z: 13, heatColor: strava.HeatBlue, sports: "winter"}))
+	assert.Error(t, token.authorize(KindGlobal, Params{z: 12, heatColor: strava.HeatRed, sports: "winter"}))
+	assert.Error(t, token.authorize(KindGlobal, Params{z: 12, heatColor: strava.HeatBlue, sports: "winter,ride"}))
+
+	assert.NoError(t, (&Token{}).authorize(KindPersonal, Params{z: 20, heatColor: strava.HeatRed, sports: "ride"}))
+}
+
+func TestTokenAuthorizeAdmin(t *testing.T) {
+	assert.NoError(t, (&Token{Name: "me"}).authorizeAdmin())
+	assert.NoError(t, (&Token{Name: "me", Endpoints: []Kind{KindAdmin, KindGlobal}}).authorizeAdmin())
+	assert.Error(t, (&Token{Name: "me", Endpoints: []Kind{KindGlobal}}).authorizeAdmin())
+	assert.Error(t, anonymousToken.authorizeAdmin())
+}
+
+func TestTileService_TokenScope(t *testing.T) {
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+		tokens: []Token{
+			{Name: "friends", Token: "shared", Endpoints: []Kind{KindGlobal}},
+		},
+		revealPublicActivities: true,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?api_token=shared", nil)
+	w := httptest.NewRecorder()
+
+	err := s.ServePersonalTile(w, req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestTileService_TokenPrivacy(t *testing.T) {
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+		tokens: []Token{
+			{Name: "friends", Token: "shared", Privacy: &Privacy{RevealPublicActivities: true}},
+		},
+		revealOnlyMeActivities: true,
+		revealPublicActivities: true,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/tiles/6/2/3?api_token=shared&reveal_only_me_activities=true", nil)
+	w := httptest.NewRecorder()
+
+	err := s.ServePersonalTile(w, req)
+
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestTokenAuthorize_athletes(t *testing.T) {
+	token := Token{Name: "team", Athletes: []string{"default", "alice"}}
+
+	assert.NoError(t, token.authorize(KindPersonal, Params{}))
+	assert.NoError(t, token.authorize(KindPersonal, Params{athlete: "alice"}))
+	assert.Error(t, token.authorize(KindPersonal, Params{athlete: "bob"}))
+	assert.NoError(t, token.authorize(KindGlobal, Params{}))
+}
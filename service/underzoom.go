@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"image"
+	"net/http"
+	"sync"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+// minUnderzoom is the lowest zoom level tiles are synthesized at below
+// strava.HeatmapMinZoom. Each level down needs four times as many tiles from
+// Strava, 64 at this zoom.
+const minUnderzoom = 3
+
+// loadUnderzoomTile loads a tile below strava.HeatmapMinZoom by downsampling
+// its four children, which are themselves synthesized until reaching a zoom
+// Strava serves. Results are cached at each level, since they're expensive,
+// and concurrent requests for the same tile share the work. If that fails, a
+// stale cached tile is served instead.
+func (s *Service) loadUnderzoomTile(ctx context.Context, kind Kind, stravaClient strava.Client, p Params) (Tile, *http.Response, error) {
+	key, err := s.source(kind).CacheKey(stravaClient, p)
+	if err != nil {
+		return Tile{}, nil, err
+	}
+	key.Underzoom = true
+
+	var cached *CachedTile
+	if s.cache != nil {
+		tile, ok, err := s.cache.Get(key)
+		if err != nil {
+			s.logger.Printf("reading cached tile %s: %v", key, err)
+		} else if ok && !tile.Stale {
+			return Tile{Data: tile.Data, Modified: tile.Modified}, nil, nil
+		} else if ok {
+			cached = &tile
+		}
+	}
+
+	result, err := s.flights.do(ctx, key.String(), func(ctx context.Context) tileResult {
+		return s.synthesizeTile(ctx, kind, stravaClient, p, key)
+	})
+	if err != nil {
+		return Tile{}, nil, err
+	}
+	if result.err != nil {
+		// a stale tile is better than none, unless there are no lines now
+		if cached != nil && !errors.Is(result.err, ErrNotFound) {
+			s.logger.Printf("synthesizing cached tile %s: %v", key, result.err)
+			return Tile{Data: cached.Data, Modified: cached.Modified}, nil, nil
+		}
+		return Tile{}, nil, result.err
+	}
+	return Tile{Data: result.data, Modified: result.modified}, nil, nil
+}
+
+// synthesizeTile downsamples the children of p's tile into one tile, and
+// caches it. It returns ErrNotFound if none of the children have lines.
+func (s *Service) synthesizeTile(ctx context.Context, kind Kind, stravaClient strava.Client, p Params, key TileKey) tileResult {
+	var children [4]*image.RGBA
+	var errs [4]error
+	var wg sync.WaitGroup
+	for i := range children {
+		child := p
+		child.z = p.z + 1
+		child.x = p.x*2 + uint64(i%2)
+		child.y = p.y*2 + uint64(i/2)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			children[i], errs[i] = s.loadTileImage(ctx, kind, stravaClient, child)
+		}()
+	}
+	wg.Wait()
+
+	var tile *image.RGBA
+	for i, child := range children {
+		if errs[i] != nil {
+			return tileResult{err: errs[i]}
+		}
+		if child == nil {
+			continue
+		}
+		if tile == nil {
+			tile = image.NewRGBA(child.Rect)
+		}
+		half := tile.Rect.Dx() / 2
+		halveTile(tile, image.Pt(i%2*half, i/2*half), child)
+	}
+	if tile == nil {
+		return tileResult{err: ErrNotFound}
+	}
+
+	data, err := encodeTile(tile)
+	if err != nil {
+		return tileResult{err: err}
+	}
+	modified := now()
+	if s.cache != nil {
+		if err := s.cache.Put(key, data, modified); err != nil {
+			s.logger.Printf("caching tile %s: %v", key, err)
+		}
+	}
+	return tileResult{status: http.StatusOK, data: data, modified: modified}
+}
+
+// halveTile downsamples src to half its size with a 2×2 box filter, drawing
+// it into dst at offset.
+func halveTile(dst *image.RGBA, offset image.Point, src *image.RGBA) {
+	width, height := src.Rect.Dx()/2, src.Rect.Dy()/2
+	for y := range height {
+		for x := range width {
+			sx, sy := src.Rect.Min.X+x*2, src.Rect.Min.Y+y*2
+			p00 := src.Pix[src.PixOffset(sx, sy):][:4]
+			p10 := src.Pix[src.PixOffset(sx+1, sy):][:4]
+			p01 := src.Pix[src.PixOffset(sx, sy+1):][:4]
+			p11 := src.Pix[src.PixOffset(sx+1, sy+1):][:4]
+			out := dst.Pix[dst.PixOffset(offset.X+x, offset.Y+y):][:4]
+			for c := range 4 {
+				out[c] = uint8((uint32(p00[c]) + uint32(p10[c]) + uint32(p01[c]) + uint32(p11[c]) + 2) / 4)
+			}
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package service
+
+import (
+	"image"
+	"image/color"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTileService_Underzoom(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	childData, err := encodeTile(solidTile(stravaTileSize, red))
+	require.NoError(t, err)
+
+	// only one z6 tile has lines
+	var requestCount atomic.Int32
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requestCount.Add(1)
+		if r.URL.Path != "/identified/globalheat/all/blue/6/10/24@2x.png" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write(childData)
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	cache, err := NewFileCache(t.TempDir(), 0, 0)
+	require.NoError(t, err)
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+		cache:        cache,
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	load := func(path string) *image.RGBA {
+		req := httptest.NewRequest("GET", "https://example.com/tiles/"+path, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		require.Equal(t, http.StatusOK, w.Code, path)
+		img, err := decodeTile(w.Body.Bytes())
+		require.NoError(t, err)
+		require.Equal(t, image.Rect(0, 0, stravaTileSize, stravaTileSize), img.Rect)
+		return img
+	}
+
+	// a z4 tile is made from 16 z6 tiles, through 4 z5 tiles
+	img := load("4/2/6")
+	assert.Equal(t, int32(16), requestCount.Load())
+	assert.Equal(t, red, img.RGBAAt(300, 100))
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(100, 100))
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(300, 300))
+
+	// both levels are cached
+	load("4/2/6")
+	img = load("5/5/12")
+	assert.Equal(t, int32(16), requestCount.Load())
+	assert.Equal(t, red, img.RGBAAt(100, 100))
+	assert.Equal(t, color.RGBA{}, img.RGBAAt(300, 100))
+
+	// tiles without any lines are missing
+	req := httptest.NewRequest("GET", "https://example.com/tiles/5/4/12", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeGlobalTile(w, req))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestTileService_UnderzoomStale(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	childData, err := encodeTile(solidTile(stravaTileSize, red))
+	require.NoError(t, err)
+
+	var throttled atomic.Bool
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if throttled.Load() {
+			rw.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Path != "/identified/globalheat/all/blue/6/10/24@2x.png" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write(childData)
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	cache, err := NewFileCache(t.TempDir(), time.Hour, 0)
+	require.NoError(t, err)
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+		cache:        cache,
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+	load := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/tiles/5/5/12", nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeGlobalTile(w, req))
+		return w
+	}
+	require.Equal(t, http.StatusOK, load().Code)
+
+	// once everything has expired and Strava is throttling, with nothing
+	// cached for the z6 tile, the stale synthesized tile is still served
+	cache.lock.Lock()
+	for _, el := range cache.entries {
+		entry := el.Value.(*fileCacheEntry)
+		old := time.Now().Add(-2 * time.Hour)
+		require.NoError(t, os.Chtimes(cache.path(*entry), old, old))
+	}
+	cache.lock.Unlock()
+	z6, err := s.source(KindGlobal).CacheKey(&stravaClient, Params{z: 6, x: 10, y: 24, sports: "all", heatColor: "blue"})
+	require.NoError(t, err)
+	cache.lock.Lock()
+	require.NoError(t, cache.remove(cache.entries[z6.hash()]))
+	cache.lock.Unlock()
+	throttled.Store(true)
+
+	w := load()
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	img, err := decodeTile(w.Body.Bytes())
+	require.NoError(t, err)
+	assert.Equal(t, red, img.RGBAAt(100, 100))
+}
+
+func TestHalveTile(t *testing.T) {
+	src := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	src.SetRGBA(0, 0, color.RGBA{R: 200, A: 200})
+	src.SetRGBA(1, 1, color.RGBA{R: 100, A: 100})
+
+	dst := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	halveTile(dst, image.Pt(2, 2), src)
+	assert.Equal(t, color.RGBA{R: 75, A: 75}, dst.RGBAAt(2, 2))
+	assert.Equal(t, color.RGBA{}, dst.RGBAAt(3, 3))
+	assert.Equal(t, color.RGBA{}, dst.RGBAAt(0, 0))
+}
@@ -0,0 +1,51 @@
+package service
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+)
+
+// sessionWatchInterval is how often session files are checked for changes.
+const sessionWatchInterval = 10 * time.Second
+
+// watchSessionFile polls a session file written by cmd/auth, and swaps new
+// credentials into the client whenever it changes, until ctx is done.
+func (s *Service) watchSessionFile(ctx context.Context, path string, stravaClient strava.Client, interval time.Duration) {
+	var lastModified time.Time
+	if info, err := os.Stat(path); err == nil {
+		lastModified = info.ModTime()
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			s.logger.Printf("checking session file %s: %v", path, err)
+			continue
+		}
+		if info.ModTime().Equal(lastModified) {
+			continue
+		}
+		session, err := strava.ReadSessionFile(path)
+		if err != nil {
+			// cmd/auth may be mid-write, try again next tick
+			s.logger.Printf("reading session file: %v", err)
+			continue
+		}
+		lastModified = info.ModTime()
+		if err := stravaClient.SetSession(session); err != nil {
+			s.logger.Printf("updating session from %s: %v", path, err)
+			continue
+		}
+		s.logger.Printf("loaded new session from %s", path)
+	}
+}
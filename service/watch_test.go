@@ -0,0 +1,59 @@
+package service
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWatchSessionFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env.auth")
+	require.NoError(t, os.WriteFile(path, []byte("STRAVA_REMEMBER_TOKEN=a\nSTRAVA4_SESSION=b\n"), 0600))
+
+	updated := make(chan strava.Session, 1)
+	stravaClient := mockStravaClient{}
+	stravaClient.On("SetSession", mock.Anything).Run(func(args mock.Arguments) {
+		updated <- args.Get(0).(strava.Session)
+	}).Return(nil)
+
+	s := Service{logger: log.Default()}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		s.watchSessionFile(ctx, path, &stravaClient, 10*time.Millisecond)
+		close(stopped)
+	}()
+
+	// Unchanged files aren't reloaded.
+	select {
+	case <-updated:
+		t.Fatal("unexpected reload")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, os.WriteFile(path, []byte("STRAVA_REMEMBER_TOKEN=c\nSTRAVA4_SESSION=d\n"), 0600))
+	later := time.Now().Add(time.Second)
+	require.NoError(t, os.Chtimes(path, later, later))
+
+	select {
+	case session := <-updated:
+		require.Equal(t, strava.Session{RememberToken: "c", Session: "d"}, session)
+	case <-time.After(time.Second):
+		t.Fatal("session wasn't reloaded")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("watcher didn't stop")
+	}
+}
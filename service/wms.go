@@ -0,0 +1,362 @@
+package service
+
+import (
+	"encoding/xml"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+// ServeWMS implements the KVP binding of OGC WMS 1.3.0 and 1.1.1, rendering
+// heatmap layers for arbitrary bounding boxes. Layers are the same as WMTS.
+// Errors are reported as WMS service exception reports.
+func (s *Service) ServeWMS(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if service := kvpGet(q, "SERVICE"); service != "" && !strings.EqualFold(service, "WMS") {
+		return s.writeWMSError(rw, r, ErrBadQuery{query: "SERVICE", err: errors.New("expected WMS")})
+	}
+	switch strings.ToLower(kvpGet(q, "REQUEST")) {
+	case "getcapabilities", "capabilities":
+		return s.serveWMSCapabilities(rw, r)
+	case "getmap", "map":
+		return s.serveWMSMap(rw, r)
+	}
+	return s.writeWMSError(rw, r, ErrBadQuery{query: "REQUEST", err: errors.New("expected GetCapabilities or GetMap")})
+}
+
+// wmsVersion negotiates the version of WMS to respond with, 1.1.1 for clients
+// asking for an earlier version and 1.3.0 otherwise.
+func wmsVersion(q url.Values) string {
+	if version := kvpGet(q, "VERSION"); version != "" && version < "1.3.0" {
+		return "1.1.1"
+	}
+	return "1.3.0"
+}
+
+// wmsCRSParam is the name of the coordinate system parameter, which was SRS
+// before 1.3.0.
+func wmsCRSParam(version string) string {
+	if version == "1.1.1" {
+		return "SRS"
+	}
+	return "CRS"
+}
+
+// parseWMSView reads the area and size of a GetMap request. WMS 1.3.0 uses
+// latitude, longitude axis order for EPSG:4326, and earlier versions
+// longitude, latitude.
+func parseWMSView(version, crs, bbox string, width, height int) (mapView, error) {
+	v := mapView{width: width, height: height}
+	values, err := parseFloats(bbox, "BBOX", 4)
+	if err != nil {
+		return v, err
+	}
+
+	switch strings.ToUpper(crs) {
+	case "EPSG:3857", "EPSG:900913":
+		v.toMercator = func(x, y float64) (float64, float64) { return x, y }
+		v.minX, v.minY, v.maxX, v.maxY = values[0], values[1], values[2], values[3]
+	case "EPSG:4326":
+		v.toMercator = geo.LonLatToMercator
+		if version == "1.1.1" {
+			v.minX, v.minY, v.maxX, v.maxY = values[0], values[1], values[2], values[3]
+		} else {
+			v.minY, v.minX, v.maxY, v.maxX = values[0], values[1], values[2], values[3]
+		}
+	case "CRS:84":
+		v.toMercator = geo.LonLatToMercator
+		v.minX, v.minY, v.maxX, v.maxY = values[0], values[1], values[2], values[3]
+	default:
+		return v, ErrBadQuery{query: wmsCRSParam(version), err: errors.New("expected EPSG:3857, EPSG:4326 or CRS:84")}
+	}
+	if v.minX >= v.maxX || v.minY >= v.maxY {
+		return v, ErrBadQuery{query: "BBOX", err: errors.New("empty bounding box")}
+	}
+	return v, nil
+}
+
+func parseWMSSize(raw, query string) (int, error) {
+	size, err := strconv.Atoi(raw)
+	if err != nil || size <= 0 || size > maxRenderSize {
+		return 0, ErrBadQuery{query: query, err: errors.Errorf("expected 1 to %d", maxRenderSize)}
+	}
+	return size, nil
+}
+
+// parseBGColor parses a WMS background color like "0xFF8800", defaulting to
+// white.
+func parseBGColor(raw string) (color.RGBA, error) {
+	if raw == "" {
+		return color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, nil
+	}
+	if len(raw) < 2 || !strings.EqualFold(raw[:2], "0x") {
+		return color.RGBA{}, errors.New("expected a hex color like 0xFF8800")
+	}
+	return parseTint(raw[2:])
+}
+
+func (s *Service) serveWMSMap(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	var layers []wmtsLayer
+	for _, identifier := range strings.Split(kvpGet(q, "LAYERS"), ",") {
+		layer, err := parseWMTSLayer(identifier)
+		if err != nil {
+			return s.writeWMSError(rw, r, ErrBadQuery{query: "LAYERS", err: err})
+		}
+		layers = append(layers, layer)
+	}
+
+	width, err := parseWMSSize(kvpGet(q, "WIDTH"), "WIDTH")
+	if err != nil {
+		return s.writeWMSError(rw, r, err)
+	}
+	height, err := parseWMSSize(kvpGet(q, "HEIGHT"), "HEIGHT")
+	if err != nil {
+		return s.writeWMSError(rw, r, err)
+	}
+	version := wmsVersion(q)
+	crs := kvpGet(q, wmsCRSParam(version))
+	view, err := parseWMSView(version, crs, kvpGet(q, "BBOX"), width, height)
+	if err != nil {
+		return s.writeWMSError(rw, r, err)
+	}
+
+	format := kvpGet(q, "FORMAT")
+	switch format {
+	case "":
+		format = "image/png"
+	case "image/png", "image/jpeg":
+	default:
+		return s.writeWMSError(rw, r, ErrBadQuery{query: "FORMAT", err: errors.New("expected image/png or image/jpeg")})
+	}
+	transparent := strings.EqualFold(kvpGet(q, "TRANSPARENT"), "TRUE") && format == "image/png"
+	background, err := parseBGColor(kvpGet(q, "BGCOLOR"))
+	if err != nil {
+		return s.writeWMSError(rw, r, ErrBadQuery{query: "BGCOLOR", err: err})
+	}
+
+	params := make([]Params, len(layers))
+	clients := make([]strava.Client, len(layers))
+	for i, layer := range layers {
+		params[i], err = s.layerParams(r, q, layer)
+		if err != nil {
+			return s.writeWMSError(rw, r, err)
+		}
+		clients[i], err = s.layerClient(layer.kind, params[i])
+		if err != nil {
+			return s.writeWMSError(rw, r, err)
+		}
+		params[i].z = view.zoom(params[i].token.maxZoom())
+		if err := params[i].token.authorize(layer.kind, params[i]); err != nil {
+			return s.writeWMSError(rw, r, err)
+		}
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	if !transparent {
+		draw.Draw(img, img.Rect, image.NewUniform(background), image.Point{}, draw.Src)
+	}
+	for i, layer := range layers {
+		p := params[i]
+		s.logger.Printf("wms %s %dx%d at zoom %d for token %s", layer.Identifier(), width, height, p.z, p.token.Name)
+		layerImg, err := s.renderView(r.Context(), layer.kind, clients[i], p, view, p.z)
+		var tooManyErr ErrTooManyTiles
+		if errors.As(err, &tooManyErr) {
+			return s.writeWMSError(rw, r, ErrBadQuery{query: "BBOX", err: err})
+		} else if err != nil {
+			return s.writeWMSError(rw, r, err)
+		}
+		drawOver(img, layerImg)
+	}
+
+	return writeImage(rw, img, format)
+}
+
+type wmsCapabilities struct {
+	URL    string
+	Layers []wmtsLayer
+}
+
+func (s *Service) serveWMSCapabilities(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	token, err := s.authenticate(q.Get("api_token"))
+	if err != nil {
+		return s.writeWMSError(rw, r, err)
+	}
+
+	caps := wmsCapabilities{URL: ogcURL(r, "/wms")}
+	for _, layer := range wmtsLayers() {
+		// only advertise layers the token can access
+		p, err := s.layerParams(r, q, layer)
+		if err != nil {
+			return s.writeWMSError(rw, r, err)
+		}
+		if _, err := s.layerClient(layer.kind, p); err != nil {
+			return s.writeWMSError(rw, r, err)
+		}
+		if token.authorize(layer.kind, p) == nil {
+			caps.Layers = append(caps.Layers, layer)
+		}
+	}
+
+	if wmsVersion(q) == "1.1.1" {
+		rw.Header().Set("Content-Type", "application/vnd.ogc.wms_xml")
+		rw.WriteHeader(http.StatusOK)
+		return wms111CapabilitiesTemplate.Execute(rw, caps)
+	}
+	rw.Header().Set("Content-Type", "text/xml")
+	rw.WriteHeader(http.StatusOK)
+	return wmsCapabilitiesTemplate.Execute(rw, caps)
+}
+
+// wmsServiceException is a WMS service exception report, for both 1.3.0 and
+// 1.1.1.
+type wmsServiceException struct {
+	XMLName   xml.Name `xml:"ServiceExceptionReport"`
+	Namespace string   `xml:"xmlns,attr,omitempty"`
+	Version   string   `xml:"version,attr"`
+	Exception struct {
+		Code    string `xml:"code,attr,omitempty"`
+		Message string `xml:",chardata"`
+	} `xml:"ServiceException"`
+}
+
+// wmsExceptionCode returns the WMS exception code for a query parameter
+// that's invalid, if there is one.
+func wmsExceptionCode(query string) string {
+	switch query {
+	case "LAYERS":
+		return "LayerNotDefined"
+	case "FORMAT":
+		return "InvalidFormat"
+	case "CRS":
+		return "InvalidCRS"
+	case "SRS":
+		return "InvalidSRS"
+	case "REQUEST":
+		return "OperationNotSupported"
+	}
+	return ""
+}
+
+// writeWMSError responds to an error with a service exception report, as WMS
+// clients expect rather than JSON or plain text. Errors not caused by the
+// request or Strava are logged and reported without details.
+func (s *Service) writeWMSError(rw http.ResponseWriter, r *http.Request, err error) error {
+	res, ok := classifyError(err)
+	if res.Status == 0 {
+		// nobody to respond to
+		return err
+	}
+	if !ok || res.Status >= 500 {
+		s.logger.Printf("error: %s, %v", r.URL.String(), err)
+	}
+
+	report := wmsServiceException{Version: wmsVersion(r.URL.Query())}
+	if report.Version == "1.3.0" {
+		report.Namespace = "http://www.opengis.net/ogc"
+	}
+	var badQuery ErrBadQuery
+	if errors.As(err, &badQuery) {
+		report.Exception.Code = wmsExceptionCode(badQuery.query)
+	}
+	report.Exception.Message = res.Message
+
+	res.setRetryAfter(rw)
+	rw.Header().Set("Content-Type", "application/vnd.ogc.se_xml")
+	rw.WriteHeader(res.Status)
+	rw.Write([]byte(xml.Header))
+	return xml.NewEncoder(rw).Encode(report)
+}
+
+var wmsCapabilitiesTemplate = template.Must(template.New("wms").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<WMS_Capabilities xmlns="http://www.opengis.net/wms" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.3.0">
+  <Service>
+    <Name>WMS</Name>
+    <Title>Strava heatmaps</Title>
+    <OnlineResource xlink:type="simple" xlink:href="{{html .URL}}"/>
+  </Service>
+  <Capability>
+    <Request>
+      <GetCapabilities>
+        <Format>text/xml</Format>
+        <DCPType><HTTP><Get><OnlineResource xlink:type="simple" xlink:href="{{html .URL}}"/></Get></HTTP></DCPType>
+      </GetCapabilities>
+      <GetMap>
+        <Format>image/png</Format>
+        <Format>image/jpeg</Format>
+        <DCPType><HTTP><Get><OnlineResource xlink:type="simple" xlink:href="{{html .URL}}"/></Get></HTTP></DCPType>
+      </GetMap>
+    </Request>
+    <Exception>
+      <Format>XML</Format>
+    </Exception>
+    <Layer>
+      <Title>Strava heatmaps</Title>
+      <CRS>EPSG:3857</CRS>
+      <CRS>EPSG:4326</CRS>
+      <CRS>CRS:84</CRS>
+      <EX_GeographicBoundingBox>
+        <westBoundLongitude>-180</westBoundLongitude>
+        <eastBoundLongitude>180</eastBoundLongitude>
+        <southBoundLatitude>-85.05112877980659</southBoundLatitude>
+        <northBoundLatitude>85.05112877980659</northBoundLatitude>
+      </EX_GeographicBoundingBox>
+      {{- range .Layers}}
+      <Layer queryable="0" opaque="0">
+        <Name>{{.Identifier}}</Name>
+        <Title>{{.Title}}</Title>
+      </Layer>
+      {{- end}}
+    </Layer>
+  </Capability>
+</WMS_Capabilities>
+`))
+
+var wms111CapabilitiesTemplate = template.Must(template.New("wms111").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<WMT_MS_Capabilities xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1.1">
+  <Service>
+    <Name>OGC:WMS</Name>
+    <Title>Strava heatmaps</Title>
+    <OnlineResource xlink:type="simple" xlink:href="{{html .URL}}"/>
+  </Service>
+  <Capability>
+    <Request>
+      <GetCapabilities>
+        <Format>application/vnd.ogc.wms_xml</Format>
+        <DCPType><HTTP><Get><OnlineResource xlink:type="simple" xlink:href="{{html .URL}}"/></Get></HTTP></DCPType>
+      </GetCapabilities>
+      <GetMap>
+        <Format>image/png</Format>
+        <Format>image/jpeg</Format>
+        <DCPType><HTTP><Get><OnlineResource xlink:type="simple" xlink:href="{{html .URL}}"/></Get></HTTP></DCPType>
+      </GetMap>
+    </Request>
+    <Exception>
+      <Format>application/vnd.ogc.se_xml</Format>
+    </Exception>
+    <Layer>
+      <Title>Strava heatmaps</Title>
+      <SRS>EPSG:3857</SRS>
+      <SRS>EPSG:900913</SRS>
+      <SRS>EPSG:4326</SRS>
+      <LatLonBoundingBox minx="-180" miny="-85.05112877980659" maxx="180" maxy="85.05112877980659"/>
+      {{- range .Layers}}
+      <Layer queryable="0" opaque="0">
+        <Name>{{.Identifier}}</Name>
+        <Title>{{.Title}}</Title>
+      </Layer>
+      {{- end}}
+    </Layer>
+  </Capability>
+</WMT_MS_Capabilities>
+`))
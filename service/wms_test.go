@@ -0,0 +1,308 @@
+package service
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseWMSView(t *testing.T) {
+	v, err := parseWMSView("1.3.0", "EPSG:4326", "50,19,51,20", 10, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{19, 50, 20, 51}, []float64{v.minX, v.minY, v.maxX, v.maxY})
+
+	v, err = parseWMSView("1.1.1", "EPSG:4326", "19,50,20,51", 10, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{19, 50, 20, 51}, []float64{v.minX, v.minY, v.maxX, v.maxY})
+
+	v, err = parseWMSView("1.3.0", "EPSG:3857", "-1000,-1000,1000,1000", 10, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 200.0, v.resolution())
+
+	_, err = parseWMSView("1.3.0", "EPSG:27700", "0,0,1,1", 10, 10)
+	assert.Error(t, err)
+	_, err = parseWMSView("1.3.0", "EPSG:3857", "1,0,0,1", 10, 10)
+	assert.Error(t, err)
+}
+
+func TestServeWMS_GetMap(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	var tile bytes.Buffer
+	require.NoError(t, png.Encode(&tile, solidTile(stravaTileSize, red)))
+
+	var requested []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		if r.URL.Path != "/identified/globalheat/all/red/13/4548/2776@2x.png" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+		rw.Write(tile.Bytes())
+	}))
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	getMap := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/wms?SERVICE=WMS&REQUEST=GetMap&LAYERS=global-all-red&STYLES=&"+query, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeWMS(w, req))
+		return w
+	}
+
+	// exactly the tile, in web mercator
+	minX, maxY := geo.TileToMercator(4548, 2776, 13)
+	maxX, minY := geo.TileToMercator(4549, 2777, 13)
+	w := getMap(url.Values{
+		"VERSION":     []string{"1.3.0"},
+		"CRS":         []string{"EPSG:3857"},
+		"BBOX":        []string{fmt.Sprintf("%f,%f,%f,%f", minX, minY, maxX, maxY)},
+		"WIDTH":       []string{"512"},
+		"HEIGHT":      []string{"512"},
+		"FORMAT":      []string{"image/png"},
+		"TRANSPARENT": []string{"TRUE"},
+	}.Encode())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, []string{"/identified/globalheat/all/red/13/4548/2776@2x.png"}, requested)
+	img, err := png.Decode(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, image.Rect(0, 0, 512, 512), img.Bounds())
+	assert.Equal(t, red, color.RGBAModel.Convert(img.At(256, 256)))
+
+	// the tile and its eastern neighbor, in lat,lon order
+	requested = nil
+	west, north := geo.TileToLonLat(4548, 2776, 13)
+	east, south := geo.TileToLonLat(4550, 2777, 13)
+	w = getMap(url.Values{
+		"VERSION": []string{"1.3.0"},
+		"CRS":     []string{"EPSG:4326"},
+		"BBOX":    []string{fmt.Sprintf("%f,%f,%f,%f", south, west, north, east)},
+		"WIDTH":   []string{"1024"},
+		"HEIGHT":  []string{"512"},
+		"FORMAT":  []string{"image/jpeg"},
+	}.Encode())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "image/jpeg", w.Header().Get("Content-Type"))
+	assert.ElementsMatch(t, []string{
+		"/identified/globalheat/all/red/13/4548/2776@2x.png",
+		"/identified/globalheat/all/red/13/4549/2776@2x.png",
+	}, requested)
+	img, err = jpeg.Decode(w.Body)
+	require.NoError(t, err)
+	r, g, _, _ := img.At(256, 256).RGBA()
+	assert.Greater(t, r, uint32(0xf000))
+	assert.Less(t, g, uint32(0x1000))
+	r, g, _, _ = img.At(768, 256).RGBA()
+	assert.Greater(t, r, uint32(0xf000))
+	assert.Greater(t, g, uint32(0xf000))
+
+	for _, query := range []string{
+		"CRS=EPSG:3857&BBOX=0,0,1000,1000&WIDTH=0&HEIGHT=10",
+		"CRS=EPSG:3857&BBOX=0,0,1000,1000&WIDTH=10&HEIGHT=10&FORMAT=image/gif",
+		"CRS=EPSG:3857&BBOX=0,0,1000&WIDTH=10&HEIGHT=10",
+		"CRS=EPSG:3857&BBOX=0,0,1000,1000&WIDTH=10&HEIGHT=10&BGCOLOR=red",
+		// twice around the world at the minimum zoom is too many tiles
+		"CRS=EPSG:3857&BBOX=-40000000,-20000000,40000000,20000000&WIDTH=100&HEIGHT=100",
+	} {
+		w := getMap(query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		assert.Equal(t, "application/vnd.ogc.se_xml", w.Header().Get("Content-Type"), query)
+	}
+}
+
+func TestServeWMS_GetMapUnderzoom(t *testing.T) {
+	red := color.RGBA{R: 0xff, A: 0xff}
+	var tile bytes.Buffer
+	require.NoError(t, png.Encode(&tile, solidTile(stravaTileSize, red)))
+
+	// only one z6 tile has lines
+	var requested []string
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		if r.URL.Path != "/identified/globalheat/all/red/6/10/24@2x.png" {
+			rw.WriteHeader(http.StatusNotFound)
+			return
+		}
+		rw.Write(tile.Bytes())
+	}))
+	defer mockServer.Close()
+
+	stravaClient := mockStravaClient{}
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	// an overview exactly covering a z4 tile is drawn from its z6 descendants
+	minX, maxY := geo.TileToMercator(2, 6, 4)
+	maxX, minY := geo.TileToMercator(3, 7, 4)
+	req := httptest.NewRequest("GET", "https://example.com/wms?"+url.Values{
+		"SERVICE":     []string{"WMS"},
+		"REQUEST":     []string{"GetMap"},
+		"VERSION":     []string{"1.3.0"},
+		"LAYERS":      []string{"global-all-red"},
+		"STYLES":      []string{""},
+		"CRS":         []string{"EPSG:3857"},
+		"BBOX":        []string{fmt.Sprintf("%f,%f,%f,%f", minX, minY, maxX, maxY)},
+		"WIDTH":       []string{"512"},
+		"HEIGHT":      []string{"512"},
+		"FORMAT":      []string{"image/png"},
+		"TRANSPARENT": []string{"TRUE"},
+	}.Encode(), nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeWMS(w, req))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, requested, 16)
+	img, err := png.Decode(w.Body)
+	require.NoError(t, err)
+	assert.Equal(t, red, color.RGBAModel.Convert(img.At(300, 100)))
+	assert.Equal(t, color.RGBA{}, color.RGBAModel.Convert(img.At(100, 100)))
+	assert.Equal(t, color.RGBA{}, color.RGBAModel.Convert(img.At(300, 300)))
+}
+
+func TestServeWMS_GetMapAthlete(t *testing.T) {
+	var tile bytes.Buffer
+	require.NoError(t, png.Encode(&tile, solidTile(stravaTileSize, color.RGBA{R: 0xff, A: 0xff})))
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Contains(t, r.URL.Path, "/tiles/45654/red/13/")
+		rw.Write(tile.Bytes())
+	}))
+	defer mockServer.Close()
+
+	aliceClient := mockStravaClient{}
+	aliceClient.On("HttpClient").Return(mockServer.Client())
+	aliceClient.On("AthleteID").Return("45654", nil)
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		athletes:     map[string]strava.Client{"alice": &aliceClient},
+		logger:       log.Default(),
+		tokens: []Token{
+			{Name: "alice", Token: "alice-token", Athletes: []string{"alice"}},
+		},
+
+		personalHeatmapDomain: mockServer.URL,
+	}
+
+	minX, maxY := geo.TileToMercator(4548, 2776, 13)
+	maxX, minY := geo.TileToMercator(4549, 2777, 13)
+	getMap := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://example.com/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=personal-all-red&CRS=EPSG:3857&WIDTH=512&HEIGHT=512&"+query+"&BBOX="+fmt.Sprintf("%f,%f,%f,%f", minX, minY, maxX, maxY), nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeWMS(w, req))
+		return w
+	}
+
+	// personal layers are for the athlete parameter's account
+	w := getMap("api_token=alice-token&athlete=alice")
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	// the token doesn't allow the default athlete
+	w = getMap("api_token=alice-token")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	w = getMap("api_token=alice-token&athlete=bob")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestServeWMS_Exception(t *testing.T) {
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+	}
+
+	var report struct {
+		XMLName   xml.Name
+		Version   string `xml:"version,attr"`
+		Exception struct {
+			Code    string `xml:"code,attr"`
+			Message string `xml:",chardata"`
+		} `xml:"ServiceException"`
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.3.0&LAYERS=nope", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeWMS(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "application/vnd.ogc.se_xml", w.Header().Get("Content-Type"))
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, xml.Name{Space: "http://www.opengis.net/ogc", Local: "ServiceExceptionReport"}, report.XMLName)
+	assert.Equal(t, "1.3.0", report.Version)
+	assert.Equal(t, "LayerNotDefined", report.Exception.Code)
+	assert.NotEmpty(t, report.Exception.Message)
+
+	req = httptest.NewRequest("GET", "https://example.com/wms?SERVICE=WMS&REQUEST=GetMap&VERSION=1.1.1&LAYERS=global-all-red&SRS=EPSG:27700&BBOX=0,0,1,1&WIDTH=10&HEIGHT=10", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeWMS(w, req))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, "1.1.1", report.Version)
+	assert.Equal(t, "InvalidSRS", report.Exception.Code)
+
+	// unauthorized requests are reported the same way
+	s.apiToken = "secret"
+	req = httptest.NewRequest("GET", "https://example.com/wms?SERVICE=WMS&REQUEST=GetCapabilities", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeWMS(w, req))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "application/vnd.ogc.se_xml", w.Header().Get("Content-Type"))
+}
+
+func TestServeWMS_GetCapabilities(t *testing.T) {
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/wms?service=WMS&request=GetCapabilities", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeWMS(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `xlink:href="https://example.com/wms?"`)
+	assert.Contains(t, w.Body.String(), "<Name>personal-run-red</Name>")
+	assert.Contains(t, w.Body.String(), "<Name>global-winter-purple</Name>")
+	assert.Contains(t, w.Body.String(), "<CRS>EPSG:4326</CRS>")
+
+	// older clients get a 1.1.1 document
+	req = httptest.NewRequest("GET", "https://example.com/wms?service=WMS&request=GetCapabilities&version=1.1.1", nil)
+	w = httptest.NewRecorder()
+	require.NoError(t, s.ServeWMS(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/vnd.ogc.wms_xml", w.Header().Get("Content-Type"))
+	var caps struct {
+		XMLName xml.Name
+		Version string   `xml:"version,attr"`
+		SRS     []string `xml:"Capability>Layer>SRS"`
+		Layers  []string `xml:"Capability>Layer>Layer>Name"`
+	}
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &caps))
+	assert.Equal(t, "WMT_MS_Capabilities", caps.XMLName.Local)
+	assert.Equal(t, "1.1.1", caps.Version)
+	assert.Contains(t, caps.SRS, "EPSG:4326")
+	assert.Contains(t, caps.Layers, "personal-run-red")
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/apexskier/strava-tile-proxy/geo"
+	"github.com/apexskier/strava-tile-proxy/strava"
+	"github.com/pkg/errors"
+)
+
+// wmtsTileMatrixSet returns the identifier of the tile matrix set tiles of
+// tileSize are served in. 256px tiles match the well-known
+// GoogleMapsCompatible scale set, larger tiles need their own.
+func wmtsTileMatrixSet(tileSize int) string {
+	if tileSize == smallTileSize {
+		return "GoogleMapsCompatible"
+	}
+	return fmt.Sprintf("GoogleMapsCompatible%d", tileSize)
+}
+
+// parseWMTSTileMatrixSet returns the tile size of a tile matrix set.
+func parseWMTSTileMatrixSet(identifier string) (int, error) {
+	for _, size := range []int{smallTileSize, stravaTileSize} {
+		if identifier == wmtsTileMatrixSet(size) {
+			return size, nil
+		}
+	}
+	return 0, errors.Errorf("expected %s or %s", wmtsTileMatrixSet(smallTileSize), wmtsTileMatrixSet(stravaTileSize))
+}
+
+// wmtsLayer is a heatmap layer advertised over WMTS or WMS, identified as
+// kind-group-color, e.g. "global-winter-purple".
+type wmtsLayer struct {
+	kind  Kind
+	group strava.SportGroup
+	color strava.Heat
+}
+
+func (l wmtsLayer) Identifier() string {
+	return fmt.Sprintf("%s-%s-%s", l.kind, l.group, l.color)
+}
+
+func (l wmtsLayer) Title() string {
+	return fmt.Sprintf("Strava %s heatmap (%s, %s)", l.kind, l.group, l.color)
+}
+
+// sports returns the sports parameter that selects the layer's sport group.
+func (l wmtsLayer) sports() string {
+	if l.kind == KindGlobal {
+		return string(l.group)
+	}
+	return l.group.PersonalFilter()
+}
+
+func parseWMTSLayer(identifier string) (wmtsLayer, error) {
+	parts := strings.Split(identifier, "-")
+	if len(parts) != 3 {
+		return wmtsLayer{}, errors.New("unknown layer")
+	}
+	layer := wmtsLayer{
+		kind:  Kind(parts[0]),
+		group: strava.SportGroup(parts[1]),
+		color: strava.Heat(parts[2]),
+	}
+	for _, known := range wmtsLayers() {
+		if layer == known {
+			return layer, nil
+		}
+	}
+	return wmtsLayer{}, errors.New("unknown layer")
+}
+
+// wmtsLayers returns every heatmap layer.
+func wmtsLayers() []wmtsLayer {
+	var layers []wmtsLayer
+	for _, kind := range []Kind{KindPersonal, KindGlobal} {
+		for _, group := range strava.SportGroups {
+			for _, color := range strava.Heats {
+				layers = append(layers, wmtsLayer{kind: kind, group: group, color: color})
+			}
+		}
+	}
+	return layers
+}
+
+// kvpGet returns an OGC key-value-pair parameter, whose names are case
+// insensitive.
+func kvpGet(q url.Values, key string) string {
+	for k, values := range q {
+		if strings.EqualFold(k, key) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// layerParams returns the parameters for tiles in an OGC layer, combining the
+// layer's sports and color with any other layer parameters in q. Personal
+// layers are for the athlete named by the athlete parameter, or the default
+// athlete.
+func (s *Service) layerParams(r *http.Request, q url.Values, layer wmtsLayer) (Params, error) {
+	layerQ := url.Values{}
+	for _, key := range layerQueryParams {
+		if values, ok := q[key]; ok {
+			layerQ[key] = values
+		}
+	}
+	layerQ.Set("color", string(layer.color))
+	layerQ.Set("sports", layer.sports())
+	p, err := s.extractQuery(layer.kind, r, layerQ)
+	if err != nil {
+		return p, err
+	}
+	if layer.kind == KindPersonal {
+		p.athlete = kvpGet(q, "athlete")
+	}
+	return p, nil
+}
+
+// layerClient returns the Strava client for an OGC layer's tiles.
+func (s *Service) layerClient(kind Kind, p Params) (strava.Client, error) {
+	if kind != KindPersonal {
+		return s.stravaClient, nil
+	}
+	stravaClient, ok := s.athleteClient(p.athlete)
+	if !ok {
+		return nil, ErrBadQuery{query: "athlete", err: errors.Errorf("unknown athlete %s", p.athlete)}
+	}
+	return stravaClient, nil
+}
+
+// ServeWMTS implements the KVP binding of OGC WMTS 1.0.0, for GIS tools that
+// don't support XYZ tiles.
+func (s *Service) ServeWMTS(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	if service := kvpGet(q, "SERVICE"); service != "" && !strings.EqualFold(service, "WMTS") {
+		return s.writeError(rw, r, ErrBadQuery{query: "SERVICE", err: errors.New("expected WMTS")})
+	}
+	switch strings.ToLower(kvpGet(q, "REQUEST")) {
+	case "getcapabilities":
+		return s.serveWMTSCapabilities(rw, r)
+	case "gettile":
+		return s.serveWMTSTile(rw, r)
+	}
+	return s.writeError(rw, r, ErrBadQuery{query: "REQUEST", err: errors.New("expected GetCapabilities or GetTile")})
+}
+
+func (s *Service) serveWMTSTile(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	layer, err := parseWMTSLayer(kvpGet(q, "LAYER"))
+	if err != nil {
+		return s.writeError(rw, r, ErrBadQuery{query: "LAYER", err: err})
+	}
+	tileMatrixSet := kvpGet(q, "TILEMATRIXSET")
+	tileSize, err := parseWMTSTileMatrixSet(tileMatrixSet)
+	if err != nil {
+		return s.writeError(rw, r, ErrBadQuery{query: "TILEMATRIXSET", err: err})
+	}
+	if format := kvpGet(q, "FORMAT"); format != "" && format != "image/png" {
+		return s.writeError(rw, r, ErrBadQuery{query: "FORMAT", err: errors.New("expected image/png")})
+	}
+
+	p, err := s.layerParams(r, q, layer)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	if q.Has("tile_size") && tileSize != p.tileSize {
+		return s.writeError(rw, r, ErrBadQuery{query: "tile_size", err: errors.Errorf("doesn't match %s", tileMatrixSet)})
+	}
+	p.tileSize = tileSize
+	p.z, err = strconv.ParseUint(kvpGet(q, "TILEMATRIX"), 10, 64)
+	if err != nil {
+		return s.writeError(rw, r, ErrBadCoord{coord: "TILEMATRIX"})
+	}
+	p.y, err = strconv.ParseUint(kvpGet(q, "TILEROW"), 10, 64)
+	if err != nil {
+		return s.writeError(rw, r, ErrBadCoord{coord: "TILEROW"})
+	}
+	p.x, err = strconv.ParseUint(kvpGet(q, "TILECOL"), 10, 64)
+	if err != nil {
+		return s.writeError(rw, r, ErrBadCoord{coord: "TILECOL"})
+	}
+	switch checkTile(p.z, p.x, p.y) {
+	case "z":
+		return s.writeError(rw, r, ErrBadCoord{coord: "TILEMATRIX"})
+	case "x":
+		return s.writeError(rw, r, ErrBadCoord{coord: "TILECOL"})
+	case "y":
+		return s.writeError(rw, r, ErrBadCoord{coord: "TILEROW"})
+	}
+	if err := p.token.authorize(layer.kind, p); err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	stravaClient, err := s.layerClient(layer.kind, p)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	s.logger.Printf("wmts %s tile %d/%d/%d for token %s", layer.Identifier(), p.z, p.x, p.y, p.token.Name)
+
+	return s.serveTile(rw, r, layer.kind, stravaClient, p)
+}
+
+type wmtsTileMatrix struct {
+	Identifier       uint64
+	ScaleDenominator float64
+	MatrixSize       uint64
+}
+
+func (m wmtsTileMatrix) MaxIndex() uint64 {
+	return m.MatrixSize - 1
+}
+
+type wmtsCapabilities struct {
+	URL           string
+	Operations    []string
+	Layers        []wmtsLayer
+	TileMatrixSet string
+	TileSize      int
+	MinZoom       uint64
+	MaxZoom       uint64
+	TileMatrices  []wmtsTileMatrix
+}
+
+func (s *Service) serveWMTSCapabilities(rw http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	token, err := s.authenticate(q.Get("api_token"))
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+	tileSize, err := parseTileSize(q)
+	if err != nil {
+		return s.writeError(rw, r, err)
+	}
+
+	caps := wmtsCapabilities{
+		URL:           ogcURL(r, "/wmts"),
+		Operations:    []string{"GetCapabilities", "GetTile"},
+		TileMatrixSet: wmtsTileMatrixSet(tileSize),
+		TileSize:      tileSize,
+		MinZoom:       minUnderzoom,
+		MaxZoom:       token.maxTileZoom(),
+	}
+	for _, layer := range wmtsLayers() {
+		// only advertise layers the token can access
+		p, err := s.layerParams(r, q, layer)
+		if err != nil {
+			return s.writeError(rw, r, err)
+		}
+		if token.authorize(layer.kind, p) == nil {
+			caps.Layers = append(caps.Layers, layer)
+		}
+	}
+	for z := uint64(0); z <= caps.MaxZoom; z++ {
+		caps.TileMatrices = append(caps.TileMatrices, wmtsTileMatrix{
+			Identifier:       z,
+			ScaleDenominator: scaleDenominator(z, caps.TileSize),
+			MatrixSize:       1 << z,
+		})
+	}
+
+	rw.Header().Set("Content-Type", "application/xml")
+	rw.WriteHeader(http.StatusOK)
+	return wmtsCapabilitiesTemplate.Execute(rw, caps)
+}
+
+// scaleDenominator returns the OGC scale denominator of a web mercator zoom
+// level, which assumes 0.28mm pixels.
+func scaleDenominator(z uint64, tileSize int) float64 {
+	metersPerPixel := 2 * geo.MercatorExtent / float64(tileSize) / math.Exp2(float64(z))
+	return metersPerPixel / 0.00028
+}
+
+// ogcURL returns the URL for KVP requests to path, ready to have more
+// parameters appended, carrying through the layer parameters of the current
+// request.
+func ogcURL(r *http.Request, path string) string {
+	query := layerQuery(r.URL.Query())
+	if query == "" {
+		return baseURL(r) + path + "?"
+	}
+	return baseURL(r) + path + query + "&"
+}
+
+var wmtsCapabilitiesTemplate = template.Must(template.New("wmts").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<Capabilities xmlns="http://www.opengis.net/wmts/1.0" xmlns:ows="http://www.opengis.net/ows/1.1" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.0.0">
+  <ows:ServiceIdentification>
+    <ows:Title>Strava heatmaps</ows:Title>
+    <ows:ServiceType>OGC WMTS</ows:ServiceType>
+    <ows:ServiceTypeVersion>1.0.0</ows:ServiceTypeVersion>
+  </ows:ServiceIdentification>
+  <ows:OperationsMetadata>
+    {{- range .Operations}}
+    <ows:Operation name="{{.}}">
+      <ows:DCP>
+        <ows:HTTP>
+          <ows:Get xlink:href="{{html $.URL}}">
+            <ows:Constraint name="GetEncoding">
+              <ows:AllowedValues>
+                <ows:Value>KVP</ows:Value>
+              </ows:AllowedValues>
+            </ows:Constraint>
+          </ows:Get>
+        </ows:HTTP>
+      </ows:DCP>
+    </ows:Operation>
+    {{- end}}
+  </ows:OperationsMetadata>
+  <Contents>
+    {{- range .Layers}}
+    <Layer>
+      <ows:Title>{{.Title}}</ows:Title>
+      <ows:WGS84BoundingBox>
+        <ows:LowerCorner>-180 -85.05112877980659</ows:LowerCorner>
+        <ows:UpperCorner>180 85.05112877980659</ows:UpperCorner>
+      </ows:WGS84BoundingBox>
+      <ows:Identifier>{{.Identifier}}</ows:Identifier>
+      <Style isDefault="true">
+        <ows:Identifier>default</ows:Identifier>
+      </Style>
+      <Format>image/png</Format>
+      <TileMatrixSetLink>
+        <TileMatrixSet>{{$.TileMatrixSet}}</TileMatrixSet>
+        <TileMatrixSetLimits>
+          {{- range $.TileMatrices}}{{if ge .Identifier $.MinZoom}}
+          <TileMatrixLimits>
+            <TileMatrix>{{.Identifier}}</TileMatrix>
+            <MinTileRow>0</MinTileRow>
+            <MaxTileRow>{{.MaxIndex}}</MaxTileRow>
+            <MinTileCol>0</MinTileCol>
+            <MaxTileCol>{{.MaxIndex}}</MaxTileCol>
+          </TileMatrixLimits>
+          {{- end}}{{end}}
+        </TileMatrixSetLimits>
+      </TileMatrixSetLink>
+    </Layer>
+    {{- end}}
+    <TileMatrixSet>
+      <ows:Identifier>{{.TileMatrixSet}}</ows:Identifier>
+      <ows:SupportedCRS>urn:ogc:def:crs:EPSG::3857</ows:SupportedCRS>
+      {{- if eq .TileSize 256}}
+      <WellKnownScaleSet>urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible</WellKnownScaleSet>
+      {{- end}}
+      {{- range .TileMatrices}}
+      <TileMatrix>
+        <ows:Identifier>{{.Identifier}}</ows:Identifier>
+        <ScaleDenominator>{{.ScaleDenominator}}</ScaleDenominator>
+        <TopLeftCorner>-20037508.342789244 20037508.342789244</TopLeftCorner>
+        <TileWidth>{{$.TileSize}}</TileWidth>
+        <TileHeight>{{$.TileSize}}</TileHeight>
+        <MatrixWidth>{{.MatrixSize}}</MatrixWidth>
+        <MatrixHeight>{{.MatrixSize}}</MatrixHeight>
+      </TileMatrix>
+      {{- end}}
+    </TileMatrixSet>
+  </Contents>
+</Capabilities>
+`))
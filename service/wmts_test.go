@@ -0,0 +1,106 @@
+package service
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServeWMTS_GetCapabilities(t *testing.T) {
+	s := Service{
+		stravaClient: &mockStravaClient{},
+		logger:       log.Default(),
+		tokens: []Token{
+			{Name: "friends", Token: "shared", Endpoints: []Kind{KindGlobal}},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/wmts?api_token=shared&service=WMTS&request=GetCapabilities", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeWMTS(w, req))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var caps struct {
+		Operations []struct {
+			Name string `xml:"name,attr"`
+			Href struct {
+				Value string `xml:"href,attr"`
+			} `xml:"DCP>HTTP>Get"`
+		} `xml:"OperationsMetadata>Operation"`
+		Layers []struct {
+			Identifier    string `xml:"Identifier"`
+			TileMatrixSet string `xml:"TileMatrixSetLink>TileMatrixSet"`
+		} `xml:"Contents>Layer"`
+		TileMatrixSet     string `xml:"Contents>TileMatrixSet>Identifier"`
+		WellKnownScaleSet string `xml:"Contents>TileMatrixSet>WellKnownScaleSet"`
+		TileMatrices      []struct {
+			Identifier       string  `xml:"Identifier"`
+			ScaleDenominator float64 `xml:"ScaleDenominator"`
+			TileWidth        int     `xml:"TileWidth"`
+		} `xml:"Contents>TileMatrixSet>TileMatrix"`
+	}
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &caps))
+
+	require.Len(t, caps.Operations, 2)
+	assert.Equal(t, "https://example.com/wmts?api_token=shared&", caps.Operations[1].Href.Value)
+
+	// Only global layers are allowed for this token.
+	assert.Len(t, caps.Layers, 5*7)
+	assert.Equal(t, "global-all-orange", caps.Layers[0].Identifier)
+
+	// 512px tiles don't match the well-known scale set
+	assert.Equal(t, "GoogleMapsCompatible512", caps.TileMatrixSet)
+	assert.Empty(t, caps.WellKnownScaleSet)
+	assert.Equal(t, "GoogleMapsCompatible512", caps.Layers[0].TileMatrixSet)
+
+	require.Len(t, caps.TileMatrices, 19)
+	assert.Equal(t, "0", caps.TileMatrices[0].Identifier)
+	assert.Equal(t, 512, caps.TileMatrices[0].TileWidth)
+	assert.InDelta(t, 559082264.0287178/2, caps.TileMatrices[0].ScaleDenominator, 0.01)
+}
+
+func TestServeWMTS_GetTile(t *testing.T) {
+	requestCount := 0
+	mockServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/identified/globalheat/winter/purple/10/2/3@2x.png", r.URL.Path)
+		rw.WriteHeader(http.StatusOK)
+		requestCount++
+	}))
+
+	stravaClient := mockStravaClient{}
+	defer stravaClient.AssertExpectations(t)
+	stravaClient.On("HttpClient").Return(mockServer.Client())
+
+	s := Service{
+		stravaClient: &stravaClient,
+		logger:       log.Default(),
+
+		globalHeatmapDomain: mockServer.URL,
+	}
+
+	req := httptest.NewRequest("GET", "https://example.com/wmts?SERVICE=WMTS&REQUEST=GetTile&VERSION=1.0.0&LAYER=global-winter-purple&STYLE=default&FORMAT=image/png&TILEMATRIXSET=GoogleMapsCompatible512&TILEMATRIX=10&TILEROW=3&TILECOL=2", nil)
+	w := httptest.NewRecorder()
+	require.NoError(t, s.ServeWMTS(w, req))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 1, requestCount)
+
+	for _, query := range []string{
+		"SERVICE=WMS&REQUEST=GetTile",
+		"REQUEST=DescribeDomains",
+		"REQUEST=GetTile&LAYER=global-winter-garbage&TILEMATRIXSET=GoogleMapsCompatible512&TILEMATRIX=10&TILEROW=3&TILECOL=2",
+		"REQUEST=GetTile&LAYER=global-winter-purple&TILEMATRIXSET=EPSG:4326&TILEMATRIX=10&TILEROW=3&TILECOL=2",
+		"REQUEST=GetTile&LAYER=global-winter-purple&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=10&TILEROW=3&TILECOL=2&tile_size=512",
+		"REQUEST=GetTile&LAYER=global-winter-purple&TILEMATRIXSET=GoogleMapsCompatible512&TILEMATRIX=10&TILEROW=x&TILECOL=2",
+		"REQUEST=GetTile&LAYER=global-winter-purple&TILEMATRIXSET=GoogleMapsCompatible512&TILEMATRIX=2&TILEROW=3&TILECOL=2",
+	} {
+		req := httptest.NewRequest("GET", "https://example.com/wmts?"+query, nil)
+		w := httptest.NewRecorder()
+		require.NoError(t, s.ServeWMTS(w, req))
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
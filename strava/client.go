@@ -1,6 +1,7 @@
 package strava
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"net/http"
@@ -14,64 +15,170 @@ import (
 	"github.com/pkg/errors"
 )
 
-type stravaTransport struct{}
+type stravaTransport struct {
+	// limiters throttle requests to each host, by hostname
+	limiters map[string]*Limiter
+}
 
+// RoundTrip makes a request once the host's limiter allows it. Requests
+// waiting for the limiter give up if their context is done.
 func (t *stravaTransport) RoundTrip(req *http.Request) (*http.Response, error) {
 	req.Header.Add("User-Agent", "strava-tile-proxy")
-	return http.DefaultTransport.RoundTrip(req)
+	limiter, ok := t.limiters[req.URL.Hostname()]
+	if !ok {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	release, err := limiter.acquire(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	res, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &releaseBody{ReadCloser: res.Body, release: release}
+	return res, nil
 }
 
+// ErrSessionExpired means Strava no longer accepts the session cookies, and
+// cmd/auth needs to be run again.
+var ErrSessionExpired = errors.New("strava session expired")
+
+// AuthState describes whether the session cookies are known to work.
+type AuthState string
+
+const (
+	// AuthStateUnknown means the session hasn't been used to refresh
+	// CloudFront cookies yet.
+	AuthStateUnknown AuthState = "unknown"
+	AuthStateOK      AuthState = "ok"
+	AuthStateExpired AuthState = "expired"
+)
+
 type Client interface {
 	RefreshCloudFrontCookies() error
+	AuthState() AuthState
 	CloudFrontExpiresAt() time.Time
 	AthleteID() (string, error)
 	HttpClient() *http.Client
+	SetSession(session Session) error
+	// Close stops refreshing cookies in the background.
+	Close() error
 }
 
 // client holds an http.Client that maintains Strava auth cookies.
 type client struct {
 	stravaUrl     string
 	httpClient    *http.Client
+	transport     *stravaTransport
 	rememberToken string
 	stravaSession string
+	sessionLock   sync.Mutex
 
 	claimedRefresh bool
 	claimLock      sync.Mutex
 	refreshLock    sync.Mutex
+	// refreshErr is the result of the last refresh, shared with callers whose
+	// refresh was coalesced into it
+	refreshErr error
+
+	authState     AuthState
+	authStateLock sync.Mutex
+
+	refreshMargin time.Duration
+	// cookiesChanged wakes the background refresher when cookies are
+	// refreshed or replaced
+	cookiesChanged chan struct{}
+	// stopRefreshing ends the background refresher
+	stopRefreshing context.CancelFunc
 }
 
-func NewClient(rememberToken, stravaSession string) (Client, error) {
+// DefaultRefreshMargin is how long before CloudFront cookies expire they're
+// proactively refreshed.
+const DefaultRefreshMargin = 10 * time.Minute
+
+// Option configures a Client.
+type Option func(*client)
+
+// WithRefreshMargin sets how long before CloudFront cookies expire they're
+// proactively refreshed.
+func WithRefreshMargin(margin time.Duration) Option {
+	return func(sc *client) {
+		sc.refreshMargin = margin
+	}
+}
+
+// WithHostLimiter throttles requests to a host, e.g.
+// "content-a.strava.com". The limiter can be shared between clients.
+func WithHostLimiter(host string, limiter *Limiter) Option {
+	return func(sc *client) {
+		sc.transport.limiters[host] = limiter
+	}
+}
+
+func NewClient(rememberToken, stravaSession string, opts ...Option) (Client, error) {
 	jar, err := cookiejar.New(nil)
 	if err != nil {
 		return nil, err
 	}
+	transport := &stravaTransport{limiters: map[string]*Limiter{}}
 	sc := &client{
 		stravaUrl:     StravaDomain,
 		rememberToken: rememberToken,
 		stravaSession: stravaSession,
+		authState:     AuthStateUnknown,
+		transport:     transport,
 		httpClient: &http.Client{
-			Transport: &stravaTransport{},
+			Transport: transport,
 			Jar:       jar,
 		},
+		refreshMargin:  DefaultRefreshMargin,
+		cookiesChanged: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(sc)
 	}
 	if err := sc.setSessionCookies(); err != nil {
 		return nil, err
 	}
-	go func() {
-		ticker := time.NewTicker(24 * time.Hour)
-		defer ticker.Stop()
-		for range ticker.C {
-			sc.setSessionCookies() //nolint:errcheck
-		}
-	}()
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.stopRefreshing = cancel
+	go sc.refreshLoop(ctx)
 	return sc, nil
 }
 
+// Close stops the background refresher. Requests can still be made, but
+// cookies are then only refreshed after being rejected.
+func (sc *client) Close() error {
+	if sc.stopRefreshing != nil {
+		sc.stopRefreshing()
+	}
+	return nil
+}
+
+// SetSession replaces the session cookies used to authenticate with Strava,
+// e.g. after cmd/auth has been run again.
+func (sc *client) SetSession(session Session) error {
+	sc.sessionLock.Lock()
+	sc.rememberToken = session.RememberToken
+	sc.stravaSession = session.Session
+	sc.sessionLock.Unlock()
+	sc.setAuthState(AuthStateUnknown)
+	if err := sc.setSessionCookies(); err != nil {
+		return err
+	}
+	sc.notifyCookiesChanged()
+	return nil
+}
+
 func (sc *client) setSessionCookies() error {
 	u, err := url.Parse(sc.stravaUrl)
 	if err != nil {
 		return err
 	}
+	sc.sessionLock.Lock()
+	defer sc.sessionLock.Unlock()
 	expires := time.Now().Add(365 * 24 * time.Hour)
 	sc.httpClient.Jar.SetCookies(u, []*http.Cookie{
 		{
@@ -95,12 +202,17 @@ func (sc *client) setSessionCookies() error {
 	return nil
 }
 
+// claimRefresh reports whether this caller should perform the refresh. The
+// claimer holds refreshLock until it's done, so other callers wait for it.
 func (sc *client) claimRefresh() bool {
 	sc.claimLock.Lock()
-	claimed := !sc.claimedRefresh
+	defer sc.claimLock.Unlock()
+	if sc.claimedRefresh {
+		return false
+	}
 	sc.claimedRefresh = true
-	sc.claimLock.Unlock()
-	return claimed
+	sc.refreshLock.Lock()
+	return true
 }
 
 func (sc *client) unclaimRefresh() {
@@ -111,23 +223,61 @@ func (sc *client) unclaimRefresh() {
 
 // RefreshCloudFrontCookies makes an authenticated request to Strava so it
 // issues fresh CloudFront signed cookies. Concurrent callers are coalesced
-// into a single actual HTTP request.
+// into a single actual HTTP request. If Strava redirects to its login page,
+// ErrSessionExpired is returned.
 func (sc *client) RefreshCloudFrontCookies() error {
-	thisClaimsRefresh := sc.claimRefresh()
+	if sc.claimRefresh() {
+		sc.refreshErr = sc.refresh()
+		err := sc.refreshErr
+		sc.unclaimRefresh()
+		sc.refreshLock.Unlock()
+		sc.notifyCookiesChanged()
+		return err
+	}
+
 	sc.refreshLock.Lock()
 	defer sc.refreshLock.Unlock()
+	return sc.refreshErr
+}
 
-	if thisClaimsRefresh {
-		resp, err := sc.httpClient.Get(sc.stravaUrl + "/maps")
-		if err != nil {
-			return err
-		}
-		resp.Body.Close()
-		sc.unclaimRefresh()
+func (sc *client) refresh() error {
+	resp, err := sc.httpClient.Get(sc.stravaUrl + "/maps")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	// Strava redirects to the login page, rather than returning an error
+	// status, when the session isn't valid.
+	if resp.StatusCode == http.StatusUnauthorized || isLoginPath(resp.Request.URL.Path) {
+		sc.setAuthState(AuthStateExpired)
+		return ErrSessionExpired
+	}
+	if resp.StatusCode >= 400 {
+		return errors.Errorf("refreshing CloudFront cookies: unexpected status %s", resp.Status)
 	}
+	sc.setAuthState(AuthStateOK)
 	return nil
 }
 
+func isLoginPath(path string) bool {
+	return path == "/login" || strings.HasPrefix(path, "/login/") || strings.HasPrefix(path, "/session")
+}
+
+// AuthState reports whether the session was accepted the last time
+// CloudFront cookies were refreshed.
+func (sc *client) AuthState() AuthState {
+	sc.authStateLock.Lock()
+	defer sc.authStateLock.Unlock()
+	return sc.authState
+}
+
+func (sc *client) setAuthState(state AuthState) {
+	sc.authStateLock.Lock()
+	sc.authState = state
+	sc.authStateLock.Unlock()
+}
+
 // CloudFrontExpiresAt returns the expiry time of the CloudFront signed cookies
 // by reading the _strava_CloudFront-Expires cookie from the jar.
 // Returns a zero time.Time if the cookie is absent or unparseable.
@@ -1,10 +1,12 @@
 package strava
 
 import (
+	"context"
 	"net/http"
 	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
+	"strconv"
 	"sync"
 	"testing"
 	"time"
@@ -81,6 +83,7 @@ func TestAthleteID(t *testing.T) {
 	// No token — should return error.
 	sc, err := NewClient("", "")
 	require.NoError(t, err)
+	defer sc.Close()
 	_, err = sc.AthleteID()
 	assert.Error(t, err)
 
@@ -89,8 +92,121 @@ func TestAthleteID(t *testing.T) {
 	token := "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOjk4NzY1fQ.fakesig"
 	sc, err = NewClient(token, "dummy")
 	require.NoError(t, err)
+	defer sc.Close()
 
 	id, err := sc.AthleteID()
 	require.NoError(t, err)
 	assert.Equal(t, "98765", id)
 }
+
+func TestSetSession(t *testing.T) {
+	// Payload: {"sub":98765}
+	sc, err := NewClient("eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOjk4NzY1fQ.fakesig", "dummy")
+	require.NoError(t, err)
+	defer sc.Close()
+
+	// Payload: {"sub":12345}
+	require.NoError(t, sc.SetSession(Session{
+		RememberToken: "eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9.eyJzdWIiOjEyMzQ1fQ.fakesig",
+		Session:       "other",
+	}))
+
+	id, err := sc.AthleteID()
+	require.NoError(t, err)
+	assert.Equal(t, "12345", id)
+}
+
+func TestRefreshCloudFrontCookies_expired(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/maps" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	sc := &client{
+		stravaUrl:  server.URL,
+		httpClient: &http.Client{Jar: jar},
+		authState:  AuthStateUnknown,
+	}
+
+	// Every coalesced caller sees the failure.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			assert.ErrorIs(t, sc.RefreshCloudFrontCookies(), ErrSessionExpired)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, AuthStateExpired, sc.AuthState())
+
+	// New credentials reset the state until they're tried.
+	require.NoError(t, sc.SetSession(Session{RememberToken: "a", Session: "b"}))
+	assert.Equal(t, AuthStateUnknown, sc.AuthState())
+}
+
+func TestRefreshLoop(t *testing.T) {
+	margin := time.Hour
+	var lock sync.Mutex
+	requestCount := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requestCount++
+		lock.Unlock()
+		// Expire just after the refresh margin, so the next refresh is due
+		// almost immediately.
+		expires := time.Now().Add(margin + 50*time.Millisecond)
+		http.SetCookie(w, &http.Cookie{
+			Name:  "_strava_CloudFront-Expires",
+			Value: strconv.FormatInt(expires.UnixMilli(), 10),
+			Path:  "/",
+		})
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	sc := &client{
+		stravaUrl:      server.URL,
+		httpClient:     &http.Client{Jar: jar},
+		refreshMargin:  margin,
+		cookiesChanged: make(chan struct{}, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan struct{})
+	go func() {
+		sc.refreshLoop(ctx)
+		close(stopped)
+	}()
+
+	// Nothing happens until there are cookies.
+	time.Sleep(100 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, 0, requestCount)
+	lock.Unlock()
+
+	// After the first reactive refresh, refreshes are scheduled ahead of
+	// expiry.
+	require.NoError(t, sc.RefreshCloudFrontCookies())
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return requestCount >= 3
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// Cancelling stops the loop, even with a refresh scheduled.
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("refresh loop didn't stop")
+	}
+}
@@ -1,6 +1,9 @@
 package strava
 
-import "errors"
+import (
+	"errors"
+	"slices"
+)
 
 const (
 	StravaDomain          = "https://www.strava.com"
@@ -10,6 +13,11 @@ const (
 	GlobalHeatmapPath     = "/identified/globalheat/%s/%s/%d/%d/%d@2x.png?%s"
 )
 
+const (
+	HeatmapMinZoom = 6  // below this, tiles are empty
+	HeatmapMaxZoom = 14 // above this, tiles aren't available
+)
+
 const (
 	ParamFilterType           = "filter_type"            // String
 	ParamFilterStart          = "filter_start"           // String 2006-01-02
@@ -22,13 +30,7 @@ const (
 )
 
 func ParseHeat(raw string) (Heat, error) {
-	if raw != string(HeatOrange) &&
-		raw != string(HeatRed) &&
-		raw != string(HeatMobileBlue) &&
-		raw != string(HeatBlue) &&
-		raw != string(HeatBlueRed) &&
-		raw != string(HeatPurple) &&
-		raw != string(HeatGray) {
+	if !slices.Contains(Heats, Heat(raw)) {
 		return "", errors.New("unknown heat color")
 	}
 	return Heat(raw), nil
@@ -11,3 +11,14 @@ const (
 	HeatPurple     Heat = "purple"
 	HeatGray       Heat = "gray"
 )
+
+// Heats lists every heat color.
+var Heats = []Heat{
+	HeatOrange,
+	HeatRed,
+	HeatMobileBlue,
+	HeatBlue,
+	HeatBlueRed,
+	HeatPurple,
+	HeatGray,
+}
@@ -0,0 +1,144 @@
+package strava
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Limit is how fast requests can be made to a host. Zero values are
+// unlimited.
+type Limit struct {
+	// Rate is the sustained number of requests per second, and Burst how many
+	// can be made at once after a quiet period.
+	Rate  float64
+	Burst int
+	// MaxInFlight is how many requests can be open at once, including reading
+	// their response bodies.
+	MaxInFlight int
+}
+
+// ParseLimit reads a limit formatted as "rate,burst,max_in_flight", e.g.
+// "10,20,4".
+func ParseLimit(raw string) (Limit, error) {
+	parts := strings.Split(raw, ",")
+	if len(parts) != 3 {
+		return Limit{}, errors.New("expected rate,burst,max_in_flight")
+	}
+	var l Limit
+	var err error
+	l.Rate, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || l.Rate < 0 {
+		return Limit{}, errors.New("rate must be a non-negative number")
+	}
+	l.Burst, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || l.Burst < 0 {
+		return Limit{}, errors.New("burst must be a non-negative integer")
+	}
+	l.MaxInFlight, err = strconv.Atoi(strings.TrimSpace(parts[2]))
+	if err != nil || l.MaxInFlight < 0 {
+		return Limit{}, errors.New("max_in_flight must be a non-negative integer")
+	}
+	return l, nil
+}
+
+// Limiter enforces a Limit, with a token bucket for the rate and a semaphore
+// for requests in flight. It can be shared by several clients, so every
+// account's requests to a host count together.
+type Limiter struct {
+	limit Limit
+	// slots has a value for each request in flight, and is nil if they're
+	// unlimited
+	slots chan struct{}
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewLimiter(limit Limit) *Limiter {
+	l := &Limiter{limit: limit}
+	if l.limit.Burst < 1 {
+		l.limit.Burst = 1
+	}
+	l.tokens = float64(l.limit.Burst)
+	if limit.MaxInFlight > 0 {
+		l.slots = make(chan struct{}, limit.MaxInFlight)
+	}
+	return l
+}
+
+// acquire waits until a request can be made, or ctx is done. release must be
+// called once the request is finished.
+func (l *Limiter) acquire(ctx context.Context) (release func(), err error) {
+	release = func() {}
+	if l.slots != nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case l.slots <- struct{}{}:
+		}
+		var once sync.Once
+		release = func() {
+			once.Do(func() { <-l.slots })
+		}
+	}
+	if err := l.wait(ctx); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// wait takes a token from the bucket, waiting for one to be added if it's
+// empty.
+func (l *Limiter) wait(ctx context.Context) error {
+	if l.limit.Rate <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		l.tokens = min(float64(l.limit.Burst), l.tokens+now.Sub(l.last).Seconds()*l.limit.Rate)
+	}
+	l.last = now
+	// take the token now, possibly going negative, so waiting requests are
+	// served in order
+	l.tokens--
+	delay := time.Duration(-l.tokens / l.limit.Rate * float64(time.Second))
+	l.lock.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		// give back the token this request won't use
+		l.lock.Lock()
+		l.tokens++
+		l.lock.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// releaseBody releases a request's limiter slot once its response body is
+// closed.
+type releaseBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
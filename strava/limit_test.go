@@ -0,0 +1,117 @@
+package strava
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLimit(t *testing.T) {
+	limit, err := ParseLimit("2.5, 10, 4")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{Rate: 2.5, Burst: 10, MaxInFlight: 4}, limit)
+
+	limit, err = ParseLimit("0,0,0")
+	require.NoError(t, err)
+	assert.Equal(t, Limit{}, limit)
+
+	for _, bad := range []string{"", "1,2", "1,2,3,4", "a,2,3", "1,2.5,3", "-1,2,3", "1,2,-3"} {
+		_, err := ParseLimit(bad)
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestLimiter_rate(t *testing.T) {
+	l := NewLimiter(Limit{Rate: 20, Burst: 2})
+	start := time.Now()
+	for range 4 {
+		release, err := l.acquire(context.Background())
+		require.NoError(t, err)
+		release()
+	}
+	// the burst is immediate, then a request every 50ms
+	assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+}
+
+func TestLimiter_cancel(t *testing.T) {
+	l := NewLimiter(Limit{Rate: 1, Burst: 1})
+	release, err := l.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the cancelled request's token is returned, so the next one waits no
+	// longer than it would have
+	l.lock.Lock()
+	assert.Greater(t, l.tokens, -0.5)
+	l.lock.Unlock()
+}
+
+func TestStravaTransport_limit(t *testing.T) {
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			m := maxInFlight.Load()
+			if n <= m || maxInFlight.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(t, err)
+
+	transport := &stravaTransport{limiters: map[string]*Limiter{
+		u.Hostname(): NewLimiter(Limit{MaxInFlight: 2}),
+	}}
+	httpClient := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	for range 6 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := httpClient.Get(server.URL)
+			if assert.NoError(t, err) {
+				res.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), maxInFlight.Load())
+
+	// a request stays in flight until its body is closed, and queued
+	// requests give up with their context
+	res, err := httpClient.Get(server.URL)
+	require.NoError(t, err)
+	res2, err := httpClient.Get(server.URL)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	_, err = httpClient.Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	res.Body.Close()
+	res2.Body.Close()
+	res, err = httpClient.Get(server.URL)
+	require.NoError(t, err)
+	res.Body.Close()
+}
@@ -0,0 +1,87 @@
+package strava
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	minRefreshBackoff = 10 * time.Second
+	maxRefreshBackoff = 10 * time.Minute
+)
+
+func (sc *client) notifyCookiesChanged() {
+	select {
+	case sc.cookiesChanged <- struct{}{}:
+	default:
+	}
+}
+
+// drainCookiesChanged discards a pending notification, e.g. from our own
+// refresh.
+func (sc *client) drainCookiesChanged() {
+	select {
+	case <-sc.cookiesChanged:
+	default:
+	}
+}
+
+// waitFor sleeps for d, returning false early if cookies change or ctx is
+// done.
+func (sc *client) waitFor(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-sc.cookiesChanged:
+		return false
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// waitForChange blocks until cookies change or ctx is done.
+func (sc *client) waitForChange(ctx context.Context) {
+	select {
+	case <-sc.cookiesChanged:
+	case <-ctx.Done():
+	}
+}
+
+// refreshLoop refreshes CloudFront cookies refreshMargin before they expire,
+// so tile requests don't have to wait for a refresh after being rejected.
+// Until there are cookies to go off, refreshes only happen reactively. It
+// returns once ctx is done.
+func (sc *client) refreshLoop(ctx context.Context) {
+	backoff := minRefreshBackoff
+	for ctx.Err() == nil {
+		expires := sc.CloudFrontExpiresAt()
+		if expires.IsZero() {
+			sc.waitForChange(ctx)
+			continue
+		}
+		if !sc.waitFor(ctx, time.Until(expires.Add(-sc.refreshMargin))) {
+			continue
+		}
+
+		err := sc.RefreshCloudFrontCookies()
+		sc.drainCookiesChanged()
+		if err == nil && time.Until(sc.CloudFrontExpiresAt()) > sc.refreshMargin {
+			backoff = minRefreshBackoff
+			continue
+		}
+		if errors.Is(err, ErrSessionExpired) {
+			// retrying won't help, wait for new credentials
+			sc.waitForChange(ctx)
+			continue
+		}
+
+		// the refresh failed, or didn't extend the cookies, so back off rather
+		// than retrying immediately
+		sc.waitFor(ctx, backoff)
+		backoff = min(backoff*2, maxRefreshBackoff)
+	}
+}
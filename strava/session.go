@@ -0,0 +1,61 @@
+package strava
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	EnvRememberToken = "STRAVA_REMEMBER_TOKEN"
+	EnvSession       = "STRAVA4_SESSION"
+)
+
+// Session holds the cookie values used to authenticate with Strava.
+type Session struct {
+	RememberToken string
+	Session       string
+}
+
+// ReadSessionFile parses a session file as written by cmd/auth, a list of
+// KEY=VALUE lines.
+func ReadSessionFile(path string) (Session, error) {
+	var session Session
+	f, err := os.Open(path)
+	if err != nil {
+		return session, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return session, errors.Errorf("%s: malformed line %q", path, line)
+		}
+		value = strings.Trim(strings.TrimSpace(value), `"'`)
+		switch strings.TrimSpace(strings.TrimPrefix(key, "export ")) {
+		case EnvRememberToken:
+			session.RememberToken = value
+		case EnvSession:
+			session.Session = value
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return session, errors.Wrapf(err, "reading %s", path)
+	}
+
+	if session.RememberToken == "" {
+		return session, errors.Errorf("%s: missing %s", path, EnvRememberToken)
+	}
+	if session.Session == "" {
+		return session, errors.Errorf("%s: missing %s", path, EnvSession)
+	}
+	return session, nil
+}
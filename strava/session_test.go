@@ -0,0 +1,36 @@
+package strava
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadSessionFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".env.auth")
+
+	require.NoError(t, os.WriteFile(path, []byte("STRAVA_REMEMBER_TOKEN=abc.def.ghi\nSTRAVA4_SESSION=xyz\n"), 0600))
+	session, err := ReadSessionFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, Session{RememberToken: "abc.def.ghi", Session: "xyz"}, session)
+
+	// Tolerates comments, quoting and exports.
+	require.NoError(t, os.WriteFile(path, []byte("# saved by cmd/auth\nexport STRAVA_REMEMBER_TOKEN=\"abc\"\n\nSTRAVA4_SESSION='xyz'\nOTHER=1\n"), 0600))
+	session, err = ReadSessionFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, Session{RememberToken: "abc", Session: "xyz"}, session)
+
+	require.NoError(t, os.WriteFile(path, []byte("STRAVA_REMEMBER_TOKEN=abc\n"), 0600))
+	_, err = ReadSessionFile(path)
+	assert.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, []byte("garbage\n"), 0600))
+	_, err = ReadSessionFile(path)
+	assert.Error(t, err)
+
+	_, err = ReadSessionFile(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
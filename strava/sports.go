@@ -1,5 +1,7 @@
 package strava
 
+import "strings"
+
 type Sport string
 
 const (
@@ -40,3 +42,68 @@ const (
 
 	// this isn't complete
 )
+
+// SportGroup is a category of sports, as used to filter the global heatmap.
+type SportGroup string
+
+const (
+	SportGroupAll    SportGroup = "all"
+	SportGroupRun    SportGroup = "run"
+	SportGroupRide   SportGroup = "ride"
+	SportGroupWater  SportGroup = "water"
+	SportGroupWinter SportGroup = "winter"
+)
+
+// SportGroups lists every group, in display order.
+var SportGroups = []SportGroup{
+	SportGroupAll,
+	SportGroupRun,
+	SportGroupRide,
+	SportGroupWater,
+	SportGroupWinter,
+}
+
+var sportGroupSports = map[SportGroup][]Sport{
+	SportGroupRun: {SportRun, SportTrailRun, SportWalk, SportHike},
+	SportGroupRide: {
+		SportRide,
+		SportMountainBikeRide,
+		SportGravelRide,
+		SportEBikeRide,
+		SportEMountainBikeRide,
+		SportVelomobile,
+	},
+	SportGroupWater: {
+		SportCanoeing,
+		SportKayaking,
+		SportKitesurf,
+		SportRowing,
+		SportSail,
+		SportStandUpPaddling,
+		SportSurfing,
+		SportSwim,
+		SportWindsurf,
+	},
+	SportGroupWinter: {
+		SportAlpineSki,
+		SportBackcountrySki,
+		SportIceSkate,
+		SportNordicSki,
+		SportSnowboard,
+		SportSnowshoe,
+	},
+}
+
+// PersonalFilter returns the filter_type value that selects the sports in the
+// group on personal heatmaps, which don't understand groups.
+func (g SportGroup) PersonalFilter() string {
+	sports, ok := sportGroupSports[g]
+	if !ok {
+		return string(SportAll)
+	}
+	filter := make([]string, len(sports))
+	for i, sport := range sports {
+		filter[i] = string(sport)
+	}
+	return strings.Join(filter, ",")
+}
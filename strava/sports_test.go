@@ -0,0 +1,12 @@
+package strava
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSportGroupPersonalFilter(t *testing.T) {
+	assert.Equal(t, "all", SportGroupAll.PersonalFilter())
+	assert.Equal(t, "sport_Run,sport_TrailRun,sport_Walk,sport_Hike", SportGroupRun.PersonalFilter())
+}
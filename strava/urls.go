@@ -0,0 +1,52 @@
+package strava
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// HeatmapFilter selects the activities drawn on a personal heatmap.
+type HeatmapFilter struct {
+	// Sports is a comma separated list of sports, see SportGroup.PersonalFilter
+	Sports string
+	// Start and End are formatted as 2006-01-02, and empty if unbounded
+	Start string
+	End   string
+
+	IncludeCommutes bool
+
+	RevealPrivacyZones           bool
+	RevealOnlyMeActivities       bool
+	RevealFollowerOnlyActivities bool
+	RevealPublicActivities       bool
+}
+
+// GlobalHeatmapURL returns the URL of a global heatmap tile, where domain is
+// usually GlobalHeatmapDomain.
+func GlobalHeatmapURL(domain, sports string, color Heat, z, x, y uint64) string {
+	query := url.Values{
+		"v": []string{"19"},
+	}
+	return fmt.Sprintf(domain+GlobalHeatmapPath, sports, color, z, x, y, query.Encode())
+}
+
+// PersonalHeatmapURL returns the URL of an athlete's personal heatmap tile,
+// where domain is usually PersonalHeatmapDomain.
+func PersonalHeatmapURL(domain, athleteID string, color Heat, z, x, y uint64, filter HeatmapFilter) string {
+	query := url.Values{
+		ParamFilterType:           []string{filter.Sports},
+		ParamRespectPrivacyZones:  []string{strconv.FormatBool(!filter.RevealPrivacyZones)},
+		ParamIncludeEveryone:      []string{strconv.FormatBool(filter.RevealPublicActivities)},
+		ParamIncludeFollowersOnly: []string{strconv.FormatBool(filter.RevealFollowerOnlyActivities)},
+		ParamIncludeOnlyMe:        []string{strconv.FormatBool(filter.RevealOnlyMeActivities)},
+		ParamIncludeCommutes:      []string{strconv.FormatBool(filter.IncludeCommutes)},
+	}
+	if filter.Start != "" {
+		query.Set(ParamFilterStart, filter.Start)
+	}
+	if filter.End != "" {
+		query.Set(ParamFilterEnd, filter.End)
+	}
+	return fmt.Sprintf(domain+PersonalHeatmapPath, athleteID, color, z, x, y, query.Encode())
+}
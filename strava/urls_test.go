@@ -0,0 +1,23 @@
+package strava
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeatmapURLs(t *testing.T) {
+	assert.Equal(t,
+		"https://content-a.strava.com/identified/globalheat/ride/purple/10/163/357@2x.png?v=19",
+		GlobalHeatmapURL(GlobalHeatmapDomain, "ride", HeatPurple, 10, 163, 357),
+	)
+
+	assert.Equal(t,
+		"https://personal-heatmaps-external.strava.com/tiles/123/orange/10/163/357@2x.png?filter_end=2024-12-31&filter_type=Run&include_commutes=false&include_everyone=true&include_followers_only=false&include_only_me=false&respect_privacy_zones=true",
+		PersonalHeatmapURL(PersonalHeatmapDomain, "123", HeatOrange, 10, 163, 357, HeatmapFilter{
+			Sports:                 "Run",
+			End:                    "2024-12-31",
+			RevealPublicActivities: true,
+		}),
+	)
+}